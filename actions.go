@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cool-rest/rest-layer/resource"
+)
+
+// action describes the target of a custom action request
+type action struct {
+	// Resource is the name of the resource the action is mounted on
+	Resource string
+	// ID is the item ID for item actions, empty for collection actions
+	ID string
+	// Args holds the path segments following the action name
+	Args []string
+}
+
+// actionHandler serves a custom action
+type actionHandler func(w http.ResponseWriter, r *http.Request, a action)
+
+// actionRouter serves custom actions mounted on the resources paths, next to
+// the REST API, like /{resource}/trash for collection actions and
+// /{resource}/{id}/restore for item actions. Other requests go to the API.
+type actionRouter struct {
+	collection map[string]map[string]actionHandler
+	item       map[string]map[string]actionHandler
+}
+
+func newActionRouter() *actionRouter {
+	return &actionRouter{
+		collection: map[string]map[string]actionHandler{},
+		item:       map[string]map[string]actionHandler{},
+	}
+}
+
+// HandleCollection mounts h on /{resource}/{name} for each resource
+func (a *actionRouter) HandleCollection(resources []string, name string, h actionHandler) {
+	for _, res := range resources {
+		if a.collection[res] == nil {
+			a.collection[res] = map[string]actionHandler{}
+		}
+		a.collection[res][name] = h
+	}
+}
+
+// HandleItem mounts h on /{resource}/{id}/{name} for each resource
+func (a *actionRouter) HandleItem(resources []string, name string, h actionHandler) {
+	for _, res := range resources {
+		if a.item[res] == nil {
+			a.item[res] = map[string]actionHandler{}
+		}
+		a.item[res][name] = h
+	}
+}
+
+// Handler returns a middleware serving the actions and passing through the
+// other requests
+func (a *actionRouter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(segments) >= 2 {
+			if h, found := a.collection[segments[0]][segments[1]]; found {
+				h(w, r, action{Resource: segments[0], Args: segments[2:]})
+				return
+			}
+		}
+		if len(segments) >= 3 {
+			if h, found := a.item[segments[0]][segments[2]]; found {
+				h(w, r, action{Resource: segments[0], ID: segments[1], Args: segments[3:]})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowMethods responds with a 405 error and returns false if the request
+// method is not one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	return false
+}
+
+// writeResourceError responds with err, using its status if it is a
+// resource.Error
+func writeResourceError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*resource.Error); ok {
+		if len(e.Issues) > 0 {
+			writeJSON(w, e.Code, map[string]interface{}{
+				"code":    e.Code,
+				"message": e.Message,
+				"issues":  e.Issues,
+			})
+			return
+		}
+		writeError(w, e.Code, e.Message)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// pagination reads the page and limit query parameters
+func pagination(r *http.Request, defaultLimit int) (page, perPage int) {
+	page, perPage = 1, defaultLimit
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		perPage = l
+	}
+	return page, perPage
+}
+
+// writeItems sends items the way REST Layer sends lists, with the total
+// count in the X-Total header when known
+func writeItems(w http.ResponseWriter, list *resource.ItemList) {
+	if list.Total >= 0 {
+		w.Header().Set("X-Total", strconv.Itoa(list.Total))
+	}
+	payloads := make([]map[string]interface{}, 0, len(list.Items))
+	for _, item := range list.Items {
+		payloads = append(payloads, item.Payload)
+	}
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// writeItem sends item the way REST Layer does, with its ETag header
+func writeItem(w http.ResponseWriter, status int, item *resource.Item) {
+	w.Header().Set("Etag", `W/"`+item.ETag+`"`)
+	writeJSON(w, status, item.Payload)
+}
+
+// decodePayload decodes the JSON body of the request into v
+func decodePayload(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "Malformed body: "+err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"github.com/cool-rest/xlog"
+	"golang.org/x/net/context"
+)
+
+// auditEntry is the schema of the audit log entries
+var auditEntry = schema.Schema{
+	Fields: schema.Fields{
+		"id": schema.IDField,
+		"created": {
+			ReadOnly:   true,
+			Filterable: true,
+			Sortable:   true,
+			OnInit:     schema.Now,
+			Validator:  &schema.Time{},
+		},
+		// actor is the user ID of the JWT token, or the name of the internal
+		// operation
+		"actor": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"request_id": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"resource": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"item_id": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"action": {
+			Filterable: true,
+			Validator: &schema.String{
+				Allowed: []string{"insert", "update", "delete", "clear", "purge"},
+			},
+		},
+		// diff holds the changed fields as {"field": {"from": old, "to": new}}
+		"diff": {
+			Validator: &schema.Dict{},
+		},
+		// count is the number of items removed by a clear
+		"count": {
+			Validator: &schema.Integer{},
+		},
+	},
+}
+
+// auditLog records the mutations of the resources in the append-only audit
+// resource. Entries are written straight to the storage so they can't be
+// altered through the API.
+type auditLog struct {
+	audit  *resource.Resource
+	storer resource.Storer
+}
+
+// Hook returns the hook recording the mutations of the name resource. The
+// values of the hidden fields of sch, like passwords, are not recorded.
+func (l *auditLog) Hook(name string, sch schema.Schema) auditHook {
+	hidden := map[string]bool{}
+	for field, def := range sch.Fields {
+		if def.Hidden {
+			hidden[field] = true
+		}
+	}
+	return auditHook{log: l, resource: name, hidden: hidden}
+}
+
+// record appends an entry to the audit log. Failures are logged but don't
+// fail the mutation, which already happened.
+func (l *auditLog) record(ctx context.Context, res, action string, itemID interface{}, fields map[string]interface{}) {
+	payload := map[string]interface{}{
+		"resource": res,
+		"action":   action,
+	}
+	if actor, ok := ActorFromContext(ctx); ok {
+		payload["actor"] = actor
+	}
+	if id, ok := xlog.IDFromContext(ctx); ok {
+		payload["request_id"] = id.String()
+	}
+	if itemID != nil {
+		payload["item_id"] = fmt.Sprint(itemID)
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	sch := l.audit.Schema()
+	changes, base := sch.Prepare(ctx, payload, nil, false)
+	doc, errs := sch.Validate(changes, base)
+	if len(errs) > 0 {
+		log.Printf("Invalid %s audit entry: %v", res, errs)
+		return
+	}
+	item, err := resource.NewItem(doc)
+	if err == nil {
+		err = l.storer.Insert(ctx, []*resource.Item{item})
+	}
+	if err != nil {
+		log.Printf("Can't record %s %s audit entry: %s", res, action, err)
+	}
+}
+
+// Purged records an item purged from the trash
+func (l *auditLog) Purged(ctx context.Context, res string, item *resource.Item) {
+	l.record(ctx, res, "purge", item.ID, map[string]interface{}{"diff": diff(item.Payload, nil)})
+}
+
+// diff returns the fields changed between before and after. Nil payloads
+// stand for missing items.
+func diff(before, after map[string]interface{}) map[string]interface{} {
+	d := map[string]interface{}{}
+	for k, v := range before {
+		if w, found := after[k]; !found || !reflect.DeepEqual(v, w) {
+			d[k] = map[string]interface{}{"from": v, "to": after[k]}
+		}
+	}
+	for k, w := range after {
+		if _, found := before[k]; !found {
+			d[k] = map[string]interface{}{"from": nil, "to": w}
+		}
+	}
+	return d
+}
+
+// auditHook records the mutations of a resource to the audit log
+type auditHook struct {
+	log      *auditLog
+	resource string
+	hidden   map[string]bool
+}
+
+// diff returns the diff between before and after with the hidden fields
+// values masked
+func (h auditHook) diff(before, after map[string]interface{}) map[string]interface{} {
+	d := diff(before, after)
+	for field, change := range d {
+		if h.hidden[field] {
+			c := change.(map[string]interface{})
+			for k, v := range c {
+				if v != nil {
+					c[k] = "[hidden]"
+				}
+			}
+		}
+	}
+	return d
+}
+
+// OnInserted implements resource.InsertedEventHandler interface
+func (h auditHook) OnInserted(ctx context.Context, r *http.Request, items []*resource.Item, err *error) {
+	if *err != nil {
+		return
+	}
+	for _, item := range items {
+		h.log.record(ctx, h.resource, "insert", item.ID, map[string]interface{}{"diff": h.diff(nil, item.Payload)})
+	}
+}
+
+// OnUpdated implements resource.UpdatedEventHandler interface
+func (h auditHook) OnUpdated(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item, err *error) {
+	if *err == nil {
+		h.log.record(ctx, h.resource, "update", item.ID, map[string]interface{}{"diff": h.diff(original.Payload, item.Payload)})
+	}
+}
+
+// OnDeleted implements resource.DeletedEventHandler interface
+func (h auditHook) OnDeleted(ctx context.Context, r *http.Request, item *resource.Item, err *error) {
+	if *err == nil {
+		h.log.record(ctx, h.resource, "delete", item.ID, map[string]interface{}{"diff": h.diff(item.Payload, nil)})
+	}
+}
+
+// OnCleared implements resource.ClearedEventHandler interface
+func (h auditHook) OnCleared(ctx context.Context, r *http.Request, lookup *resource.Lookup, deleted *int, err *error) {
+	if *err == nil {
+		h.log.record(ctx, h.resource, "clear", nil, map[string]interface{}{"count": *deleted})
+	}
+}
+
+// AdminResourceHook is a resource event handler restricting the access to
+// admins
+type AdminResourceHook struct {
+	users *resource.Resource
+}
+
+// OnFind implements resource.FindEventHandler interface
+func (a AdminResourceHook) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	return a.checkAdmin(ctx, r)
+}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (a AdminResourceHook) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	return a.checkAdmin(ctx, r)
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (a AdminResourceHook) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	return a.checkAdmin(ctx, r)
+}
+
+// OnDelete implements resource.DeleteEventHandler interface
+func (a AdminResourceHook) OnDelete(ctx context.Context, r *http.Request, item *resource.Item) error {
+	return a.checkAdmin(ctx, r)
+}
+
+// OnClear implements resource.ClearEventHandler interface
+func (a AdminResourceHook) OnClear(ctx context.Context, r *http.Request, lookup *resource.Lookup) error {
+	return a.checkAdmin(ctx, r)
+}
+
+// OnGot implements resource.GotEventHandler interface
+func (a AdminResourceHook) OnGot(ctx context.Context, r *http.Request, item **resource.Item, err *error) {
+	if *err != nil {
+		return
+	}
+	if e := a.checkAdmin(ctx, r); e != nil {
+		*err = e
+	}
+}
+
+func (a AdminResourceHook) checkAdmin(ctx context.Context, r *http.Request) error {
+	if isSystemContext(ctx) {
+		return nil
+	}
+	user, found := UserFromToken(a.users, ctx, r)
+	if !found {
+		return resource.ErrUnauthorized
+	}
+	if !hasRole(user, "admin") {
+		return resource.ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+// bookmarkedResources are the resources whose items can be bookmarked
+var bookmarkedResources = []string{"feed", "news", "video", "photo"}
+
+// bookmark is an item saved by a user
+var bookmark = schema.Schema{
+	Fields: schema.Fields{
+		"id":      schema.IDField,
+		"created": schema.CreatedField,
+		"updated": schema.UpdatedField,
+		// user is the owner of the bookmark, set by the OwnerResourceHook
+		"user": {
+			Filterable: true,
+			Validator: &schema.Reference{
+				Path: "users",
+			},
+		},
+		"resource": {
+			Required:   true,
+			Filterable: true,
+			Validator: &schema.String{
+				Allowed: bookmarkedResources,
+			},
+		},
+		// item is the ID of the bookmarked item in resource
+		"item": {
+			Required:   true,
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"folder": {
+			Filterable: true,
+			Sortable:   true,
+			Validator: &schema.String{
+				MaxLen: 100,
+			},
+		},
+		"tags": {
+			Filterable: true,
+			Validator: &schema.Array{
+				ValuesValidator: &schema.String{},
+			},
+		},
+		"note": {
+			Validator: &schema.String{
+				MaxLen: 1000,
+			},
+		},
+	},
+}
+
+// bookmarks checks the bookmarked items, serves /me/bookmarks and drops the
+// bookmarks of the items purged from the trash
+type bookmarks struct {
+	bookmarks *resource.Resource
+	resources map[string]*resource.Resource
+}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (b *bookmarks) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	for _, item := range items {
+		if err := b.check(ctx, item.Payload); err != nil {
+			return err
+		}
+		// Items are bookmarked once per user
+		lookup := resource.NewLookup()
+		lookup.AddQuery(schema.Query{
+			schema.Equal{Field: "user", Value: item.Payload["user"]},
+			schema.Equal{Field: "resource", Value: item.Payload["resource"]},
+			schema.Equal{Field: "item", Value: item.Payload["item"]},
+		})
+		list, err := b.bookmarks.Find(NewContextWithSystemActor(ctx, "bookmarks"), nil, lookup, 1, 1)
+		if err != nil {
+			return err
+		}
+		if len(list.Items) > 0 {
+			return &resource.Error{Code: http.StatusConflict, Message: "Item already bookmarked"}
+		}
+	}
+	return nil
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (b *bookmarks) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	if item.Payload["resource"] != original.Payload["resource"] || item.Payload["item"] != original.Payload["item"] {
+		return &resource.Error{Code: 422, Message: "The bookmarked item can't be changed"}
+	}
+	return nil
+}
+
+// check tells if the bookmarked item exists
+func (b *bookmarks) check(ctx context.Context, payload map[string]interface{}) error {
+	name, _ := payload["resource"].(string)
+	res := b.resources[name]
+	if res == nil {
+		return &resource.Error{Code: 422, Message: fmt.Sprintf("Can't bookmark %s items", name)}
+	}
+	if _, err := res.Get(NewContextWithSystemActor(ctx, "bookmarks"), nil, payload["item"]); err != nil {
+		if err == resource.ErrNotFound {
+			return &resource.Error{Code: 422, Message: "Bookmarked item not found"}
+		}
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP serves GET /me/bookmarks, the bookmarks of the user with the
+// bookmarked items expanded in their item_data field, newest first. They can
+// be filtered by folder and tag. Bookmarks of the items in the trash are
+// left out until the items are restored or purged.
+func (b *bookmarks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	ctx := r.Context()
+	lookup := resource.NewLookup()
+	q := schema.Query{}
+	if folder := r.URL.Query().Get("folder"); folder != "" {
+		q = append(q, schema.Equal{Field: "folder", Value: folder})
+	}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		q = append(q, schema.In{Field: "tags", Values: []schema.Value{tag}})
+	}
+	if len(q) > 0 {
+		lookup.AddQuery(q)
+	}
+	if err := lookup.SetSort("-created", b.bookmarks.Validator()); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	page, perPage := pagination(r, 20)
+	// The OwnerResourceHook authenticates the user and restricts to its bookmarks
+	list, err := b.bookmarks.Find(ctx, r, lookup, page, perPage)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+
+	payloads, err := expandItems(NewContextWithSystemActor(ctx, "bookmarks"), b.resources, list.Items)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// expandItems returns the payloads of refs, items referencing an item with
+// their resource and item fields, with the referenced item payload in their
+// item_data field. The refs whose item is not found are left out.
+func expandItems(ctx context.Context, resources map[string]*resource.Resource, refs []*resource.Item) ([]map[string]interface{}, error) {
+	// Fetch the referenced items with one request per resource
+	ids := map[string][]interface{}{}
+	for _, ref := range refs {
+		name, _ := ref.Payload["resource"].(string)
+		ids[name] = append(ids[name], ref.Payload["item"])
+	}
+	found := map[string]*resource.Item{}
+	for name, resIDs := range ids {
+		res := resources[name]
+		if res == nil {
+			continue
+		}
+		items, err := res.MultiGet(ctx, nil, resIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if item != nil {
+				found[name+"/"+fmt.Sprint(item.ID)] = item
+			}
+		}
+	}
+	payloads := []map[string]interface{}{}
+	for _, ref := range refs {
+		item := found[fmt.Sprintf("%v/%v", ref.Payload["resource"], ref.Payload["item"])]
+		if item == nil {
+			continue
+		}
+		payload := map[string]interface{}{}
+		for k, v := range ref.Payload {
+			payload[k] = v
+		}
+		payload["item_data"] = item.Payload
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+// Purged drops the bookmarks of an item purged from the trash
+func (b *bookmarks) Purged(ctx context.Context, res string, item *resource.Item) {
+	if b.resources[res] == nil {
+		return
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: res},
+		schema.Equal{Field: "item", Value: fmt.Sprint(item.ID)},
+	})
+	if _, err := b.bookmarks.Clear(ctx, nil, lookup); err != nil {
+		log.Printf("Can't drop the bookmarks of %s/%v: %s", res, item.ID, err)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"golang.org/x/net/context"
+)
+
+var (
+	cacheTTLs       = flag.String("cache-ttl", "feed=30s,categories=5m", "Comma separated response cache TTLs as resource=duration; resources not listed are not cached")
+	cacheStale      = flag.Duration("cache-stale", time.Minute, "How long an expired cached response may still be served while it is refreshed in the background")
+	cacheMaxEntries = flag.Int("cache-max-entries", 10000, "Maximum number of cached responses")
+)
+
+// parseCacheTTLs parses a -cache-ttl spec into TTLs keyed by resource
+func parseCacheTTLs(spec string) (map[string]time.Duration, error) {
+	ttls := map[string]time.Duration{}
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid cache TTL %q: expected resource=duration", rule)
+		}
+		ttl, err := time.ParseDuration(kv[1])
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid cache TTL %q: expected a positive duration", rule)
+		}
+		ttls[kv[0]] = ttl
+	}
+	return ttls, nil
+}
+
+// cachedResponse is a response stored by the response cache
+type cachedResponse struct {
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	refreshing bool
+}
+
+// responseCache caches GET responses of the REST API in process. Responses
+// are keyed by resource, normalized URL and auth scope, expire after the
+// resource TTL and are served stale for a while longer while being refreshed.
+type responseCache struct {
+	clock      clock
+	ttls       map[string]time.Duration
+	stale      time.Duration
+	maxEntries int
+	// variants holds the resources whose items are decorated for each user.
+	// Their ETags are made per user so a version validated by a user is
+	// never reused for another one.
+	variants map[string]bool
+
+	mu          sync.Mutex
+	entries     map[string]map[string]*cachedResponse
+	generations map[string]uint64
+}
+
+func newResponseCache(c clock, ttls map[string]time.Duration, stale time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		clock:       c,
+		ttls:        ttls,
+		stale:       stale,
+		maxEntries:  maxEntries,
+		variants:    map[string]bool{},
+		entries:     map[string]map[string]*cachedResponse{},
+		generations: map[string]uint64{},
+	}
+}
+
+// Invalidate drops all the cached responses of a resource
+func (c *responseCache) Invalidate(res string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, res)
+	// Responses being computed while the resource changed must not be stored
+	c.generations[res]++
+}
+
+func (c *responseCache) generation(res string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[res]
+}
+
+// get returns the entry stored under key and whether the caller should
+// refresh it in the background
+func (c *responseCache) get(res, key string) (entry *cachedResponse, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[res][key]
+	if !found {
+		return nil, false
+	}
+	age := c.clock.Now().Sub(entry.stored)
+	ttl := c.ttls[res]
+	if age >= ttl+c.stale {
+		delete(c.entries[res], key)
+		return nil, false
+	}
+	if age >= ttl && !entry.refreshing {
+		entry.refreshing = true
+		return entry, true
+	}
+	return entry, false
+}
+
+// set stores entry unless the resource was invalidated since generation
+func (c *responseCache) set(res, key string, generation uint64, entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[res] != generation {
+		return
+	}
+	if c.size() >= c.maxEntries {
+		c.evictExpired()
+		if c.size() >= c.maxEntries {
+			return
+		}
+	}
+	if c.entries[res] == nil {
+		c.entries[res] = map[string]*cachedResponse{}
+	}
+	c.entries[res][key] = entry
+}
+
+func (c *responseCache) size() int {
+	n := 0
+	for _, entries := range c.entries {
+		n += len(entries)
+	}
+	return n
+}
+
+func (c *responseCache) evictExpired() {
+	now := c.clock.Now()
+	for res, entries := range c.entries {
+		for key, entry := range entries {
+			if now.Sub(entry.stored) >= c.ttls[res]+c.stale {
+				delete(entries, key)
+			}
+		}
+	}
+}
+
+// key returns the cache key of the request and false if it must not be cached
+func (c *responseCache) key(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet {
+		return "", false
+	}
+	// Let conditional and explicitly uncached requests go through
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" ||
+		strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return "", false
+	}
+	scope, ok := authScope(r)
+	if !ok {
+		return "", false
+	}
+	// url.Values.Encode sorts parameters by key
+	return scope + "|" + r.URL.Path + "?" + r.URL.Query().Encode(), true
+}
+
+// authScope returns the hash of the user authenticated by r, anonymous
+// without authorization, and false if the authorization is invalid
+func authScope(r *http.Request) (string, bool) {
+	if r.Header.Get("Authorization") == "" {
+		return "anonymous", true
+	}
+	userID, ok := UserIDFromToken(r)
+	if !ok {
+		return "", false
+	}
+	sum := sha1.Sum([]byte(userID))
+	return "user:" + hex.EncodeToString(sum[:]), true
+}
+
+// Handler returns a middleware serving GET requests from the cache
+func (c *responseCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := resourceName(r.URL.Path)
+		if c.variants[res] {
+			if scope, ok := authScope(r); ok && scope != "anonymous" {
+				w, r = varyETags(w, r, scope[len("user:"):len("user:")+8])
+			}
+		}
+		ttl, cached := c.ttls[res]
+		key, ok := c.key(r)
+		if !cached || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if entry, refresh := c.get(res, key); entry != nil {
+			if refresh {
+				go c.fill(res, key, next, r.WithContext(refreshContext(r.Context())))
+			}
+			c.write(w, entry, ttl, true)
+			return
+		}
+		entry := c.fill(res, key, next, r)
+		c.write(w, entry, ttl, false)
+	})
+}
+
+// fill runs the request through next and caches the response if successful
+func (c *responseCache) fill(res, key string, next http.Handler, r *http.Request) *cachedResponse {
+	generation := c.generation(res)
+	rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+	entry := &cachedResponse{
+		status: rec.status,
+		header: rec.header,
+		body:   rec.body.Bytes(),
+		stored: c.clock.Now(),
+	}
+	if entry.status == http.StatusOK {
+		c.set(res, key, generation, entry)
+	}
+	return entry
+}
+
+// write sends a response with its Age and Cache-Control headers
+func (c *responseCache) write(w http.ResponseWriter, entry *cachedResponse, ttl time.Duration, hit bool) {
+	h := w.Header()
+	for k, v := range entry.header {
+		h[k] = v
+	}
+	if entry.status == http.StatusOK {
+		age := c.clock.Now().Sub(entry.stored)
+		maxAge := ttl - age
+		status := "HIT"
+		if !hit {
+			status = "MISS"
+		} else if maxAge < 0 {
+			maxAge = 0
+			status = "STALE"
+		}
+		h.Set("Age", strconv.Itoa(int(age.Seconds())))
+		h.Set("Cache-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d", int(maxAge.Seconds()), int(c.stale.Seconds())))
+		h.Set("X-Cache", status)
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// responseRecorder buffers a response so it can be cached
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// refreshContext returns the context of the background refresh of a cached
+// response requested with ctx. It only keeps the actor markers of ctx, the
+// other values, like the logger, belonging to the request.
+func refreshContext(ctx context.Context) context.Context {
+	fresh := context.Background()
+	if actor, ok := ctx.Value(actorKey).(string); ok {
+		fresh = NewContextWithActor(fresh, actor)
+	}
+	if actor, ok := ctx.Value(systemActorKey).(string); ok {
+		fresh = NewContextWithSystemActor(fresh, actor)
+	}
+	return fresh
+}
+
+// varyETags makes the ETags of the response to r specific to variant, and
+// takes them back from the conditional headers of r. The If-None-Match ETags
+// of other variants are dropped for their versions not to be validated.
+func varyETags(w http.ResponseWriter, r *http.Request, variant string) (http.ResponseWriter, *http.Request) {
+	suffix := "-" + variant + `"`
+	header := http.Header{}
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	for _, name := range []string{"If-None-Match", "If-Match"} {
+		v := header.Get(name)
+		if v == "" {
+			continue
+		}
+		tags := []string{}
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			switch {
+			case strings.HasSuffix(tag, suffix):
+				tags = append(tags, strings.TrimSuffix(tag, suffix)+`"`)
+			case name == "If-Match" || tag == "*":
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			header.Del(name)
+		} else {
+			header.Set(name, strings.Join(tags, ", "))
+		}
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = header
+	return &etagWriter{ResponseWriter: w, suffix: suffix}, r2
+}
+
+// etagWriter appends suffix to the ETag of a response
+type etagWriter struct {
+	http.ResponseWriter
+	suffix      string
+	wroteHeader bool
+}
+
+func (w *etagWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if etag := w.Header().Get("Etag"); strings.HasSuffix(etag, `"`) {
+			w.Header().Set("Etag", strings.TrimSuffix(etag, `"`)+w.suffix)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// cacheInvalidationHook drops the cached responses of a resource when one of
+// its items changes
+type cacheInvalidationHook struct {
+	cache    *responseCache
+	resource string
+}
+
+// OnInserted implements resource.InsertedEventHandler interface
+func (h cacheInvalidationHook) OnInserted(ctx context.Context, r *http.Request, items []*resource.Item, err *error) {
+	if *err == nil {
+		h.cache.Invalidate(h.resource)
+	}
+}
+
+// OnUpdated implements resource.UpdatedEventHandler interface
+func (h cacheInvalidationHook) OnUpdated(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item, err *error) {
+	if *err == nil {
+		h.cache.Invalidate(h.resource)
+	}
+}
+
+// OnDeleted implements resource.DeletedEventHandler interface
+func (h cacheInvalidationHook) OnDeleted(ctx context.Context, r *http.Request, item *resource.Item, err *error) {
+	if *err == nil {
+		h.cache.Invalidate(h.resource)
+	}
+}
+
+// OnCleared implements resource.ClearedEventHandler interface
+func (h cacheInvalidationHook) OnCleared(ctx context.Context, r *http.Request, lookup *resource.Lookup, deleted *int, err *error) {
+	if *err == nil {
+		h.cache.Invalidate(h.resource)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "time"
+
+// clock tells the current time. It is injected in time dependent components
+// so they can be tested with a fake clock.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock backed by the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
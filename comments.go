@@ -0,0 +1,438 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	commentEditWindow   = flag.Duration("comment-edit-window", 15*time.Minute, "How long after posting authors can edit their comments")
+	commentMaxDepth     = flag.Int("comment-max-depth", 8, "Maximum nesting level of the comment replies")
+	commentPremoderated = flag.Bool("comment-premoderation", false, "Hold the new comments as pending until a moderator publishes them")
+)
+
+// commentStatuses are the moderation states of the comments. Only published
+// comments are counted and shown to everyone.
+var commentStatuses = []string{"published", "pending", "hidden"}
+
+// commentThreadLimit is the maximum number of comments of an item threaded
+// by /{resource}/{id}/comments
+const commentThreadLimit = 1000
+
+// comment is a comment on a content item, or a reply to another comment
+var comment = schema.Schema{
+	Fields: schema.Fields{
+		"id":      schema.IDField,
+		"created": schema.CreatedField,
+		"updated": schema.UpdatedField,
+		// user is the author, set by the AuthResourceHook
+		"user": {
+			Filterable: true,
+			Validator: &schema.Reference{
+				Path: "users",
+			},
+		},
+		"resource": {
+			Required:   true,
+			Filterable: true,
+			Validator: &schema.String{
+				Allowed: bookmarkedResources,
+			},
+		},
+		// item is the ID of the commented item in resource
+		"item": {
+			Required:   true,
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		// parent is the ID of the comment replied to
+		"parent": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		// thread is the ID of the top level comment of the thread
+		"thread": {
+			ReadOnly:   true,
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"depth": {
+			ReadOnly:  true,
+			Validator: &schema.Integer{},
+		},
+		"body": {
+			Required: true,
+			Validator: &schema.String{
+				MinLen: 1,
+				MaxLen: 5000,
+			},
+		},
+		// status is changed by moderators on /comments/{id}/moderate
+		"status": {
+			ReadOnly:   true,
+			Filterable: true,
+			Default:    "published",
+			Validator: &schema.String{
+				Allowed: commentStatuses,
+			},
+		},
+		// edited is the last time the author changed the body
+		"edited": {
+			ReadOnly:  true,
+			Validator: &schema.Time{},
+		},
+	},
+}
+
+// comments threads the comments, enforces their edit window and moderation,
+// and keeps the comments counter of the commented items up to date.
+type comments struct {
+	users         *resource.Resource
+	comments      *resource.Resource
+	resources     map[string]*resource.Resource
+	storers       map[string]resource.Storer
+	clock         clock
+	editWindow    time.Duration
+	maxDepth      int
+	premoderation bool
+	// invalidate drops the cached responses of a resource whose counters
+	// changed
+	invalidate func(res string)
+}
+
+// isModerator tells if user can moderate the comments
+func isModerator(user *resource.Item) bool {
+	return hasRole(user, "admin") || hasRole(user, "editor")
+}
+
+// OnFind implements resource.FindEventHandler interface
+func (c *comments) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	if isSystemContext(ctx) {
+		return nil
+	}
+	user, found := UserFromToken(c.users, ctx, r)
+	if !found {
+		return resource.ErrUnauthorized
+	}
+	if !isModerator(user) {
+		// Authors still see their own pending and hidden comments
+		lookup.AddQuery(schema.Query{schema.Or{
+			schema.Equal{Field: "status", Value: "published"},
+			schema.Equal{Field: "user", Value: user.ID},
+		}})
+	}
+	return nil
+}
+
+// OnGot implements resource.GotEventHandler interface
+func (c *comments) OnGot(ctx context.Context, r *http.Request, item **resource.Item, err *error) {
+	if *err != nil || isSystemContext(ctx) || (*item).Payload["status"] == "published" {
+		return
+	}
+	user, found := UserFromToken(c.users, ctx, r)
+	if !found {
+		*err = resource.ErrUnauthorized
+		return
+	}
+	if (*item).Payload["user"] != user.ID && !isModerator(user) {
+		*err = resource.ErrNotFound
+	}
+}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (c *comments) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	sys := NewContextWithSystemActor(ctx, "comments")
+	for _, item := range items {
+		name, _ := item.Payload["resource"].(string)
+		res := c.resources[name]
+		if res == nil {
+			return &resource.Error{Code: 422, Message: fmt.Sprintf("Can't comment %s items", name)}
+		}
+		if _, err := res.Get(sys, nil, item.Payload["item"]); err != nil {
+			if err == resource.ErrNotFound {
+				return &resource.Error{Code: 422, Message: "Commented item not found"}
+			}
+			return err
+		}
+		item.Payload["thread"] = fmt.Sprint(item.ID)
+		item.Payload["depth"] = 0
+		if parentID, found := item.Payload["parent"]; found {
+			parent, err := c.comments.Get(sys, nil, parentID)
+			if err == resource.ErrNotFound {
+				return &resource.Error{Code: 422, Message: "Parent comment not found"}
+			} else if err != nil {
+				return err
+			}
+			if parent.Payload["resource"] != item.Payload["resource"] || parent.Payload["item"] != item.Payload["item"] {
+				return &resource.Error{Code: 422, Message: "The parent comment is on another item"}
+			}
+			depth := intValue(parent.Payload["depth"]) + 1
+			if depth > c.maxDepth {
+				return &resource.Error{Code: 422, Message: "Too many nested replies"}
+			}
+			item.Payload["thread"] = parent.Payload["thread"]
+			item.Payload["depth"] = depth
+		}
+		if c.premoderation && !isSystemContext(ctx) {
+			item.Payload["status"] = "pending"
+		}
+	}
+	return nil
+}
+
+// OnInserted implements resource.InsertedEventHandler interface
+func (c *comments) OnInserted(ctx context.Context, r *http.Request, items []*resource.Item, err *error) {
+	if *err != nil {
+		return
+	}
+	for _, item := range items {
+		c.recount(ctx, item.Payload["resource"], item.Payload["item"])
+	}
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (c *comments) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	for _, field := range []string{"resource", "item", "parent"} {
+		if item.Payload[field] != original.Payload[field] {
+			return &resource.Error{Code: 422, Message: "Comments can't be moved"}
+		}
+	}
+	if isSystemContext(ctx) || item.Payload["body"] == original.Payload["body"] {
+		return nil
+	}
+	if created, ok := original.Payload["created"].(time.Time); ok && c.clock.Now().Sub(created) > c.editWindow {
+		return &resource.Error{Code: http.StatusForbidden, Message: "The comment can't be edited anymore"}
+	}
+	if original.Payload["status"] == "hidden" {
+		return &resource.Error{Code: http.StatusForbidden, Message: "Hidden comments can't be edited"}
+	}
+	item.Payload["edited"] = c.clock.Now()
+	return nil
+}
+
+// OnDeleted implements resource.DeletedEventHandler interface. The replies
+// of a deleted comment are kept and shown under a placeholder.
+func (c *comments) OnDeleted(ctx context.Context, r *http.Request, item *resource.Item, err *error) {
+	if *err == nil {
+		c.recount(ctx, item.Payload["resource"], item.Payload["item"])
+	}
+}
+
+// recount sets the comments counter of the commented item to its number of
+// published comments. Counting rather than incrementing lets any write fix
+// a drifted counter.
+func (c *comments) recount(ctx context.Context, res, itemID interface{}) {
+	name, _ := res.(string)
+	storer := c.storers[name]
+	if storer == nil {
+		return
+	}
+	if _, found := c.resources[name].Schema().Fields["comments"]; !found {
+		return
+	}
+	ctx = NewContextWithSystemActor(ctx, "comments")
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: name},
+		schema.Equal{Field: "item", Value: itemID},
+		schema.Equal{Field: "status", Value: "published"},
+	})
+	list, err := c.comments.Find(ctx, nil, lookup, 1, 1)
+	if err != nil {
+		log.Printf("Can't count the comments of %s/%v: %s", name, itemID, err)
+		return
+	}
+	changed, err := setCounters(ctx, storer, itemID, map[string]int{"comments": list.Total})
+	if err != nil {
+		log.Printf("Can't update the comments counter of %s/%v: %s", name, itemID, err)
+	} else if changed && c.invalidate != nil {
+		c.invalidate(name)
+	}
+}
+
+// Moderate serves POST /comments/{id}/moderate, setting the status of the
+// comment given as {"status": status}. Only admins and editors moderate.
+func (c *comments) Moderate(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+	user, found := UserFromToken(c.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	if !isModerator(user) {
+		writeResourceError(w, resource.ErrForbidden)
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if !decodePayload(w, r, &body) {
+		return
+	}
+	valid := false
+	for _, status := range commentStatuses {
+		valid = valid || status == body.Status
+	}
+	if !valid {
+		writeError(w, 422, "Invalid comment status")
+		return
+	}
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	original, err := c.comments.Get(ctx, r, a.ID)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	payload := map[string]interface{}{}
+	for k, v := range original.Payload {
+		payload[k] = v
+	}
+	payload["status"] = body.Status
+	payload["updated"] = c.clock.Now()
+	item, err := resource.NewItem(payload)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	if err := c.comments.Update(ctx, r, item, original); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	c.recount(ctx, item.Payload["resource"], item.Payload["item"])
+	writeItem(w, http.StatusOK, item)
+}
+
+// Thread serves GET /{resource}/{id}/comments, the comments of the item as
+// a tree, oldest first, each comment holding its replies in a replies field.
+// Unpublished comments and the deleted ones still having replies are kept
+// as placeholders without their body, except for moderators and for the
+// authors of the unpublished ones.
+func (c *comments) Thread(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	user, found := UserFromToken(c.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	// Comments of items in the trash are not listed
+	if _, err := c.resources[a.Resource].Get(ctx, r, a.ID); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: a.Resource},
+		schema.Equal{Field: "item", Value: a.ID},
+	})
+	if err := lookup.SetSort("created", c.comments.Validator()); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	list, err := c.comments.Find(ctx, r, lookup, 1, commentThreadLimit)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, commentTree(list.Items, user.ID, isModerator(user)))
+}
+
+// commentTree nests the comments under their parent. Comments not readable
+// by userID are turned into placeholders, or left out with no replies. The
+// placeholders of deleted comments are listed at the top level.
+func commentTree(items []*resource.Item, userID interface{}, moderator bool) []map[string]interface{} {
+	nodes := map[string]map[string]interface{}{}
+	order := []string{}
+	node := func(id string) map[string]interface{} {
+		n, found := nodes[id]
+		if !found {
+			// The comment was deleted, keep its place in the thread
+			n = map[string]interface{}{"id": id, "status": "deleted"}
+			nodes[id] = n
+		}
+		return n
+	}
+	for _, item := range items {
+		id := fmt.Sprint(item.ID)
+		n := node(id)
+		for k, v := range item.Payload {
+			n[k] = v
+		}
+		if item.Payload["status"] != "published" && !moderator && item.Payload["user"] != userID {
+			for _, field := range []string{"body", "user", "edited"} {
+				delete(n, field)
+			}
+		}
+		order = append(order, id)
+	}
+	roots := []map[string]interface{}{}
+	added := map[string]bool{}
+	var attach func(id string)
+	attach = func(id string) {
+		if added[id] {
+			return
+		}
+		added[id] = true
+		n := nodes[id]
+		parentID, _ := n["parent"].(string)
+		if parentID == "" {
+			roots = append(roots, n)
+			return
+		}
+		parent := node(parentID)
+		if parent["status"] == "deleted" {
+			attach(parentID)
+		}
+		replies, _ := parent["replies"].([]map[string]interface{})
+		parent["replies"] = append(replies, n)
+	}
+	for _, id := range order {
+		attach(id)
+	}
+	prune(&roots)
+	return roots
+}
+
+// prune drops the placeholders left without replies, depth first
+func prune(nodes *[]map[string]interface{}) {
+	kept := (*nodes)[:0]
+	for _, n := range *nodes {
+		replies, _ := n["replies"].([]map[string]interface{})
+		prune(&replies)
+		if len(replies) > 0 {
+			n["replies"] = replies
+		} else {
+			delete(n, "replies")
+		}
+		if _, readable := n["body"]; readable || len(replies) > 0 {
+			kept = append(kept, n)
+		}
+	}
+	*nodes = kept
+}
+
+// Purged drops the comments of an item purged from the trash
+func (c *comments) Purged(ctx context.Context, res string, item *resource.Item) {
+	if c.resources[res] == nil {
+		return
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: res},
+		schema.Equal{Field: "item", Value: fmt.Sprint(item.ID)},
+	})
+	if _, err := c.comments.Clear(ctx, nil, lookup); err != nil {
+		log.Printf("Can't drop the comments of %s/%v: %s", res, item.ID, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+// setCounters writes the counters of the item itemID of storer, bypassing
+// the resource hooks so counting doesn't make revisions, audit entries nor
+// notifications. It tells if the item changed, items not found having no
+// counter to set.
+func setCounters(ctx context.Context, storer resource.Storer, itemID interface{}, counters map[string]int) (bool, error) {
+	// Retry on concurrent changes of the item
+	for i := 0; ; i++ {
+		lookup := resource.NewLookup()
+		lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: itemID}})
+		list, err := storer.Find(ctx, lookup, 1, 1)
+		if err != nil || len(list.Items) == 0 {
+			return false, err
+		}
+		original := list.Items[0]
+		payload := map[string]interface{}{}
+		for k, v := range original.Payload {
+			payload[k] = v
+		}
+		changed := false
+		for field, n := range counters {
+			if intValue(payload[field]) != n {
+				payload[field] = n
+				changed = true
+			}
+		}
+		if !changed {
+			return false, nil
+		}
+		item, err := resource.NewItem(payload)
+		if err != nil {
+			return false, err
+		}
+		if err = storer.Update(ctx, item, original); err != resource.ErrConflict || i == 2 {
+			return err == nil, err
+		}
+	}
+}
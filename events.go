@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+// eventStatuses are the states of an event, following schema.org EventStatus
+var eventStatuses = []string{"scheduled", "postponed", "rescheduled", "cancelled"}
+
+const (
+	// calendarLimit is the maximum number of events of an iCalendar export
+	calendarLimit = 1000
+	// calendarWindow is how long ended events stay in the iCalendar exports
+	calendarWindow = 30 * 24 * time.Hour
+)
+
+// event is a dated event, referenced by the feed items about it
+var event = schema.Schema{
+	Fields: schema.Fields{
+		"id":      schema.IDField,
+		"created": schema.CreatedField,
+		"updated": schema.UpdatedField,
+		"user": {
+			Filterable: true,
+			Validator: &schema.Reference{
+				Path: "users",
+			},
+		},
+		"title": {
+			Required:   true,
+			Filterable: true,
+			Sortable:   true,
+			Validator:  &schema.String{MaxLen: 300},
+		},
+		"description": {
+			Validator: &schema.String{},
+		},
+		"start": {
+			Required:   true,
+			Filterable: true,
+			Sortable:   true,
+			Validator:  &schema.Time{},
+		},
+		// end defaults to start
+		"end": {
+			Filterable: true,
+			Sortable:   true,
+			Validator:  &schema.Time{},
+		},
+		// timezone is the IANA time zone the event takes place in, start
+		// and end being absolute times
+		"timezone": {
+			Filterable: true,
+			Default:    "UTC",
+			Validator:  timeZone{},
+		},
+		"venue": placeField,
+		"organizer": {
+			Validator: &schema.Object{
+				Schema: &schema.Schema{
+					Fields: schema.Fields{
+						"name": {
+							Required:   true,
+							Filterable: true,
+							Validator:  &schema.String{},
+						},
+						"url": {
+							Validator: &schema.URL{},
+						},
+						"email": {
+							Validator: &schema.String{},
+						},
+					},
+				},
+			},
+		},
+		"tickets": {
+			Validator: &schema.Array{
+				ValuesValidator: &schema.Object{
+					Schema: &schema.Schema{
+						Fields: schema.Fields{
+							"url": {
+								Required:  true,
+								Validator: &schema.URL{},
+							},
+							"label": {
+								Validator: &schema.String{},
+							},
+							"price": {
+								Validator: &schema.Float{Boundaries: &schema.Boundaries{Min: 0, Max: maxInt32}},
+							},
+							"currency": {
+								Validator: &schema.String{MinLen: 3, MaxLen: 3},
+							},
+						},
+					},
+				},
+			},
+		},
+		"category": {
+			Filterable: true,
+			Validator: &schema.Reference{
+				Path: "categories",
+			},
+		},
+		"status": {
+			Filterable: true,
+			Default:    "scheduled",
+			Validator: &schema.String{
+				Allowed: eventStatuses,
+			},
+		},
+	},
+}
+
+// timeZone validates the IANA time zone names like Europe/Paris
+type timeZone struct{}
+
+// Validate implements schema.FieldValidator interface
+func (v timeZone) Validate(value interface{}) (interface{}, error) {
+	name, ok := value.(string)
+	if !ok || name == "" || name == "Local" {
+		return nil, errors.New("not a time zone")
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return name, nil
+}
+
+// eventsHook defaults the end of the events to their start, checks they
+// don't end before starting, and filters their listings with when=upcoming
+// for the events not over yet or when=past for the others
+type eventsHook struct {
+	clock clock
+}
+
+// OnFind implements resource.FindEventHandler interface
+func (h eventsHook) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	if r == nil || isSystemContext(ctx) {
+		return nil
+	}
+	now := h.clock.Now()
+	switch when := r.URL.Query().Get("when"); when {
+	case "":
+	case "upcoming":
+		lookup.AddQuery(schema.Query{schema.GreaterOrEqual{Field: "end", Value: now}})
+	case "past":
+		lookup.AddQuery(schema.Query{schema.LowerThan{Field: "end", Value: now}})
+	default:
+		return &resource.Error{Code: 422, Message: fmt.Sprintf("when: expected upcoming or past, got %q", when)}
+	}
+	return nil
+}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (h eventsHook) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	for _, item := range items {
+		if err := h.check(item.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (h eventsHook) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	return h.check(item.Payload)
+}
+
+func (h eventsHook) check(payload map[string]interface{}) error {
+	if _, found := payload["end"]; !found {
+		payload["end"] = payload["start"]
+	}
+	start, _ := payload["start"].(time.Time)
+	end, _ := payload["end"].(time.Time)
+	if end.Before(start) {
+		return &resource.Error{
+			Code:    422,
+			Message: "Document contains error(s)",
+			Issues:  map[string][]interface{}{"end": {"must not be before start"}},
+		}
+	}
+	return nil
+}
+
+// eventCalendar serves GET /categories/{id}/events.ics, the iCalendar
+// export of the events of a category to subscribe to in calendar apps
+type eventCalendar struct {
+	users      *resource.Resource
+	categories *resource.Resource
+	events     *resource.Resource
+	storer     resource.Storer
+	clock      clock
+}
+
+// Serve implements actionHandler
+func (c eventCalendar) Serve(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	user, found := UserFromToken(c.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	category, err := c.categories.Get(ctx, r, a.ID)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	// The recent and upcoming events, the soonest first
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "category", Value: category.ID},
+		schema.GreaterOrEqual{Field: "end", Value: c.clock.Now().Add(-calendarWindow)},
+	})
+	if err := lookup.SetSort("start", c.events.Validator()); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	list, err := c.storer.Find(ctx, lookup, 1, calendarLimit)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	name, _ := category.Payload["name"].(string)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(icalendar(name, list.Items, c.clock.Now()))
+}
+
+// icalendar returns the iCalendar (RFC 5545) document of the events, named
+// name. Times are given in UTC, with the time zone of the events in the
+// X-TIMEZONE property.
+func icalendar(name string, events []*resource.Item, now time.Time) []byte {
+	cal := &icalWriter{}
+	cal.line("BEGIN", "VCALENDAR")
+	cal.line("VERSION", "2.0")
+	cal.line("PRODID", "-//rest-layer//events//EN")
+	cal.line("CALSCALE", "GREGORIAN")
+	cal.line("X-WR-CALNAME", icalText(name))
+	for _, e := range events {
+		p := e.Payload
+		cal.line("BEGIN", "VEVENT")
+		cal.line("UID", fmt.Sprintf("%v@events", e.ID))
+		cal.line("DTSTAMP", icalTime(now))
+		start, err := parseSourceTime(p["start"], true)
+		if err == nil {
+			cal.line("DTSTART", icalTime(start))
+		}
+		// DTEND must be after DTSTART, events without duration have none
+		if end, err := parseSourceTime(p["end"], true); err == nil && end.After(start) {
+			cal.line("DTEND", icalTime(end))
+		}
+		if t, err := parseSourceTime(p["updated"], true); err == nil {
+			cal.line("LAST-MODIFIED", icalTime(t))
+		}
+		if tz, ok := p["timezone"].(string); ok {
+			cal.line("X-TIMEZONE", tz)
+		}
+		title, _ := p["title"].(string)
+		cal.line("SUMMARY", icalText(title))
+		if description, ok := p["description"].(string); ok && description != "" {
+			cal.line("DESCRIPTION", icalText(description))
+		}
+		if venue, ok := p["venue"].(map[string]interface{}); ok {
+			parts := []string{}
+			for _, field := range []string{"name", "address", "city", "country"} {
+				if s, ok := venue[field].(string); ok && s != "" {
+					parts = append(parts, s)
+				}
+			}
+			if len(parts) > 0 {
+				cal.line("LOCATION", icalText(strings.Join(parts, ", ")))
+			}
+			if point, ok := geoPointAt(p, "venue.location"); ok {
+				cal.line("GEO", fmt.Sprintf("%f;%f", point.Lat, point.Lon))
+			}
+		}
+		if organizer, ok := p["organizer"].(map[string]interface{}); ok {
+			name, _ := organizer["name"].(string)
+			if email, ok := organizer["email"].(string); ok && email != "" {
+				cal.line(fmt.Sprintf(`ORGANIZER;CN="%s"`, icalParam(name)), "mailto:"+email)
+			}
+		}
+		if tickets, ok := p["tickets"].([]interface{}); ok && len(tickets) > 0 {
+			if ticket, ok := tickets[0].(map[string]interface{}); ok {
+				if url, ok := ticket["url"].(string); ok {
+					cal.line("URL", url)
+				}
+			}
+		}
+		switch p["status"] {
+		case "cancelled":
+			cal.line("STATUS", "CANCELLED")
+		case "postponed":
+			cal.line("STATUS", "TENTATIVE")
+		default:
+			cal.line("STATUS", "CONFIRMED")
+		}
+		cal.line("END", "VEVENT")
+	}
+	cal.line("END", "VCALENDAR")
+	return cal.Bytes()
+}
+
+// icalWriter writes the content lines of an iCalendar document, folded at
+// 75 octets
+type icalWriter struct {
+	bytes.Buffer
+}
+
+func (w *icalWriter) line(name, value string) {
+	line := name + ":" + value
+	// Continuation lines start with a space
+	for max := 75; len(line) > max; max = 74 {
+		cut := max
+		// Don't split a UTF-8 sequence
+		for !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	w.WriteString(line + "\r\n")
+}
+
+// icalTime formats t as an iCalendar UTC date-time
+func icalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icalParam strips s of the characters a quoted iCalendar parameter value
+// can't hold: double quotes and control characters, line breaks included
+func icalParam(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// icalText escapes s as an iCalendar TEXT value
+func icalText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+var geoDefaultRadius = flag.String("geo-default-radius", "10km", "Radius of the near queries not giving one")
+
+// geoFields holds the geo_point field of the storage types having one
+var geoFields = map[string]string{
+	"feed":   "place.location",
+	"data":   "place.location",
+	"news":   "place.location",
+	"video":  "place.location",
+	"events": "venue.location",
+}
+
+// geoResources are the resources whose listings take the near and bbox
+// parameters
+var geoResources = []string{"feed", "news", "video", "events"}
+
+// place is the typed location of an item
+var place = schema.Schema{
+	Fields: schema.Fields{
+		"name": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"address": {
+			Validator: &schema.String{},
+		},
+		"city": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"country": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		// location is indexed as an Elasticsearch geo_point
+		"location": {
+			Validator: &schema.Object{
+				Schema: &schema.Schema{
+					Fields: schema.Fields{
+						"lat": {
+							Required:  true,
+							Validator: &schema.Float{Boundaries: &schema.Boundaries{Min: -90, Max: 90}},
+						},
+						"lon": {
+							Required:  true,
+							Validator: &schema.Float{Boundaries: &schema.Boundaries{Min: -180, Max: 180}},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+// placeField is the field holding the place of an item
+var placeField = schema.Field{
+	Filterable: true,
+	Validator: &schema.Object{
+		Schema: &place,
+	},
+}
+
+// geoPoint is a latitude and longitude in degrees
+type geoPoint struct {
+	Lat, Lon float64
+}
+
+// geoPointAt returns the point stored in the field of payload, a dotted path
+func geoPointAt(payload map[string]interface{}, field string) (geoPoint, bool) {
+	var v interface{} = payload
+	for _, name := range strings.Split(field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return geoPoint{}, false
+		}
+		v = m[name]
+	}
+	m, _ := v.(map[string]interface{})
+	lat, ok1 := m["lat"].(float64)
+	lon, ok2 := m["lon"].(float64)
+	return geoPoint{Lat: lat, Lon: lon}, ok1 && ok2
+}
+
+// distance returns the great-circle distance between p and q in meters
+func (p geoPoint) distance(q geoPoint) float64 {
+	const earthRadius = 6371008.8
+	rad := math.Pi / 180
+	dLat, dLon := (q.Lat-p.Lat)*rad, (q.Lon-p.Lon)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(p.Lat*rad)*math.Cos(q.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geoDistance is a query expression matching the items whose field is
+// within radius meters of center. Sort tells to list the nearest first.
+type geoDistance struct {
+	Field  string
+	Center geoPoint
+	Radius float64
+	Sort   bool
+}
+
+// Match implements schema.Expression interface
+func (e geoDistance) Match(payload map[string]interface{}) bool {
+	p, ok := geoPointAt(payload, e.Field)
+	return ok && e.Center.distance(p) <= e.Radius
+}
+
+// geoBox is a query expression matching the items whose field is within a
+// bounding box
+type geoBox struct {
+	Field       string
+	TopLeft     geoPoint
+	BottomRight geoPoint
+}
+
+// Match implements schema.Expression interface
+func (e geoBox) Match(payload map[string]interface{}) bool {
+	p, ok := geoPointAt(payload, e.Field)
+	if !ok || p.Lat > e.TopLeft.Lat || p.Lat < e.BottomRight.Lat {
+		return false
+	}
+	if e.TopLeft.Lon <= e.BottomRight.Lon {
+		return p.Lon >= e.TopLeft.Lon && p.Lon <= e.BottomRight.Lon
+	}
+	// The box crosses the antimeridian
+	return p.Lon >= e.TopLeft.Lon || p.Lon <= e.BottomRight.Lon
+}
+
+// parseGeoPoint parses a "lat,lon" point
+func parseGeoPoint(s string) (geoPoint, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return geoPoint{}, fmt.Errorf("expected lat,lon")
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return geoPoint{}, fmt.Errorf("invalid coordinates")
+	}
+	return geoPoint{Lat: lat, Lon: lon}, nil
+}
+
+// parseRadius parses a distance in m, km or mi, meters if no unit is given
+func parseRadius(s string) (float64, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	unit := 1.0
+	for _, u := range []struct {
+		suffix string
+		meters float64
+	}{{"km", 1000}, {"mi", 1609.344}, {"m", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSuffix(s, u.suffix), u.meters
+			break
+		}
+	}
+	d, err := strconv.ParseFloat(s, 64)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid radius")
+	}
+	return d * unit, nil
+}
+
+// geoQuery returns the geo expressions of the near, radius and bbox query
+// parameters on field, nil if none. The near results are sorted by distance
+// unless sort is set.
+//
+//	near=lat,lon&radius=5km
+//	bbox=top,left,bottom,right as the latitude and longitude of the top left
+//	and bottom right corners
+func geoQuery(params map[string][]string, field string) (schema.Query, error) {
+	get := func(name string) string {
+		if v := params[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	q := schema.Query{}
+	if near := get("near"); near != "" {
+		center, err := parseGeoPoint(near)
+		if err != nil {
+			return nil, fmt.Errorf("near: %s", err)
+		}
+		radius := get("radius")
+		if radius == "" {
+			radius = *geoDefaultRadius
+		}
+		meters, err := parseRadius(radius)
+		if err != nil {
+			return nil, fmt.Errorf("radius: %s", err)
+		}
+		q = append(q, geoDistance{Field: field, Center: center, Radius: meters, Sort: get("sort") == ""})
+	}
+	if bbox := get("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("bbox: expected top,left,bottom,right")
+		}
+		topLeft, err1 := parseGeoPoint(parts[0] + "," + parts[1])
+		bottomRight, err2 := parseGeoPoint(parts[2] + "," + parts[3])
+		if err1 != nil || err2 != nil || topLeft.Lat < bottomRight.Lat {
+			return nil, fmt.Errorf("bbox: invalid corners")
+		}
+		q = append(q, geoBox{Field: field, TopLeft: topLeft, BottomRight: bottomRight})
+	}
+	if len(q) == 0 {
+		return nil, nil
+	}
+	return q, nil
+}
+
+// geoHook adds the geo expressions of the listing request parameters to
+// the lookup of a resource
+type geoHook struct {
+	field string
+}
+
+// OnFind implements resource.FindEventHandler interface
+func (h geoHook) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	if r == nil || isSystemContext(ctx) {
+		return nil
+	}
+	q, err := geoQuery(r.URL.Query(), h.field)
+	if err != nil {
+		return &resource.Error{Code: 422, Message: err.Error()}
+	}
+	if q != nil {
+		lookup.AddQuery(q)
+	}
+	return nil
+}
+
+// geoCell is a geohash grid cell of a clustering
+type geoCell struct {
+	Geohash string  `json:"geohash"`
+	Count   int     `json:"count"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+// geoGridder is implemented by the storers clustering items on a geohash
+// grid
+type geoGridder interface {
+	GeoGrid(ctx context.Context, lookup *resource.Lookup, field string, precision int) ([]geoCell, error)
+}
+
+// geoCandidates caps the number of items matching geo expressions, the
+// Elasticsearch max_result_window, for the lookups sorted by distance and the
+// grids to be computed in memory
+const geoCandidates = 10000
+
+// geoStorer adds the geo expressions support to a storer. On Elasticsearch,
+// the geo expressions are searched with the client and replaced by the ids
+// of the matching items, the storage handler translating the rest of the
+// lookups, and the grids are aggregated by the cluster. Other storers match
+// the expressions themselves. The nearest first sorting and the grids of the
+// other storers are computed here, from geoCandidates items at most.
+type geoStorer struct {
+	resource.Storer
+	client *elastic.Client
+	index  string
+	typ    string
+}
+
+// newGeoStorer wraps s storing typ on client, nil if not on Elasticsearch
+func newGeoStorer(client *elastic.Client, index, typ string, s resource.Storer) resource.Storer {
+	return geoStorer{Storer: s, client: client, index: index, typ: typ}
+}
+
+// splitGeoExpressions splits the top level geo expressions of q from the
+// others
+func splitGeoExpressions(q schema.Query) (geo, rest schema.Query, near *geoDistance) {
+	for _, e := range q {
+		switch e := e.(type) {
+		case geoDistance:
+			near = &e
+			geo = append(geo, e)
+		case geoBox:
+			geo = append(geo, e)
+		default:
+			rest = append(rest, e)
+		}
+	}
+	return geo, rest, near
+}
+
+// validatedFields validates the sort of a lookup copied from a lookup
+// already validated against the resource schema
+type validatedFields struct {
+	schema.Schema
+}
+
+// GetField implements schema.Validator interface
+func (validatedFields) GetField(name string) *schema.Field {
+	return &schema.Field{Sortable: true, Filterable: true}
+}
+
+// newSubLookup returns a lookup with the sort of lookup and q
+func newSubLookup(lookup *resource.Lookup, q schema.Query) (*resource.Lookup, error) {
+	sub := resource.NewLookup()
+	if len(q) > 0 {
+		sub.AddQuery(q)
+	}
+	if sort := lookup.Sort(); len(sort) > 0 {
+		if err := sub.SetSort(strings.Join(sort, ","), validatedFields{}); err != nil {
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
+// Find implements resource.Storer interface
+func (s geoStorer) Find(ctx context.Context, lookup *resource.Lookup, page, perPage int) (*resource.ItemList, error) {
+	geo, rest, near := splitGeoExpressions(lookup.Filter())
+	if len(geo) == 0 {
+		return s.Storer.Find(ctx, lookup, page, perPage)
+	}
+	q := lookup.Filter()
+	if s.client != nil {
+		ids, err := s.geoMatches(geo)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return &resource.ItemList{Page: page, Items: []*resource.Item{}}, nil
+		}
+		q = append(rest, schema.In{Field: "id", Values: ids})
+	}
+	sub, err := newSubLookup(lookup, q)
+	if err != nil {
+		return nil, err
+	}
+	if near == nil || !near.Sort {
+		return s.Storer.Find(ctx, sub, page, perPage)
+	}
+	list, err := s.Storer.Find(ctx, sub, 1, geoCandidates)
+	if err != nil {
+		return nil, err
+	}
+	items := list.Items
+	sort.SliceStable(items, func(i, j int) bool {
+		p, _ := geoPointAt(items[i].Payload, near.Field)
+		q, _ := geoPointAt(items[j].Payload, near.Field)
+		return near.Center.distance(p) < near.Center.distance(q)
+	})
+	if perPage >= 0 {
+		start := (page - 1) * perPage
+		if start > len(items) {
+			start = len(items)
+		}
+		end := start + perPage
+		if end > len(items) {
+			end = len(items)
+		}
+		items = items[start:end]
+	}
+	return &resource.ItemList{Total: len(list.Items), Page: page, Items: items}, nil
+}
+
+// geoMatches returns the ids of the items matching the geo expressions geo
+// on Elasticsearch, geoCandidates at most
+func (s geoStorer) geoMatches(geo schema.Query) ([]schema.Value, error) {
+	res, err := s.client.Search(s.index).Type(s.typ).Query(esGeoQuery(geo)).FetchSource(false).Size(geoCandidates).Do()
+	if err != nil {
+		return nil, err
+	}
+	ids := []schema.Value{}
+	for _, hit := range res.Hits.Hits {
+		ids = append(ids, hit.Id)
+	}
+	return ids, nil
+}
+
+// GeoGrid implements geoGridder interface
+func (s geoStorer) GeoGrid(ctx context.Context, lookup *resource.Lookup, field string, precision int) ([]geoCell, error) {
+	geo, rest, _ := splitGeoExpressions(lookup.Filter())
+	if s.client == nil {
+		list, err := s.Storer.Find(ctx, lookup, 1, geoCandidates)
+		if err != nil {
+			return nil, err
+		}
+		counts := map[string]int{}
+		for _, item := range list.Items {
+			if p, ok := geoPointAt(item.Payload, field); ok {
+				counts[geohash(p, precision)]++
+			}
+		}
+		cells := []geoCell{}
+		for hash, n := range counts {
+			cells = append(cells, newGeoCell(hash, n))
+		}
+		sortGeoCells(cells)
+		return cells, nil
+	}
+	q := esGeoQuery(geo)
+	if len(rest) > 0 {
+		// The other expressions are matched by the storage handler
+		list, err := s.Storer.Find(ctx, resource.NewLookupWithQuery(rest), 1, geoCandidates)
+		if err != nil {
+			return nil, err
+		}
+		ids := []string{}
+		for _, item := range list.Items {
+			ids = append(ids, fmt.Sprint(item.ID))
+		}
+		q = q.Filter(elastic.NewIdsQuery(s.typ).Ids(ids...))
+	}
+	res, err := s.client.Search(s.index).Type(s.typ).Query(q).Size(0).
+		Aggregation("grid", elastic.NewGeoHashGridAggregation().Field(field).Precision(precision).Size(10000)).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+	cells := []geoCell{}
+	if grid, found := res.Aggregations.GeoHash("grid"); found {
+		for _, bucket := range grid.Buckets {
+			cells = append(cells, newGeoCell(fmt.Sprint(bucket.Key), int(bucket.DocCount)))
+		}
+	}
+	sortGeoCells(cells)
+	return cells, nil
+}
+
+func newGeoCell(hash string, count int) geoCell {
+	center := geohashCenter(hash)
+	return geoCell{Geohash: hash, Count: count, Lat: center.Lat, Lon: center.Lon}
+}
+
+// sortGeoCells orders cells by decreasing count
+func sortGeoCells(cells []geoCell) {
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Count != cells[j].Count {
+			return cells[i].Count > cells[j].Count
+		}
+		return cells[i].Geohash < cells[j].Geohash
+	})
+}
+
+// esGeoQuery translates the geo expressions geo into an Elasticsearch query
+func esGeoQuery(geo schema.Query) *elastic.BoolQuery {
+	b := elastic.NewBoolQuery()
+	for _, e := range geo {
+		switch e := e.(type) {
+		case geoDistance:
+			b = b.Filter(elastic.NewGeoDistanceQuery(e.Field).Lat(e.Center.Lat).Lon(e.Center.Lon).Distance(fmt.Sprintf("%fm", e.Radius)))
+		case geoBox:
+			b = b.Filter(elastic.NewGeoBoundingBoxQuery(e.Field).TopLeft(e.TopLeft.Lat, e.TopLeft.Lon).BottomRight(e.BottomRight.Lat, e.BottomRight.Lon))
+		}
+	}
+	return b
+}
+
+// geoClusters serves GET /{resource}/clusters, the items of a listing
+// counted on a geohash grid to cluster map markers. It takes the near and
+// bbox parameters of the listings and the grid precision, from 1 to 12.
+type geoClusters struct {
+	users   *resource.Resource
+	storers map[string]resource.Storer
+}
+
+func (g geoClusters) Serve(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	if _, found := UserFromToken(g.users, r.Context(), r); !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	gridder, ok := g.storers[a.Resource].(geoGridder)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "Clustering not supported")
+		return
+	}
+	precision := 5
+	if p := r.URL.Query().Get("precision"); p != "" {
+		var err error
+		if precision, err = strconv.Atoi(p); err != nil || precision < 1 || precision > 12 {
+			writeError(w, 422, "precision: expected 1 to 12")
+			return
+		}
+	}
+	q, err := geoQuery(r.URL.Query(), geoFields[a.Resource])
+	if err != nil {
+		writeError(w, 422, err.Error())
+		return
+	}
+	lookup := resource.NewLookup()
+	if q != nil {
+		lookup.AddQuery(q)
+	}
+	cells, err := gridder.GeoGrid(NewContextWithSystemActor(r.Context(), "geo"), lookup, geoFields[a.Resource], precision)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cells)
+}
+
+// geohashBase32 is the geohash alphabet
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes p with precision characters
+func geohash(p geoPoint, precision int) string {
+	lat, lon := [2]float64{-90, 90}, [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bits, ch, even := 0, 0, true
+	for len(hash) < precision {
+		if even {
+			if mid := (lon[0] + lon[1]) / 2; p.Lon >= mid {
+				ch, lon[0] = ch<<1|1, mid
+			} else {
+				ch, lon[1] = ch<<1, mid
+			}
+		} else {
+			if mid := (lat[0] + lat[1]) / 2; p.Lat >= mid {
+				ch, lat[0] = ch<<1|1, mid
+			} else {
+				ch, lat[1] = ch<<1, mid
+			}
+		}
+		even = !even
+		if bits++; bits == 5 {
+			hash = append(hash, geohashBase32[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// geohashCenter returns the center of the hash cell
+func geohashCenter(hash string) geoPoint {
+	lat, lon := [2]float64{-90, 90}, [2]float64{-180, 180}
+	even := true
+	for _, c := range hash {
+		n := strings.IndexRune(geohashBase32, c)
+		for bit := 4; bit >= 0; bit-- {
+			on := n >= 0 && n>>uint(bit)&1 == 1
+			r := &lat
+			if even {
+				r = &lon
+			}
+			if mid := (r[0] + r[1]) / 2; on {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return geoPoint{Lat: (lat[0] + lat[1]) / 2, Lon: (lon[0] + lon[1]) / 2}
+}
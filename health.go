@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+var (
+	esURL           = flag.String("es-url", "http://ES_HOST:9200", "Elasticsearch URL")
+	esIndex         = flag.String("es-index", "esocial_dev", "Elasticsearch index storing the resources, one type per resource")
+	esRetries       = flag.Int("es-connect-retries", 10, "Number of attempts to connect to Elasticsearch at startup")
+	esRetryBackoff  = flag.Duration("es-connect-backoff", time.Second, "Initial delay between Elasticsearch connection attempts, doubled after each failure")
+	esHealthTimeout = flag.Duration("es-health-timeout", 2*time.Second, "Timeout of the Elasticsearch requests of the readiness checks")
+	jwtSecretFile   = flag.String("jwt-secret-file", "", "Read the JWT secret passphrase from this file instead of -jwt-secret")
+)
+
+const maxESRetryBackoff = 30 * time.Second
+
+// secretCheckInterval is the interval between two checks for a change of
+// the JWT secret file
+const secretCheckInterval = 5 * time.Second
+
+// errNoJWTKey is returned when no JWT secret is configured
+var errNoJWTKey = errors.New("no JWT secret configured")
+
+// jwtSecretCache holds the content of the JWT secret file, read again when
+// its modification time changes so a rotated secret is picked up without a
+// restart
+var jwtSecretCache = &secretFile{}
+
+// secretFile caches the content of a secret file
+type secretFile struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	checked time.Time
+	key     []byte
+	err     error
+}
+
+// get returns the secret of the file at path, reading it only when it
+// changed since the last read
+func (f *secretFile) get(path string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if path == f.path && now.Sub(f.checked) < secretCheckInterval {
+		return f.key, f.err
+	}
+	f.checked = now
+	info, err := os.Stat(path)
+	if err != nil {
+		f.path, f.modTime, f.key, f.err = path, time.Time{}, nil, err
+		return nil, err
+	}
+	if path == f.path && info.ModTime().Equal(f.modTime) && f.err == nil {
+		return f.key, nil
+	}
+	f.path, f.modTime = path, info.ModTime()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		f.key, f.err = nil, err
+	} else if key := strings.TrimSpace(string(b)); key != "" {
+		f.key, f.err = []byte(key), nil
+	} else {
+		f.key, f.err = nil, errNoJWTKey
+	}
+	return f.key, f.err
+}
+
+// jwtKey returns the key used to verify JWT tokens
+func jwtKey() ([]byte, error) {
+	if *jwtSecretFile != "" {
+		return jwtSecretCache.get(*jwtSecretFile)
+	}
+	if *jwtSecret == "" {
+		return nil, errNoJWTKey
+	}
+	return []byte(*jwtSecret), nil
+}
+
+// connectElasticsearch creates the Elasticsearch client, retrying with an
+// exponential backoff so a briefly unavailable cluster does not kill the service
+func connectElasticsearch() (*elastic.Client, error) {
+	backoff := *esRetryBackoff
+	for attempt := 1; ; attempt++ {
+		client, err := elastic.NewClient(
+			elastic.SetSniff(false),
+			elastic.SetURL(*esURL),
+		)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= *esRetries {
+			return nil, err
+		}
+		log.Printf("Can't connect to Elasticsearch DB (attempt %d/%d), retrying in %s: %s", attempt, *esRetries, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxESRetryBackoff {
+			backoff = maxESRetryBackoff
+		}
+	}
+}
+
+// newProbeClient returns the Elasticsearch client of the readiness checks,
+// whose requests time out after -es-health-timeout without being retried
+// so an unreachable cluster fails the probe instead of blocking it
+func newProbeClient() (*elastic.Client, error) {
+	return elastic.NewClient(
+		elastic.SetSniff(false),
+		elastic.SetURL(*esURL),
+		elastic.SetHttpClient(&http.Client{Timeout: *esHealthTimeout}),
+		elastic.SetMaxRetries(0),
+	)
+}
+
+// createTypes creates the index and the types of the resources which don't
+// exist yet, so the readiness checks find them before their first write
+func createTypes(client *elastic.Client, index string, types []string) error {
+	exists, err := client.IndexExists(index).Do()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := client.CreateIndex(index).Do(); err != nil {
+			return err
+		}
+	}
+	for _, typ := range types {
+		exists, err := client.TypeExists().Index(index).Type(typ).Do()
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		empty := map[string]interface{}{"properties": map[string]interface{}{}}
+		if _, err := client.PutMapping().Index(index).Type(typ).BodyJson(empty).Do(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkResult is the outcome of a single readiness check
+type checkResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readinessHandler reports whether the service can serve traffic: the
+// Elasticsearch cluster must be reachable and not red, the index and the
+// type of every bound resource must exist and the JWT key must be
+// available. Elasticsearch checks are skipped when running without a
+// client, which must be one of newProbeClient.
+type readinessHandler struct {
+	client *elastic.Client
+	index  string
+	types  []string
+}
+
+func (h readinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]checkResult{}
+	ready := true
+	set := func(name string, detail string, err error) {
+		res := checkResult{Status: "ok", Detail: detail}
+		if err != nil {
+			res.Status = "failed"
+			res.Error = err.Error()
+			ready = false
+		}
+		checks[name] = res
+	}
+
+	if h.client != nil {
+		h.checkElasticsearch(set)
+	}
+
+	_, err := jwtKey()
+	set("jwt_key", "", err)
+
+	status := http.StatusOK
+	overall := "ok"
+	if !ready {
+		status = http.StatusServiceUnavailable
+		overall = "unavailable"
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"status": overall,
+		"checks": checks,
+	})
+}
+
+func (h readinessHandler) checkElasticsearch(set func(name, detail string, err error)) {
+	health, err := h.client.ClusterHealth().Do()
+	if err == nil && health.Status == "red" {
+		err = errors.New("cluster status is red")
+	}
+	if err != nil {
+		set("elasticsearch", "", err)
+		// Don't wait for each of the other checks to time out
+		err = errors.New("elasticsearch unavailable")
+		set("index:"+h.index, "", err)
+		for _, typ := range h.types {
+			set("type:"+typ, "", err)
+		}
+		return
+	}
+	set("elasticsearch", health.Status, nil)
+
+	exists, err := h.client.IndexExists(h.index).Do()
+	if err == nil && !exists {
+		err = errors.New("index does not exist")
+	}
+	set("index:"+h.index, "", err)
+	for _, typ := range h.types {
+		exists, err := h.client.TypeExists().Index(h.index).Type(typ).Do()
+		if err == nil && !exists {
+			err = errors.New("type does not exist")
+		}
+		set("type:"+typ, "", err)
+	}
+}
+
+// livenessHandler only reports the process is up and serving HTTP
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// writeJSON sends v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Can't encode JSON response: %s", err)
+	}
+}
+
+// writeError sends a JSON error in the same format as REST Layer errors
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"code":    status,
+		"message": message,
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	historyRetention     = flag.Duration("history-retention", 180*24*time.Hour, "How long reading history entries are kept after the item was last read")
+	historyPurgeInterval = flag.Duration("history-purge-interval", time.Hour, "Interval between two purges of the expired reading history")
+)
+
+// historyCompletion is the part of a video to watch for it to be completed
+const historyCompletion = 0.95
+
+// historyEntry is the reading history of an item by a user
+var historyEntry = schema.Schema{
+	Fields: schema.Fields{
+		"id": {
+			ReadOnly:  true,
+			Validator: &schema.String{},
+		},
+		// created is the first time the item was read
+		"created": schema.CreatedField,
+		// updated is the last time the item was read
+		"updated": {
+			ReadOnly:   true,
+			Filterable: true,
+			Sortable:   true,
+			Validator:  &schema.Time{},
+		},
+		"user": {
+			Filterable: true,
+			Validator: &schema.Reference{
+				Path: "users",
+			},
+		},
+		"resource": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"item": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		// position is the playback position of videos, in seconds
+		"position": {
+			Validator: &schema.Integer{},
+		},
+		// duration is the length of videos, in seconds
+		"duration": {
+			Validator: &schema.Integer{},
+		},
+		"completed": {
+			Filterable: true,
+			Validator:  &schema.Bool{},
+		},
+		// reads counts the recorded events
+		"reads": {
+			Sortable:  true,
+			Validator: &schema.Integer{},
+		},
+	},
+}
+
+// readingHistory records what the users read or watch and serves it on
+// /me/history. Entries are written to the storage directly, they are too
+// frequent to go through the audit log. Users pause the recording with the
+// history_paused field of their user and clear it on /history.
+type readingHistory struct {
+	users     *resource.Resource
+	history   *resource.Resource
+	storer    resource.Storer
+	resources map[string]*resource.Resource
+	clock     clock
+}
+
+// historyID returns the ID of the entry of a user for an item
+func historyID(userID interface{}, res string, itemID interface{}) string {
+	return fmt.Sprintf("%v:%s:%v", userID, res, itemID)
+}
+
+// ServeHTTP serves /me/history:
+//
+//	GET lists the entries, last read first, with the items in their
+//	item_data field. With in_progress=true, only the videos started but not
+//	completed are listed, for continue watching.
+//	POST records a read as {"resource": "video", "item": id, "position": seconds}
+func (h *readingHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	user, found := UserFromToken(h.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	if r.Method == "POST" {
+		h.record(w, r, user)
+		return
+	}
+	q := schema.Query{schema.Equal{Field: "user", Value: user.ID}}
+	if res := r.URL.Query().Get("resource"); res != "" {
+		q = append(q, schema.Equal{Field: "resource", Value: res})
+	}
+	if r.URL.Query().Get("in_progress") == "true" {
+		q = append(q, schema.Equal{Field: "completed", Value: false}, schema.GreaterThan{Field: "position", Value: 0})
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(q)
+	if err := lookup.SetSort("-updated", h.history.Validator()); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	page, perPage := pagination(r, 20)
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	list, err := h.history.Find(ctx, r, lookup, page, perPage)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	payloads, err := expandItems(ctx, h.resources, list.Items)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, payloads)
+}
+
+// record upserts the entry of the user for the read item
+func (h *readingHistory) record(w http.ResponseWriter, r *http.Request, user *resource.Item) {
+	if user.Payload["history_paused"] == true {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var event struct {
+		Resource string `json:"resource"`
+		Item     string `json:"item"`
+		Position int    `json:"position"`
+	}
+	if !decodePayload(w, r, &event) {
+		return
+	}
+	res := h.resources[event.Resource]
+	if res == nil || event.Item == "" || event.Position < 0 {
+		writeError(w, 422, "Invalid read event")
+		return
+	}
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	item, err := res.Get(ctx, r, event.Item)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+
+	id := historyID(user.ID, event.Resource, item.ID)
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: id}})
+	list, err := h.storer.Find(ctx, lookup, 1, 1)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	now := h.clock.Now()
+	payload := map[string]interface{}{
+		"id":       id,
+		"created":  now,
+		"user":     user.ID,
+		"resource": event.Resource,
+		"item":     fmt.Sprint(item.ID),
+	}
+	var original *resource.Item
+	if len(list.Items) > 0 {
+		original = list.Items[0]
+		for k, v := range original.Payload {
+			payload[k] = v
+		}
+	}
+	payload["updated"] = now
+	payload["reads"] = intValue(payload["reads"]) + 1
+	payload["completed"] = true
+	if duration, ok := parseDuration(item.Payload["duration"]); ok {
+		payload["duration"] = int(duration / time.Second)
+		payload["position"] = event.Position
+		payload["completed"] = float64(event.Position) >= historyCompletion*duration.Seconds()
+	}
+	entry, err := resource.NewItem(payload)
+	if err == nil {
+		if original == nil {
+			err = h.storer.Insert(ctx, []*resource.Item{entry})
+		} else {
+			err = h.storer.Update(ctx, entry, original)
+		}
+	}
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeItem(w, http.StatusOK, entry)
+}
+
+// Purge clears the entries not updated within the retention
+func (h *readingHistory) Purge(ctx context.Context, retention time.Duration) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.LowerThan{Field: "updated", Value: h.clock.Now().Add(-retention)}})
+	n, err := h.history.Clear(NewContextWithSystemActor(ctx, "history"), nil, lookup)
+	if err != nil {
+		log.Printf("Can't purge the reading history: %s", err)
+	} else if n > 0 {
+		log.Printf("Purged %d reading history entries", n)
+	}
+}
+
+// isoDuration matches the ISO 8601 durations like PT1H2M3S
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseDuration parses a video duration given in ISO 8601 (PT1M30S), clock
+// ([h:]mm:ss) or seconds format
+func parseDuration(v interface{}) (time.Duration, bool) {
+	var d time.Duration
+	switch v := v.(type) {
+	case float64:
+		d = time.Duration(v * float64(time.Second))
+	case int:
+		d = time.Duration(v) * time.Second
+	case string:
+		v = strings.TrimSpace(v)
+		if m := isoDuration.FindStringSubmatch(strings.ToUpper(v)); m != nil && v != "P" && v != "PT" {
+			for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute} {
+				n, _ := strconv.Atoi(m[i+1])
+				d += time.Duration(n) * unit
+			}
+			s, _ := strconv.ParseFloat(m[4], 64)
+			d += time.Duration(s * float64(time.Second))
+		} else if parts := strings.Split(v, ":"); len(parts) >= 2 && len(parts) <= 3 {
+			for _, part := range parts {
+				n, err := strconv.Atoi(part)
+				if err != nil || n < 0 {
+					return 0, false
+				}
+				d = d*60 + time.Duration(n)*time.Second
+			}
+		} else if s, err := strconv.ParseFloat(v, 64); err == nil {
+			d = time.Duration(s * float64(time.Second))
+		}
+	}
+	return d, d > 0
+}
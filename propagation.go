@@ -0,0 +1,516 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+var (
+	propagationInterval = flag.Duration("propagation-interval", 10*time.Second, "Interval between two runs of the embedded copies propagation worker")
+	propagationRate     = flag.Int("propagation-rate", 500, "Maximum number of embedded copies updated per second, 0 for no limit")
+	propagationBatch    = flag.Int("propagation-batch", 500, "Number of embedded copies updated per batch")
+)
+
+// embeddedCopies maps the resources whose items are copied into other items
+// to the field holding their copies
+var embeddedCopies = map[string]string{
+	"categories": "category",
+	"channel":    "channel",
+	"country":    "country",
+}
+
+// embeddingResources are the resources whose items may hold embedded copies,
+// in the fields of embeddedCopies their schema has
+var embeddingResources = []string{"channel", "data", "feed", "news", "photo", "video"}
+
+// propagationStatuses are the states of a propagation job, in order
+var propagationStatuses = []string{"queued", "running", "done", "failed"}
+
+// propagationJob tracks the propagation of the changes of an item to its
+// embedded copies
+var propagationJob = schema.Schema{
+	Fields: schema.Fields{
+		"id": schema.IDField,
+		"created": {
+			ReadOnly:   true,
+			Filterable: true,
+			Sortable:   true,
+			OnInit:     schema.Now,
+			Validator:  &schema.Time{},
+		},
+		"updated": schema.UpdatedField,
+		// resource and item are the changed item
+		"resource": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"item": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"field": {
+			Validator: &schema.String{},
+		},
+		"status": {
+			Filterable: true,
+			Validator: &schema.String{
+				Allowed: propagationStatuses,
+			},
+		},
+		// copies counts the copies updated in each embedding resource
+		"copies": {
+			Validator: &schema.Dict{
+				ValuesValidator: &schema.Integer{},
+			},
+		},
+		"total": {
+			Validator: &schema.Integer{},
+		},
+		"started": {
+			Validator: &schema.Time{},
+		},
+		"finished": {
+			Validator: &schema.Time{},
+		},
+		"error": {
+			Validator: &schema.String{},
+		},
+	},
+}
+
+// copyUpdater is implemented by the storers refreshing embedded copies in
+// bulk
+type copyUpdater interface {
+	// UpdateCopies refreshes the stale copies of source held in field from
+	// source, updating at most rate copies per second by batches, and returns
+	// the number of updated copies
+	UpdateCopies(ctx context.Context, field string, source map[string]interface{}, rate, batch int) (int, error)
+}
+
+// staleCopies returns the query of the copies of source in field which were
+// not refreshed since its last update
+func staleCopies(field string, source map[string]interface{}) schema.Query {
+	return schema.Query{
+		schema.Equal{Field: field + ".id", Value: source["id"]},
+		schema.NotEqual{Field: field + ".updated", Value: source["updated"]},
+	}
+}
+
+// refreshCopy returns the embedded copy with the current values of source.
+// Copies keep the fields they were made with, with the id and update time of
+// source telling which version they are a copy of.
+func refreshCopy(embedded interface{}, source map[string]interface{}) map[string]interface{} {
+	old, _ := embedded.(map[string]interface{})
+	fresh := map[string]interface{}{}
+	for k := range old {
+		if v, found := source[k]; found {
+			fresh[k] = v
+		}
+	}
+	fresh["id"] = source["id"]
+	fresh["updated"] = source["updated"]
+	return fresh
+}
+
+// refreshCopyScript is refreshCopy for Elasticsearch update-by-query, in
+// Groovy, the scripting language of Elasticsearch 2.x, which needs inline
+// scripts enabled. The items ETag is changed for the clients not to keep
+// their stale version.
+const refreshCopyScript = `def copy = ctx._source[field];
+for (k in new ArrayList(copy.keySet())) {
+	if (source.containsKey(k)) {
+		copy[k] = source[k];
+	} else {
+		copy.remove(k);
+	}
+}
+copy.id = source.id;
+copy.updated = source.updated;
+ctx._source._etag = etag;`
+
+// UpdateCopies implements copyUpdater interface. On Elasticsearch, the
+// copies are refreshed by the cluster with update-by-query, throttled to
+// rate. Other storers go through the copies batch by batch, pausing between
+// batches to keep to rate.
+func (s geoStorer) UpdateCopies(ctx context.Context, field string, source map[string]interface{}, rate, batch int) (int, error) {
+	if s.client == nil {
+		updated := 0
+		for ctx.Err() == nil {
+			lookup := resource.NewLookup()
+			lookup.AddQuery(staleCopies(field, source))
+			// Refreshed copies leave the lookup results, so always read the
+			// first page
+			list, err := s.Storer.Find(ctx, lookup, 1, batch)
+			if err != nil {
+				return updated, err
+			}
+			if len(list.Items) == 0 {
+				return updated, nil
+			}
+			for _, original := range list.Items {
+				payload := map[string]interface{}{}
+				for k, v := range original.Payload {
+					payload[k] = v
+				}
+				payload[field] = refreshCopy(original.Payload[field], source)
+				item, err := resource.NewItem(payload)
+				if err == nil {
+					err = s.Storer.Update(ctx, item, original)
+				}
+				if err != nil {
+					return updated, err
+				}
+				updated++
+			}
+			if rate > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Duration(len(list.Items)) * time.Second / time.Duration(rate)):
+				}
+			}
+		}
+		return updated, ctx.Err()
+	}
+	// staleCopies on Elasticsearch
+	q := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery(field+".id", source["id"])).
+		MustNot(elastic.NewTermQuery(field+".updated", source["updated"]))
+	updated := 0
+	// Copies changed while being refreshed are skipped, retry them
+	for i := 0; i < 3; i++ {
+		script := elastic.NewScriptInline(refreshCopyScript).Lang("groovy").Params(map[string]interface{}{
+			"field":  field,
+			"source": source,
+			"etag":   newEventID(),
+		})
+		update := s.client.UpdateByQuery(s.index).Type(s.typ).Query(q).Script(script).
+			ProceedOnVersionConflict().ScrollSize(batch).Refresh("true")
+		if rate > 0 {
+			update = update.RequestsPerSecond(rate)
+		}
+		res, err := update.Do()
+		if err != nil {
+			return updated, err
+		}
+		updated += int(res.Updated)
+		if res.VersionConflicts == 0 {
+			return updated, nil
+		}
+	}
+	return updated, fmt.Errorf("%s copies kept changing while being refreshed", field)
+}
+
+// copyPropagator keeps the embedded copies of the categories, channels and
+// countries up to date. Their updates queue a job in the propagations
+// resource, run in the background by Run, which refreshes the copies of the
+// item in every embedding resource. Copies are written to the storage
+// directly, without revisions, audit entries nor notifications.
+type copyPropagator struct {
+	users     *resource.Resource
+	jobs      *resource.Resource
+	storer    resource.Storer
+	resources map[string]*resource.Resource
+	storers   map[string]resource.Storer
+	clock     clock
+	// rate and batch throttle the copy updates
+	rate  int
+	batch int
+	// invalidate drops the cached responses of a resource whose copies
+	// changed
+	invalidate func(res string)
+}
+
+// Sources returns the names of the resources whose items are copied
+func (p *copyPropagator) Sources() []string {
+	names := []string{}
+	for name := range embeddedCopies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// targets returns the resources holding copies in field
+func (p *copyPropagator) targets(field string) []string {
+	names := []string{}
+	for _, name := range embeddingResources {
+		if _, found := p.resources[name].Schema().Fields[field]; found {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Hook returns the hook queuing the propagation of the updates of the name
+// resource items
+func (p *copyPropagator) Hook(name string) propagationHook {
+	return propagationHook{propagator: p, resource: name}
+}
+
+// Enqueue queues the propagation of the changes of an item
+func (p *copyPropagator) Enqueue(ctx context.Context, res string, item *resource.Item) {
+	err := p.save(ctx, map[string]interface{}{
+		"resource": res,
+		"item":     fmt.Sprint(item.ID),
+		"field":    embeddedCopies[res],
+		"status":   "queued",
+	}, nil)
+	if err != nil {
+		log.Printf("Can't queue the propagation of %s/%v: %s", res, item.ID, err)
+	}
+}
+
+// save stores the job payload, updating original if not nil
+func (p *copyPropagator) save(ctx context.Context, payload map[string]interface{}, original *resource.Item) error {
+	sch := p.jobs.Schema()
+	var base map[string]interface{}
+	if original != nil {
+		base = original.Payload
+	}
+	changes, base := sch.Prepare(ctx, payload, &base, false)
+	doc, errs := sch.Validate(changes, base)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid propagation job: %v", errs)
+	}
+	item, err := resource.NewItem(doc)
+	if err != nil {
+		return err
+	}
+	if original == nil {
+		return p.storer.Insert(ctx, []*resource.Item{item})
+	}
+	if err := p.storer.Update(ctx, item, original); err != nil {
+		return err
+	}
+	*original = *item
+	return nil
+}
+
+// update sets fields of job, logging failures: the job is resumed on the
+// next run anyway
+func (p *copyPropagator) update(ctx context.Context, job *resource.Item, fields map[string]interface{}) {
+	payload := map[string]interface{}{}
+	for k, v := range job.Payload {
+		payload[k] = v
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	if err := p.save(ctx, payload, job); err != nil {
+		log.Printf("Can't update propagation job %v: %s", job.ID, err)
+	}
+}
+
+// pending returns the jobs to run, the oldest first. Running jobs were
+// interrupted and are resumed.
+func (p *copyPropagator) pending(ctx context.Context, perPage int) (*resource.ItemList, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.In{Field: "status", Values: []schema.Value{"queued", "running"}}})
+	if err := lookup.SetSort("created", p.jobs.Validator()); err != nil {
+		return nil, err
+	}
+	return p.storer.Find(ctx, lookup, 1, perPage)
+}
+
+// Run runs the pending jobs until there are none left or ctx is done
+func (p *copyPropagator) Run(ctx context.Context) {
+	ctx = NewContextWithSystemActor(ctx, "propagation")
+	for ctx.Err() == nil {
+		list, err := p.pending(ctx, 100)
+		if err != nil {
+			log.Printf("Can't list the propagation jobs: %s", err)
+			return
+		}
+		if len(list.Items) == 0 {
+			return
+		}
+		for _, job := range list.Items {
+			if ctx.Err() != nil {
+				return
+			}
+			p.run(ctx, job)
+		}
+	}
+}
+
+// run refreshes the copies of the item of job, recording its progress after
+// each embedding resource
+func (p *copyPropagator) run(ctx context.Context, job *resource.Item) {
+	res, _ := job.Payload["resource"].(string)
+	field, _ := job.Payload["field"].(string)
+	p.update(ctx, job, map[string]interface{}{"status": "running", "started": p.clock.Now(), "copies": map[string]interface{}{}})
+	fail := func(err error) {
+		log.Printf("Can't propagate %s/%v: %s", res, job.Payload["item"], err)
+		p.update(ctx, job, map[string]interface{}{"status": "failed", "finished": p.clock.Now(), "error": err.Error()})
+	}
+	if p.storers[res] == nil {
+		fail(fmt.Errorf("unknown resource %q", res))
+		return
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: job.Payload["item"]}})
+	list, err := p.storers[res].Find(ctx, lookup, 1, 1)
+	if err != nil {
+		fail(err)
+		return
+	}
+	copies := map[string]interface{}{}
+	total := 0
+	if len(list.Items) > 0 {
+		source := list.Items[0].Payload
+		for _, target := range p.targets(field) {
+			updater, ok := p.storers[target].(copyUpdater)
+			if !ok {
+				fail(fmt.Errorf("%s copies can't be updated", target))
+				return
+			}
+			n, err := updater.UpdateCopies(ctx, field, source, p.rate, p.batch)
+			copies[target] = n
+			total += n
+			if n > 0 && p.invalidate != nil {
+				p.invalidate(target)
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			p.update(ctx, job, map[string]interface{}{"copies": copies, "total": total})
+		}
+	}
+	p.update(ctx, job, map[string]interface{}{"status": "done", "finished": p.clock.Now(), "copies": copies, "total": total})
+}
+
+// copyCount counts the copies of an item in a resource
+type copyCount struct {
+	Total int `json:"total"`
+	Stale int `json:"stale"`
+}
+
+// staleItem reports the copies of an item with stale ones
+type staleItem struct {
+	Resource string               `json:"resource"`
+	ID       string               `json:"id"`
+	Copies   map[string]copyCount `json:"copies"`
+}
+
+// count counts the copies of source in each embedding resource
+func (p *copyPropagator) count(ctx context.Context, field string, source map[string]interface{}) (map[string]copyCount, int, error) {
+	counts := map[string]copyCount{}
+	stale := 0
+	for _, target := range p.targets(field) {
+		total, err := p.total(ctx, target, schema.Query{schema.Equal{Field: field + ".id", Value: source["id"]}})
+		if err != nil {
+			return nil, 0, err
+		}
+		if total == 0 {
+			continue
+		}
+		c := copyCount{Total: total}
+		if c.Stale, err = p.total(ctx, target, staleCopies(field, source)); err != nil {
+			return nil, 0, err
+		}
+		counts[target] = c
+		stale += c.Stale
+	}
+	return counts, stale, nil
+}
+
+// total returns the number of items of res matching q
+func (p *copyPropagator) total(ctx context.Context, res string, q schema.Query) (int, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(q)
+	list, err := p.storers[res].Find(ctx, lookup, 1, 1)
+	if err != nil {
+		return 0, err
+	}
+	return list.Total, nil
+}
+
+// Report serves GET /propagations/report, the consistency report of the
+// embedded copies of the live items, for admins. It lists the items having
+// stale copies, optionally only those of a resource with ?resource= or an
+// item with ?resource=&id=, and counts the pending jobs expected to refresh
+// them.
+func (p *copyPropagator) Report(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	user, found := UserFromToken(p.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	if !hasRole(user, "admin") {
+		writeResourceError(w, resource.ErrForbidden)
+		return
+	}
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	sources := p.Sources()
+	if res := r.URL.Query().Get("resource"); res != "" {
+		if _, found := embeddedCopies[res]; !found {
+			writeError(w, 422, fmt.Sprintf("%s items are not copied", res))
+			return
+		}
+		sources = []string{res}
+	}
+	checked, stale := 0, 0
+	items := []staleItem{}
+	for _, res := range sources {
+		field := embeddedCopies[res]
+		var q schema.Query
+		if id := r.URL.Query().Get("id"); id != "" {
+			q = schema.Query{schema.Equal{Field: "id", Value: id}}
+		}
+		err := scan(ctx, p.storers[res], p.resources[res].Validator(), q, func(list []*resource.Item) error {
+			for _, item := range list {
+				counts, n, err := p.count(ctx, field, item.Payload)
+				if err != nil {
+					return err
+				}
+				checked++
+				if n > 0 {
+					stale += n
+					items = append(items, staleItem{Resource: res, ID: fmt.Sprint(item.ID), Copies: counts})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			writeResourceError(w, err)
+			return
+		}
+	}
+	pending, err := p.pending(ctx, 1)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"checked": checked,
+		"stale":   stale,
+		"items":   items,
+		"pending": pending.Total,
+	})
+}
+
+// propagationHook queues the propagation of the updates of a resource items
+type propagationHook struct {
+	propagator *copyPropagator
+	resource   string
+}
+
+// OnUpdated implements resource.UpdatedEventHandler interface
+func (h propagationHook) OnUpdated(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item, err *error) {
+	if *err == nil {
+		h.propagator.Enqueue(ctx, h.resource, item)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimits     = flag.String("rate-limits", "*:*=600/m,*:POST=60/m,*:PUT=60/m,*:PATCH=60/m,*:DELETE=60/m", "Comma separated rate limits as resource:METHOD=requests/period with s, m or h periods, * matching any resource or method; empty disables rate limiting")
+	trustedProxies = flag.String("trusted-proxies", "", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For and X-Real-IP headers are trusted")
+)
+
+// rateLimit allows Limit requests per Window
+type rateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// parseRateLimits parses a -rate-limits spec into rules keyed by resource:METHOD
+func parseRateLimits(spec string) (map[string]rateLimit, error) {
+	rules := map[string]rateLimit{}
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		kv := strings.SplitN(rule, "=", 2)
+		scope := strings.SplitN(kv[0], ":", 2)
+		if len(kv) != 2 || len(scope) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q: expected resource:METHOD=requests/period", rule)
+		}
+		rate := strings.SplitN(kv[1], "/", 2)
+		if len(rate) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q: expected requests/period", rule)
+		}
+		limit, err := strconv.Atoi(rate[0])
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q: requests must be a positive integer", rule)
+		}
+		var window time.Duration
+		switch rate[1] {
+		case "s":
+			window = time.Second
+		case "m":
+			window = time.Minute
+		case "h":
+			window = time.Hour
+		default:
+			return nil, fmt.Errorf("invalid rate limit %q: period must be s, m or h", rule)
+		}
+		rules[scope[0]+":"+strings.ToUpper(scope[1])] = rateLimit{Limit: limit, Window: window}
+	}
+	return rules, nil
+}
+
+// parseTrustedProxies parses a -trusted-proxies spec
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// rateWindow counts the requests of a client in the current fixed window
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// rateLimiter limits requests per client, identified by the user ID of its
+// JWT token or by its IP, with limits depending on the resource and method
+type rateLimiter struct {
+	clock   clock
+	rules   map[string]rateLimit
+	trusted []*net.IPNet
+
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+func newRateLimiter(c clock, rules map[string]rateLimit, trusted []*net.IPNet) *rateLimiter {
+	return &rateLimiter{
+		clock:   c,
+		rules:   rules,
+		trusted: trusted,
+		windows: map[string]*rateWindow{},
+	}
+}
+
+// rule returns the most specific rule matching the resource and method
+func (l *rateLimiter) rule(res, method string) (string, rateLimit, bool) {
+	for _, scope := range []string{res + ":" + method, res + ":*", "*:" + method, "*:*"} {
+		if rl, found := l.rules[scope]; found {
+			return scope, rl, true
+		}
+	}
+	return "", rateLimit{}, false
+}
+
+// take consumes one request from the client window and returns the remaining
+// requests and the time left before the window resets
+func (l *rateLimiter) take(key string, rl rateLimit) (remaining int, reset time.Duration, ok bool) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	w, found := l.windows[key]
+	if !found || now.Sub(w.start) >= rl.Window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	reset = w.start.Add(rl.Window).Sub(now)
+	if w.count >= rl.Limit {
+		return 0, reset, false
+	}
+	w.count++
+	return rl.Limit - w.count, reset, true
+}
+
+// sweep drops the windows idle for more than an hour, the longest period
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, w := range l.windows {
+		if now.Sub(w.start) > time.Hour {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// clientIP returns the IP of the client, taken from X-Forwarded-For or
+// X-Real-IP only when the request comes from a trusted proxy
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.isTrusted(host) {
+		return host
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		// Walk the chain from the closest hop and stop at the first untrusted one
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if !l.isTrusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	return host
+}
+
+func (l *rateLimiter) isTrusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceName returns the name of the resource targeted by the request path
+func resourceName(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.IndexByte(path, '/'); i != -1 {
+		path = path[:i]
+	}
+	return path
+}
+
+// Handler returns a middleware rejecting clients over their limit with a
+// JSON 429 response
+func (l *rateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope, rl, found := l.rule(resourceName(r.URL.Path), r.Method)
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := "ip:" + l.clientIP(r)
+		if userID, ok := UserIDFromToken(r); ok {
+			client = "user:" + userID
+		}
+		remaining, reset, ok := l.take(scope+"|"+client, rl)
+		resetSecs := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(rl.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("RateLimit-Reset", resetSecs)
+		if !ok {
+			h.Set("Retry-After", resetSecs)
+			writeError(w, http.StatusTooManyRequests, "Rate limit exceeded, retry in "+resetSecs+" seconds")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
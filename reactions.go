@@ -0,0 +1,443 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var reactionReconcileInterval = flag.Duration("reaction-reconcile-interval", time.Hour, "Interval between two recomputations of the items reaction counters")
+
+// reactionCounters maps the reaction types to the item counter they feed
+var reactionCounters = map[string]string{
+	"like":  "likes",
+	"point": "points",
+}
+
+// reactionTypes are the types a user can react with
+var reactionTypes = []string{"like", "point"}
+
+// reaction is the reaction of a user to an item, stored once per user, item
+// and type
+var reaction = schema.Schema{
+	Fields: schema.Fields{
+		"id": {
+			ReadOnly:  true,
+			Sortable:  true,
+			Validator: &schema.String{},
+		},
+		"created": schema.CreatedField,
+		"user": {
+			Filterable: true,
+			Validator: &schema.Reference{
+				Path: "users",
+			},
+		},
+		"resource": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"item": {
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+		"type": {
+			Filterable: true,
+			Validator: &schema.String{
+				Allowed: reactionTypes,
+			},
+		},
+	},
+}
+
+// reactions serves the reactions to the content items on
+// /{resource}/{id}/reactions and keeps their counters up to date. Reactions
+// are written to the storage directly, the reactions resource only lists
+// the reactions of the user. The counters can't be set by the clients and
+// are periodically recomputed from the reactions by Reconcile.
+type reactions struct {
+	users     *resource.Resource
+	storer    resource.Storer
+	resources map[string]*resource.Resource
+	storers   map[string]resource.Storer
+	clock     clock
+	// invalidate drops the cached responses of a resource whose counters
+	// changed
+	invalidate func(res string)
+}
+
+// reactionID returns the ID of the reaction of a user to an item
+func reactionID(userID interface{}, res string, itemID interface{}, typ string) string {
+	return fmt.Sprintf("%v:%s:%v:%s", userID, res, itemID, typ)
+}
+
+// Serve serves the reactions of an item:
+//
+//	GET /{resource}/{id}/reactions returns the counts per type and the types
+//	the user reacted with as {"counts": {"like": 2}, "mine": ["like"]}
+//	PUT /{resource}/{id}/reactions/{type} adds the reaction of the user
+//	DELETE /{resource}/{id}/reactions/{type} removes it
+//
+// Adding and removing are idempotent.
+func (rx *reactions) Serve(w http.ResponseWriter, r *http.Request, a action) {
+	methods := []string{"GET"}
+	if len(a.Args) > 0 {
+		methods = []string{"PUT", "DELETE"}
+	}
+	if !allowMethods(w, r, methods...) {
+		return
+	}
+	user, found := UserFromToken(rx.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	item, err := rx.resources[a.Resource].Get(ctx, r, a.ID)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	if len(a.Args) == 0 {
+		rx.summary(w, ctx, a.Resource, item, user)
+		return
+	}
+	typ := a.Args[0]
+	if _, found := reactionCounters[typ]; !found || len(a.Args) > 1 {
+		writeError(w, http.StatusNotFound, "Unknown reaction type")
+		return
+	}
+
+	id := reactionID(user.ID, a.Resource, item.ID, typ)
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: id}})
+	list, err := rx.storer.Find(ctx, lookup, 1, 1)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	status := http.StatusOK
+	var existing *resource.Item
+	if len(list.Items) > 0 {
+		existing = list.Items[0]
+	}
+	switch {
+	case r.Method == "PUT" && existing == nil:
+		existing, err = resource.NewItem(map[string]interface{}{
+			"id":       id,
+			"created":  rx.clock.Now(),
+			"user":     user.ID,
+			"resource": a.Resource,
+			"item":     fmt.Sprint(item.ID),
+			"type":     typ,
+		})
+		if err == nil {
+			err = rx.storer.Insert(ctx, []*resource.Item{existing})
+		}
+		status = http.StatusCreated
+		if err == resource.ErrConflict {
+			// A concurrent request added it first
+			status = http.StatusOK
+			if list, err = rx.storer.Find(ctx, lookup, 1, 1); err == nil && len(list.Items) > 0 {
+				existing = list.Items[0]
+			}
+		}
+	case r.Method == "DELETE" && existing != nil:
+		// or removed it
+		if err = rx.storer.Delete(ctx, existing); err == resource.ErrNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	if err := rx.recount(ctx, a.Resource, item.ID, typ); err != nil {
+		log.Printf("Can't update the %s counter of %s/%v: %s", typ, a.Resource, item.ID, err)
+	}
+	if r.Method == "DELETE" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeItem(w, status, existing)
+}
+
+// summary sends the reaction counts of item and the types user reacted with
+func (rx *reactions) summary(w http.ResponseWriter, ctx context.Context, res string, item, user *resource.Item) {
+	counts := map[string]int{}
+	for _, typ := range reactionTypes {
+		n, err := rx.count(ctx, res, item.ID, typ)
+		if err != nil {
+			writeResourceError(w, err)
+			return
+		}
+		counts[typ] = n
+	}
+	mine, err := rx.mine(ctx, fmt.Sprint(user.ID), res, []schema.Value{fmt.Sprint(item.ID)})
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	types := mine[fmt.Sprint(item.ID)]
+	if types == nil {
+		types = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"counts": counts, "mine": types})
+}
+
+// count returns the number of reactions of typ to an item
+func (rx *reactions) count(ctx context.Context, res string, itemID interface{}, typ string) (int, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: res},
+		schema.Equal{Field: "item", Value: fmt.Sprint(itemID)},
+		schema.Equal{Field: "type", Value: typ},
+	})
+	list, err := rx.storer.Find(ctx, lookup, 1, 1)
+	if err != nil {
+		return 0, err
+	}
+	return list.Total, nil
+}
+
+// mine returns the types userID reacted with to the items of res, by item ID
+func (rx *reactions) mine(ctx context.Context, userID, res string, itemIDs []schema.Value) (map[string][]string, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "user", Value: userID},
+		schema.Equal{Field: "resource", Value: res},
+		schema.In{Field: "item", Values: itemIDs},
+	})
+	list, err := rx.storer.Find(ctx, lookup, 1, len(itemIDs)*len(reactionTypes))
+	if err != nil {
+		return nil, err
+	}
+	mine := map[string][]string{}
+	for _, r := range list.Items {
+		item := fmt.Sprint(r.Payload["item"])
+		typ, _ := r.Payload["type"].(string)
+		mine[item] = append(mine[item], typ)
+	}
+	for _, types := range mine {
+		sort.Strings(types)
+	}
+	return mine, nil
+}
+
+// recount sets the counters of types of an item to the number of stored
+// reactions, only for the counters the resource has
+func (rx *reactions) recount(ctx context.Context, res string, itemID interface{}, types ...string) error {
+	counters := map[string]int{}
+	for _, typ := range types {
+		field := reactionCounters[typ]
+		if _, found := rx.resources[res].Schema().Fields[field]; !found {
+			continue
+		}
+		n, err := rx.count(ctx, res, itemID, typ)
+		if err != nil {
+			return err
+		}
+		counters[field] = n
+	}
+	if len(counters) == 0 {
+		return nil
+	}
+	changed, err := setCounters(ctx, rx.storers[res], itemID, counters)
+	if changed && rx.invalidate != nil {
+		rx.invalidate(res)
+	}
+	return err
+}
+
+// Reconcile recomputes the reaction counters from the reactions and fixes
+// the items whose counters drifted, by hand or after a failed update: the
+// items reacted to, and the items with counters but no reaction left
+func (rx *reactions) Reconcile(ctx context.Context) {
+	ctx = NewContextWithSystemActor(ctx, "reactions")
+	// counts holds the counters by resource and item
+	counts := map[string]map[string]map[string]int{}
+	err := scan(ctx, rx.storer, reaction, nil, func(items []*resource.Item) error {
+		for _, r := range items {
+			res, _ := r.Payload["resource"].(string)
+			typ, _ := r.Payload["type"].(string)
+			item := fmt.Sprint(r.Payload["item"])
+			if counts[res] == nil {
+				counts[res] = map[string]map[string]int{}
+			}
+			if counts[res][item] == nil {
+				counts[res][item] = map[string]int{}
+			}
+			counts[res][item][reactionCounters[typ]]++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Can't count the reactions: %s", err)
+		return
+	}
+	names := []string{}
+	for name := range rx.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := rx.reconcile(ctx, name, counts[name]); err != nil {
+			log.Printf("Can't reconcile the reactions of %s: %s", name, err)
+		}
+	}
+}
+
+// reconcile fixes the counters of the items of res differing from counts
+func (rx *reactions) reconcile(ctx context.Context, res string, counts map[string]map[string]int) error {
+	fields := []string{}
+	for _, field := range reactionCounters {
+		if _, found := rx.resources[res].Schema().Fields[field]; found {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	storer := rx.storers[res]
+	fix := func(items []*resource.Item) error {
+		for _, item := range items {
+			want := map[string]int{}
+			drifted := false
+			for _, field := range fields {
+				want[field] = counts[fmt.Sprint(item.ID)][field]
+				drifted = drifted || intValue(item.Payload[field]) != want[field]
+			}
+			if !drifted {
+				continue
+			}
+			changed, err := setCounters(ctx, storer, item.ID, want)
+			if err != nil {
+				return err
+			}
+			if changed && rx.invalidate != nil {
+				rx.invalidate(res)
+			}
+		}
+		return nil
+	}
+	// The items reacted to
+	ids := []schema.Value{}
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > scanBatch {
+			n = scanBatch
+		}
+		lookup := resource.NewLookup()
+		lookup.AddQuery(schema.Query{schema.In{Field: "id", Values: ids[:n]}})
+		list, err := storer.Find(ctx, lookup, 1, n)
+		if err != nil {
+			return err
+		}
+		if err := fix(list.Items); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	// The items with counters left by removed reactions
+	counted := schema.Or{}
+	for _, field := range fields {
+		counted = append(counted, schema.GreaterThan{Field: field, Value: 0})
+	}
+	return scan(ctx, storer, rx.resources[res].Validator(), schema.Query{counted}, func(items []*resource.Item) error {
+		uncounted := []*resource.Item{}
+		for _, item := range items {
+			if counts[fmt.Sprint(item.ID)] == nil {
+				uncounted = append(uncounted, item)
+			}
+		}
+		return fix(uncounted)
+	})
+}
+
+// Purged drops the reactions to an item purged from the trash
+func (rx *reactions) Purged(ctx context.Context, res string, item *resource.Item) {
+	if rx.resources[res] == nil {
+		return
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: res},
+		schema.Equal{Field: "item", Value: fmt.Sprint(item.ID)},
+	})
+	if _, err := rx.storer.Clear(ctx, lookup); err != nil {
+		log.Printf("Can't drop the reactions to %s/%v: %s", res, item.ID, err)
+	}
+}
+
+// Hook returns the hook adding the types the user reacted with to the items
+// of the name resource read with GET, in their my_reactions field
+func (rx *reactions) Hook(name string) reactionsHook {
+	return reactionsHook{reactions: rx, resource: name}
+}
+
+// reactionsHook tells the users how they reacted to the items they read
+type reactionsHook struct {
+	reactions *reactions
+	resource  string
+}
+
+// OnGot implements resource.GotEventHandler interface
+func (h reactionsHook) OnGot(ctx context.Context, r *http.Request, item **resource.Item, err *error) {
+	if *err != nil {
+		return
+	}
+	items := []*resource.Item{*item}
+	h.flag(ctx, r, items)
+	*item = items[0]
+}
+
+// OnFound implements resource.FoundEventHandler interface
+func (h reactionsHook) OnFound(ctx context.Context, r *http.Request, lookup *resource.Lookup, list **resource.ItemList, err *error) {
+	if *err == nil {
+		h.flag(ctx, r, (*list).Items)
+	}
+}
+
+// flag replaces the items with copies holding the my_reactions field. Only
+// the items sent in GET responses are flagged: the other reads, like the
+// one of the original item of an update, would store the flag.
+func (h reactionsHook) flag(ctx context.Context, r *http.Request, items []*resource.Item) {
+	if r == nil || r.Method != "GET" || len(items) == 0 || isSystemContext(ctx) || isInternalRead(ctx) {
+		return
+	}
+	userID, ok := UserIDFromToken(r)
+	if !ok {
+		return
+	}
+	ids := []schema.Value{}
+	for _, item := range items {
+		ids = append(ids, fmt.Sprint(item.ID))
+	}
+	mine, err := h.reactions.mine(NewContextWithSystemActor(ctx, userID), userID, h.resource, ids)
+	if err != nil {
+		log.Printf("Can't read the reactions of %s: %s", userID, err)
+		return
+	}
+	for i, item := range items {
+		types := mine[fmt.Sprint(item.ID)]
+		if types == nil {
+			types = []string{}
+		}
+		flagged := *item
+		flagged.Payload = map[string]interface{}{"my_reactions": types}
+		for k, v := range item.Payload {
+			flagged.Payload[k] = v
+		}
+		items[i] = &flagged
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var revisionCaps = flag.String("revisions", "feed=20,news=50,video=20,photo=20", "Comma separated number of revisions kept per resource as resource=count; resources not listed have no revision history")
+
+// revision is the schema of the stored revisions, used to query them
+var revision = schema.Schema{
+	Fields: schema.Fields{
+		"id":       {Validator: &schema.String{}},
+		"resource": {Filterable: true, Validator: &schema.String{}},
+		"item_id":  {Filterable: true, Validator: &schema.String{}},
+		// etag is the ETag of the item when it was replaced by an update
+		"etag": {Filterable: true, Validator: &schema.String{}},
+		"created": {
+			Filterable: true,
+			Sortable:   true,
+			Validator:  &schema.Time{},
+		},
+		// by is the actor of the update which replaced the revision
+		"by": {Filterable: true, Validator: &schema.String{}},
+		// payload is the item as it was before the update
+		"payload": {Validator: &schema.Dict{}},
+	},
+}
+
+// revisionKeptFields are the item fields not changed by a rollback, as they
+// are managed by the service rather than the item content
+var revisionKeptFields = []string{"id", "created", "user", "status", "status_history", "deleted_at", "deleted_by"}
+
+// parseRevisionCaps parses a -revisions spec into caps keyed by resource
+func parseRevisionCaps(spec string) (map[string]int, error) {
+	caps := map[string]int{}
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid revision cap %q: expected resource=count", rule)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid revision cap %q: expected a positive count", rule)
+		}
+		caps[kv[0]] = n
+	}
+	return caps, nil
+}
+
+// revisions stores the previous versions of the items of the resources with
+// a revision history, and serves them on /{resource}/{id}/revisions
+type revisions struct {
+	storer    resource.Storer
+	resources map[string]*resource.Resource
+	caps      map[string]int
+	clock     clock
+}
+
+func newRevisions(storer resource.Storer, caps map[string]int, c clock) *revisions {
+	return &revisions{
+		storer:    storer,
+		resources: map[string]*resource.Resource{},
+		caps:      caps,
+		clock:     c,
+	}
+}
+
+// Use records the revisions of res if it has a cap
+func (rv *revisions) Use(res *resource.Resource) {
+	if rv.caps[res.Name()] == 0 {
+		return
+	}
+	rv.resources[res.Name()] = res
+	res.Use(traceHook("revisionHook", revisionHook{revisions: rv, resource: res.Name()}))
+}
+
+// Resources returns the names of the resources with a revision history
+func (rv *revisions) Resources() []string {
+	names := []string{}
+	for name := range rv.resources {
+		names = append(names, name)
+	}
+	return names
+}
+
+// revisionID returns the ID of the revision of an item at etag
+func revisionID(res string, itemID interface{}, etag string) string {
+	return fmt.Sprintf("%s:%v:%s", res, itemID, etag)
+}
+
+// save stores original as a revision of its item and drops the revisions
+// over the cap
+func (rv *revisions) save(ctx context.Context, res string, original *resource.Item) error {
+	payload := map[string]interface{}{
+		"id":       revisionID(res, original.ID, original.ETag),
+		"resource": res,
+		"item_id":  fmt.Sprint(original.ID),
+		"etag":     original.ETag,
+		"created":  rv.clock.Now(),
+		"payload":  original.Payload,
+	}
+	if actor, ok := ActorFromContext(ctx); ok {
+		payload["by"] = actor
+	}
+	item, err := resource.NewItem(payload)
+	if err != nil {
+		return err
+	}
+	if err := rv.storer.Insert(ctx, []*resource.Item{item}); err != nil {
+		return err
+	}
+	// Only the oldest revision is expected to go, but a lower cap or
+	// concurrent updates may leave more. The revisions past the newest cap
+	// ones are on the second page, until it is empty.
+	keep := rv.caps[res]
+	for {
+		list, err := rv.list(ctx, res, original.ID, 2, keep)
+		if err != nil {
+			return err
+		}
+		if len(list.Items) == 0 {
+			return nil
+		}
+		for _, old := range list.Items {
+			if err := rv.storer.Delete(ctx, old); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// list returns a page of the revisions of an item, newest first
+func (rv *revisions) list(ctx context.Context, res string, itemID interface{}, page, perPage int) (*resource.ItemList, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: res},
+		schema.Equal{Field: "item_id", Value: fmt.Sprint(itemID)},
+	})
+	if err := lookup.SetSort("-created", revision); err != nil {
+		return nil, err
+	}
+	return rv.storer.Find(ctx, lookup, page, perPage)
+}
+
+// get returns the revision of an item at etag
+func (rv *revisions) get(ctx context.Context, res string, itemID interface{}, etag string) (*resource.Item, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: revisionID(res, itemID, etag)}})
+	list, err := rv.storer.Find(ctx, lookup, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, resource.ErrNotFound
+	}
+	return list.Items[0], nil
+}
+
+// Purged drops the revisions of an item purged from the trash
+func (rv *revisions) Purged(ctx context.Context, res string, item *resource.Item) {
+	if rv.resources[res] == nil {
+		return
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "resource", Value: res},
+		schema.Equal{Field: "item_id", Value: fmt.Sprint(item.ID)},
+	})
+	if _, err := rv.storer.Clear(ctx, lookup); err != nil {
+		log.Printf("Can't drop the revisions of %s/%v: %s", res, item.ID, err)
+	}
+}
+
+// Serve serves the revisions of an item:
+//
+//	GET /{resource}/{id}/revisions lists them, newest first
+//	GET /{resource}/{id}/revisions/{etag} returns one
+//	GET /{resource}/{id}/revisions/{etag}/diff/{etag} diffs two, current being the item as it is
+//	POST /{resource}/{id}/revisions/{etag}/rollback updates the item to the revision content
+//
+// Revisions are readable by the users allowed to read the item and rolled
+// back by the users allowed to update it.
+func (rv *revisions) Serve(w http.ResponseWriter, r *http.Request, a action) {
+	ctx := NewContextWithInternalRead(r.Context())
+	res := rv.resources[a.Resource]
+	if len(a.Args) == 2 && a.Args[1] == "rollback" {
+		if !allowMethods(w, r, "POST") {
+			return
+		}
+		rv.rollback(w, r, res, a.ID, a.Args[0])
+		return
+	}
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	current, err := res.Get(ctx, r, a.ID)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	switch {
+	case len(a.Args) == 0:
+		page, perPage := pagination(r, 20)
+		list, err := rv.list(ctx, a.Resource, current.ID, page, perPage)
+		if err != nil {
+			writeResourceError(w, err)
+			return
+		}
+		writeItems(w, list)
+	case len(a.Args) == 1:
+		rev, err := rv.get(ctx, a.Resource, current.ID, a.Args[0])
+		if err != nil {
+			writeResourceError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rev.Payload)
+	case len(a.Args) == 3 && a.Args[1] == "diff":
+		payloads := []map[string]interface{}{}
+		for _, etag := range []string{a.Args[0], a.Args[2]} {
+			if etag == "current" || etag == current.ETag {
+				payloads = append(payloads, current.Payload)
+				continue
+			}
+			rev, err := rv.get(ctx, a.Resource, current.ID, etag)
+			if err != nil {
+				writeResourceError(w, err)
+				return
+			}
+			payload, _ := rev.Payload["payload"].(map[string]interface{})
+			payloads = append(payloads, payload)
+		}
+		writeJSON(w, http.StatusOK, diff(payloads[0], payloads[1]))
+	default:
+		writeResourceError(w, resource.ErrNotFound)
+	}
+}
+
+// rollback updates the item to the content of its etag revision. The
+// update stores the current version as a new revision.
+func (rv *revisions) rollback(w http.ResponseWriter, r *http.Request, res *resource.Resource, id, etag string) {
+	ctx := NewContextWithInternalRead(r.Context())
+	original, err := res.Get(ctx, r, id)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	rev, err := rv.get(ctx, res.Name(), original.ID, etag)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	payload := map[string]interface{}{}
+	if content, ok := rev.Payload["payload"].(map[string]interface{}); ok {
+		for k, v := range content {
+			payload[k] = v
+		}
+	}
+	kept := append([]string{}, revisionKeptFields...)
+	// Read-only fields, like the counters, aren't content either
+	for name, def := range res.Schema().Fields {
+		if def.ReadOnly {
+			kept = append(kept, name)
+		}
+	}
+	for _, field := range kept {
+		if v, found := original.Payload[field]; found {
+			payload[field] = v
+		} else {
+			delete(payload, field)
+		}
+	}
+	// The revision was valid for the schema of its time, check it still is
+	v := res.Validator()
+	changes, base := v.Prepare(ctx, payload, &original.Payload, true)
+	doc, errs := v.Validate(changes, base)
+	if len(errs) > 0 {
+		writeResourceError(w, &resource.Error{Code: 422, Message: "Revision is not valid anymore", Issues: errs})
+		return
+	}
+	item, err := resource.NewItem(doc)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	if err := res.Update(ctx, r, item, original); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeItem(w, http.StatusOK, item)
+}
+
+// revisionHook stores the previous version of the updated items
+type revisionHook struct {
+	revisions *revisions
+	resource  string
+}
+
+// OnUpdated implements resource.UpdatedEventHandler interface
+func (h revisionHook) OnUpdated(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item, err *error) {
+	if *err != nil {
+		return
+	}
+	if e := h.revisions.save(ctx, h.resource, original); e != nil {
+		log.Printf("Can't save %s/%v revision: %s", h.resource, original.ID, e)
+	}
+}
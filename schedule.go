@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	schedulerInterval = flag.Duration("scheduler-interval", 30*time.Second, "Interval between two runs of the publishing scheduler")
+	publishStatus     = flag.String("publish-status", "published", "Status the scheduler gives to items reaching their publish_at time")
+	unpublishStatus   = flag.String("unpublish-status", "archived", "Status the scheduler gives to published items reaching their unpublish_at time")
+)
+
+// scheduleFields are the fields of the content items scheduled to go live
+// or to expire
+var scheduleFields = schema.Fields{
+	"publish_at": {
+		Filterable: true,
+		Sortable:   true,
+		Validator:  &schema.Time{},
+	},
+	"unpublish_at": {
+		Filterable: true,
+		Sortable:   true,
+		Validator:  &schema.Time{},
+	},
+}
+
+// scheduler publishes and unpublishes the items of the workflow resources
+// at their publish_at and unpublish_at times. The schedule is stored in the
+// items themselves and the times are cleared once handled, so nothing is
+// lost on restart. Items are flipped with an ETag conditional update: when
+// several instances run, the ones losing the race get a conflict and skip
+// the item.
+type scheduler struct {
+	workflow  *workflow
+	clock     clock
+	publish   string
+	unpublish string
+	// batch is the maximum number of items flipped per resource and run
+	batch int
+}
+
+func newScheduler(wf *workflow, c clock, publish, unpublish string) (*scheduler, error) {
+	if len(wf.sources(publish)) == 0 {
+		return nil, fmt.Errorf("no transition to the %s status", publish)
+	}
+	if err := wf.allow(publish, unpublish, []string{"admin"}); err != nil {
+		return nil, fmt.Errorf("no transition from the %s to the %s status", publish, unpublish)
+	}
+	return &scheduler{
+		workflow:  wf,
+		clock:     c,
+		publish:   publish,
+		unpublish: unpublish,
+		batch:     100,
+	}, nil
+}
+
+// Run flips the items which are due
+func (s *scheduler) Run(ctx context.Context) {
+	ctx = NewContextWithSystemActor(ctx, "scheduler")
+	for name, res := range s.workflow.resources {
+		for _, flip := range []struct {
+			field string
+			from  []string
+			to    string
+		}{
+			{"publish_at", s.workflow.sources(s.publish), s.publish},
+			{"unpublish_at", []string{s.publish}, s.unpublish},
+		} {
+			n, err := s.flip(ctx, res, flip.field, flip.from, flip.to)
+			if n > 0 {
+				log.Printf("Scheduler moved %d %s items to %s", n, name, flip.to)
+			}
+			if err != nil {
+				log.Printf("Scheduler can't move %s items to %s: %s", name, flip.to, err)
+			}
+		}
+	}
+}
+
+// flip moves the res items in one of the from statuses whose field time is
+// past to the to status, and clears field
+func (s *scheduler) flip(ctx context.Context, res *resource.Resource, field string, from []string, to string) (int, error) {
+	statuses := []schema.Value{}
+	for _, status := range from {
+		statuses = append(statuses, status)
+	}
+	now := s.clock.Now()
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.In{Field: "status", Values: statuses},
+		schema.LowerOrEqual{Field: field, Value: now},
+	})
+	if err := lookup.SetSort(field, res.Validator()); err != nil {
+		return 0, err
+	}
+	list, err := res.Find(ctx, nil, lookup, 1, s.batch)
+	if err != nil {
+		return 0, err
+	}
+	flipped := 0
+	for _, original := range list.Items {
+		payload := map[string]interface{}{}
+		for k, v := range original.Payload {
+			payload[k] = v
+		}
+		delete(payload, field)
+		payload["status"] = to
+		payload["updated"] = now
+		item, err := resource.NewItem(payload)
+		if err != nil {
+			return flipped, err
+		}
+		switch err := res.Update(ctx, nil, item, original); err {
+		case nil:
+			flipped++
+		case resource.ErrConflict:
+			// Changed since it was read, most likely flipped by another
+			// instance. If not, it's still due and is retried next run.
+		default:
+			log.Printf("Scheduler can't move %s/%v to %s: %s", res.Name(), original.ID, to, err)
+		}
+	}
+	return flipped, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	env         = flag.String("env", "development", "Environment the service runs in: development, staging or production")
+	fixtures    = flag.String("fixtures", "fixtures", "Directory holding a fixture set per environment")
+	seedOnStart = flag.Bool("seed-on-start", false, "Seed the fixtures of the environment on startup, never done in production nor without an explicit -env on Elasticsearch")
+)
+
+// fixtureSets lists the seeded resources in insertion order with the field
+// identifying an existing item, so seeding twice updates instead of duplicating
+var fixtureSets = []struct {
+	file     string
+	resource string
+	key      string
+}{
+	{"users.json", "users", "id"},
+	{"categories.json", "categories", "slug"},
+	{"countries.json", "country", "code"},
+	{"channels.json", "channel", "slug"},
+}
+
+// isProduction tells if the service runs in production
+func isProduction() bool {
+	return *env == "production"
+}
+
+// flagPassed tells if the flag name was given on the command line
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		passed = passed || f.Name == name
+	})
+	return passed
+}
+
+// checkSeedOnStart returns why the fixtures can't be seeded on startup on
+// backend storage: never in production, and only with an explicit -env on
+// a storage outliving the service
+func checkSeedOnStart(backend string) error {
+	if isProduction() {
+		return fmt.Errorf("fixtures are never seeded on startup in production")
+	}
+	if backend != "mem" && !flagPassed(flag.CommandLine, "env") {
+		return fmt.Errorf("-env is required to seed %s storage on startup", backend)
+	}
+	return nil
+}
+
+// seed upserts the fixtures of the dir/environment fixture set. Missing
+// fixture files are skipped.
+func (s *service) seed(ctx context.Context, dir, environment string) error {
+	for _, set := range fixtureSets {
+		path := filepath.Join(dir, environment, set.file)
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		items := []map[string]interface{}{}
+		if err := json.Unmarshal(b, &items); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		inserted, updated := 0, 0
+		for i, payload := range items {
+			created, err := s.upsert(ctx, set.resource, set.key, payload)
+			if err != nil {
+				return fmt.Errorf("%s: item %d: %s", path, i, err)
+			}
+			if created {
+				inserted++
+			} else {
+				updated++
+			}
+		}
+		log.Printf("Seeded %s from %s: %d inserted, %d updated", set.resource, path, inserted, updated)
+	}
+	return nil
+}
+
+// upsert validates payload against the resource schema and inserts it, or
+// updates the item having the same value for key. It goes straight to the
+// storage, bypassing the resource hooks.
+func (s *service) upsert(ctx context.Context, name, key string, payload map[string]interface{}) (created bool, err error) {
+	value, found := payload[key]
+	if !found {
+		return false, fmt.Errorf("missing %s", key)
+	}
+	storer := s.storers[name]
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: key, Value: value}})
+	list, err := storer.Find(ctx, lookup, 1, 1)
+	if err != nil {
+		return false, err
+	}
+	var original *resource.Item
+	var base *map[string]interface{}
+	if len(list.Items) > 0 {
+		original = list.Items[0]
+		base = &original.Payload
+	}
+	sch := s.resources[name].Schema()
+	changes, merged := sch.Prepare(ctx, payload, base, false)
+	doc, errs := sch.Validate(changes, merged)
+	if len(errs) > 0 {
+		return false, fmt.Errorf("invalid %s: %v", name, errs)
+	}
+	item, err := resource.NewItem(doc)
+	if err != nil {
+		return false, err
+	}
+	if original == nil {
+		return true, storer.Insert(ctx, []*resource.Item{item})
+	}
+	return false, storer.Update(ctx, item, original)
+}
+
+// runSeed implements the seed subcommand. The fixture set must be given,
+// with -set or -env, to seed a storage outliving the service.
+func runSeed(s *service, backend string, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	set := fs.String("set", *env, "Fixture set to load, defaults to the environment")
+	fs.Parse(args)
+	if backend != "mem" && !flagPassed(fs, "set") && !flagPassed(flag.CommandLine, "env") {
+		return fmt.Errorf("-set or -env is required to seed %s storage", backend)
+	}
+	return s.seed(context.Background(), *fixtures, *set)
+}
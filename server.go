@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	listenAddr        = flag.String("listen", ":8080", "HTTP listen address")
+	tlsCert           = flag.String("tls-cert", "", "TLS certificate file, enables HTTPS when set with -tls-key")
+	tlsKey            = flag.String("tls-key", "", "TLS private key file")
+	readTimeout       = flag.Duration("read-timeout", 15*time.Second, "Maximum duration for reading an entire request, including the body")
+	readHeaderTimeout = flag.Duration("read-header-timeout", 5*time.Second, "Maximum duration for reading request headers")
+	writeTimeout      = flag.Duration("write-timeout", 30*time.Second, "Maximum duration before timing out writes of the response")
+	idleTimeout       = flag.Duration("idle-timeout", 120*time.Second, "Maximum time to wait for the next request on keep-alive connections")
+	maxHeaderBytes    = flag.Int("max-header-bytes", 1<<20, "Maximum size of request headers")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 30*time.Second, "Maximum time given to in-flight requests and background workers to finish on shutdown")
+)
+
+// newServer creates the HTTP server serving h with the configured limits
+func newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              *listenAddr,
+		Handler:           h,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+}
+
+// listenAndServe serves srv until SIGINT or SIGTERM is received. It then stops
+// accepting connections, waits for in-flight requests to complete and calls
+// onShutdown, all within -shutdown-timeout.
+func listenAndServe(srv *http.Server, onShutdown func(ctx context.Context)) error {
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		if *tlsCert != "" || *tlsKey != "" {
+			err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		errc <- err
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	onShutdown(ctx)
+	return err
+}
+
+// workers runs the service background jobs and stops them on shutdown
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in the background. The context given to fn is canceled when
+// the workers are stopped and fn is expected to return promptly.
+func (w *workers) Go(name string, fn func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		fn(w.ctx)
+		log.Printf("Worker %s stopped", name)
+	}()
+}
+
+// Every runs fn in the background every interval
+func (w *workers) Every(name string, interval time.Duration, fn func(ctx context.Context)) {
+	w.Go(name, func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	})
+}
+
+// Stop cancels all the workers and waits for them to return or for ctx to
+// be done, whichever comes first
+func (w *workers) Stop(ctx context.Context) {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Timed out waiting for background workers: %s", ctx.Err())
+	}
+}
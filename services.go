@@ -5,23 +5,30 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"time"
-	"github.com/dgrijalva/jwt-go"
-	"github.com/dgrijalva/jwt-go/request"
+	"reflect"
+	"strings"
+
 	"github.com/cool-rest/alice"
 	"github.com/cool-rest/rest-layer/resource"
 	"github.com/cool-rest/rest-layer/rest"
 	"github.com/cool-rest/rest-layer/schema"
 	"github.com/cool-rest/xaccess"
 	"github.com/cool-rest/xlog"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/dgrijalva/jwt-go/request"
 	"golang.org/x/net/context"
-	"gopkg.in/olivere/elastic.v3"
-	"github.com/cool-rest/rest-layer-es"
 )
 
 type key int
 
-const userKey key = 0
+const (
+	userKey key = iota
+	userLookupKey
+	actorKey
+	systemActorKey
+	trashModeKey
+	internalReadKey
+)
 
 // NewContextWithUser stores user into context
 func NewContextWithUser(ctx context.Context, user *resource.Item) context.Context {
@@ -34,19 +41,92 @@ func UserFromContext(ctx context.Context) (*resource.Item, bool) {
 	return user, ok
 }
 
+// NewContextWithActor stores the ID of the user making the request into context
+func NewContextWithActor(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, actorKey, userID)
+}
+
+// NewContextWithSystemActor marks the context of an internal operation made
+// on behalf of actor, such as a background job. Resource hooks don't
+// authenticate those operations, their caller is responsible for it.
+func NewContextWithSystemActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, systemActorKey, actor)
+}
+
+// ActorFromContext retrieves who is performing the operation from context:
+// the system actor if any, or the authenticated user ID
+func ActorFromContext(ctx context.Context) (string, bool) {
+	if actor, ok := ctx.Value(systemActorKey).(string); ok {
+		return actor, true
+	}
+	actor, ok := ctx.Value(actorKey).(string)
+	return actor, ok
+}
+
+// isSystemContext tells if ctx is the one of an internal operation
+func isSystemContext(ctx context.Context) bool {
+	_, ok := ctx.Value(systemActorKey).(string)
+	return ok
+}
+
+// NewContextWithInternalRead marks the context of a read authenticated as
+// the user but not sent as is, like the one of the current version of an
+// item diffed with its revisions. Hooks decorating the items sent to the
+// users skip those reads.
+func NewContextWithInternalRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalReadKey, true)
+}
+
+// isInternalRead tells if ctx is the one of an internal read
+func isInternalRead(ctx context.Context) bool {
+	return ctx.Value(internalReadKey) == true
+}
+
+// NewActorHandler stores the user ID of a valid JWT token in the request
+// context so storage handlers know who is acting. The token is not required.
+func NewActorHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if userID, ok := UserIDFromToken(r); ok {
+				r = r.WithContext(NewContextWithActor(r.Context(), userID))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasRole tells if the user item has been granted role
+func hasRole(user *resource.Item, role string) bool {
+	roles, _ := user.Payload["roles"].([]interface{})
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 func UserFromToken(users *resource.Resource, ctx context.Context, r *http.Request) (*resource.Item, bool) {
+	if r == nil {
+		return nil, false
+	}
+	ctx, span := tracer.Start(ctx, "UserFromToken")
+	defer span.End()
 	tokenString, err := request.HeaderExtractor{"Authorization"}.ExtractToken(r)
 	fmt.Println("tokenString:", tokenString)
 	if tokenString == "" {
 		return nil, false
 	}
+	_, parseSpan := tracer.Start(ctx, "jwt.Parse")
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte("secret"), nil
+		return jwtKey()
 	})
-	if token.Valid {
+	endSpan(parseSpan, err)
+	if token != nil && token.Valid {
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 			fmt.Println(claims["user_id"])
-			user, err := users.Get(ctx, r, claims["user_id"])
+			// Flag the lookup so the users resource hooks don't authenticate it again
+			user, err := users.Get(context.WithValue(ctx, userLookupKey, true), r, claims["user_id"])
 			if err == nil && user != nil {
 				return user, true
 			} else {
@@ -63,6 +143,27 @@ func UserFromToken(users *resource.Resource, ctx context.Context, r *http.Reques
 
 }
 
+// UserIDFromToken returns the user_id claim of the request's JWT token if the
+// token is valid, without looking the user up
+func UserIDFromToken(r *http.Request) (string, bool) {
+	tokenString, _ := request.HeaderExtractor{"Authorization"}.ExtractToken(r)
+	if tokenString == "" {
+		return "", false
+	}
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey()
+	})
+	if err != nil || token == nil || !token.Valid {
+		return "", false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	userID, ok := claims["user_id"].(string)
+	return userID, ok && userID != ""
+}
+
 // NewJWTHandler parse and validates JWT token if present and store it in the net/context
 func NewJWTHandler(users *resource.Resource, jwtKeyFunc jwt.Keyfunc) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -122,6 +223,10 @@ func (a AuthResourceHook) OnFind(ctx context.Context, r *http.Request, lookup *r
 	// Reject unauthorized users
 	fmt.Println("OnFind ctx:", ctx)
 	fmt.Println("OnFind r:", r)
+	// Internal operations are authorized by their caller
+	if isSystemContext(ctx) {
+		return nil
+	}
 	user, found := UserFromToken(a.users, ctx, r)
 	if !found {
 		return resource.ErrUnauthorized
@@ -139,7 +244,11 @@ func (a AuthResourceHook) OnGot(ctx context.Context, r *http.Request, item **res
 	fmt.Println("OnGot ctx:", ctx)
 	fmt.Println("OnGot r:", r)
 	// Do not override existing errors
-	if err != nil {
+	if *err != nil {
+		return
+	}
+	// Let the user lookups made by UserFromToken and internal operations through
+	if lookup, _ := ctx.Value(userLookupKey).(bool); lookup || isSystemContext(ctx) {
 		return
 	}
 	// Reject unauthorized users
@@ -160,6 +269,10 @@ func (a AuthResourceHook) OnGot(ctx context.Context, r *http.Request, item **res
 func (a AuthResourceHook) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
 	fmt.Println("OnInsert ctx:", ctx)
 	fmt.Println("OnInsert r:", r)
+	// Internal operations are authorized by their caller
+	if isSystemContext(ctx) {
+		return nil
+	}
 	user, found := UserFromToken(a.users, ctx, r)
 	if !found {
 		return resource.ErrUnauthorized
@@ -182,6 +295,10 @@ func (a AuthResourceHook) OnInsert(ctx context.Context, r *http.Request, items [
 func (a AuthResourceHook) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
 	fmt.Println("OnUpdate ctx:", ctx)
 	fmt.Println("OnUpdate r:", r)
+	// Internal operations are authorized by their caller
+	if isSystemContext(ctx) {
+		return nil
+	}
 	// Reject unauthorized users
 	user, found := UserFromToken(a.users, ctx, r)
 	if !found {
@@ -209,6 +326,10 @@ func (a AuthResourceHook) OnUpdate(ctx context.Context, r *http.Request, item *r
 func (a AuthResourceHook) OnDelete(ctx context.Context, r *http.Request, item *resource.Item) error {
 	fmt.Println("OnDelete ctx:", ctx)
 	fmt.Println("OnDelete r:", r)
+	// Internal operations are authorized by their caller
+	if isSystemContext(ctx) {
+		return nil
+	}
 	// Reject unauthorized users
 	user, found := UserFromToken(a.users, ctx, r)
 	if !found {
@@ -225,6 +346,10 @@ func (a AuthResourceHook) OnDelete(ctx context.Context, r *http.Request, item *r
 func (a AuthResourceHook) OnClear(ctx context.Context, r *http.Request, lookup *resource.Lookup) error {
 	fmt.Println("OnClear ctx:", ctx)
 	fmt.Println("OnClear r:", r)
+	// Internal operations are authorized by their caller
+	if isSystemContext(ctx) {
+		return nil
+	}
 	// Reject unauthorized users
 	user, found := UserFromToken(a.users, ctx, r)
 	if !found {
@@ -237,6 +362,90 @@ func (a AuthResourceHook) OnClear(ctx context.Context, r *http.Request, lookup *
 	return nil
 }
 
+// OwnerResourceHook is an AuthResourceHook for private resources, also
+// restricting the reads to the items owned by the user
+type OwnerResourceHook struct {
+	AuthResourceHook
+}
+
+// OnFind implements resource.FindEventHandler interface
+func (a OwnerResourceHook) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	if isSystemContext(ctx) {
+		return nil
+	}
+	user, found := UserFromToken(a.users, ctx, r)
+	if !found {
+		return resource.ErrUnauthorized
+	}
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: a.UserField, Value: user.ID},
+	})
+	return nil
+}
+
+// OnGot implements resource.GotEventHandler interface
+func (a OwnerResourceHook) OnGot(ctx context.Context, r *http.Request, item **resource.Item, err *error) {
+	if *err != nil || isSystemContext(ctx) {
+		return
+	}
+	user, found := UserFromToken(a.users, ctx, r)
+	if !found {
+		*err = resource.ErrUnauthorized
+		return
+	}
+	// Don't tell others' items exist
+	if (*item).Payload[a.UserField] != user.ID {
+		*err = resource.ErrNotFound
+	}
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (a OwnerResourceHook) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	if err := a.AuthResourceHook.OnUpdate(ctx, r, item, original); err != nil || isSystemContext(ctx) {
+		return err
+	}
+	// Items can't be given to someone else
+	if item.Payload[a.UserField] != original.Payload[a.UserField] {
+		return resource.ErrUnauthorized
+	}
+	return nil
+}
+
+// RolesHook is a users resource event handler preventing non admins from
+// granting roles
+type RolesHook struct {
+	users *resource.Resource
+}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (h RolesHook) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	for _, item := range items {
+		if _, found := item.Payload["roles"]; found {
+			return h.checkAdmin(ctx, r)
+		}
+	}
+	return nil
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (h RolesHook) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	if reflect.DeepEqual(item.Payload["roles"], original.Payload["roles"]) {
+		return nil
+	}
+	return h.checkAdmin(ctx, r)
+}
+
+func (h RolesHook) checkAdmin(ctx context.Context, r *http.Request) error {
+	if isSystemContext(ctx) {
+		return nil
+	}
+	user, found := UserFromToken(h.users, ctx, r)
+	if !found || !hasRole(user, "admin") {
+		return resource.ErrUnauthorized
+	}
+	return nil
+}
+
 var (
 	category = schema.Schema{
 		Fields: schema.Fields{
@@ -283,6 +492,9 @@ var (
 
 	channel = schema.Schema{
 		Fields: schema.Fields{
+			"id":      schema.IDField,
+			"created": schema.CreatedField,
+			"updated": schema.UpdatedField,
 			"route": schema.Field{
 				Validator: &schema.Dict{},
 			},
@@ -484,9 +696,7 @@ var (
 			"photo": {
 				Validator: &schema.Dict{},
 			},
-			"place": {
-				Validator: &schema.Dict{},
-			},
+			"place": placeField,
 			"product": {
 				Validator: &schema.Dict{},
 			},
@@ -542,14 +752,10 @@ var (
 
 	feed = schema.Schema{
 		Fields: schema.Fields{
-			"id":      schema.IDField,
-			"created": schema.CreatedField,
-			"updated": schema.UpdatedField,
-			"source_created": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.String{},
-			},
+			"id":             schema.IDField,
+			"created":        schema.CreatedField,
+			"updated":        schema.UpdatedField,
+			"source_created": sourceCreatedField,
 			"url": {
 				Filterable: true,
 				Sortable:   true,
@@ -581,19 +787,27 @@ var (
 				Sortable:   true,
 				Validator:  &schema.String{},
 			},
+			// feed_type selects the vertical field holding the typed payload
+			// of the item, checked by feedTypeHook
 			"feed_type": {
 				Filterable: true,
-				Validator:  &schema.String{},
+				Validator: &schema.String{
+					Allowed: feedTypes,
+				},
 			},
 			"type": {
 				Filterable: true,
 				Validator:  &schema.String{},
 			},
-			"views":    {Validator: &schema.Integer{}},
-			"likes":    {Validator: &schema.Integer{}},
-			"shares":   {Validator: &schema.Integer{}},
-			"comments": {Validator: &schema.Integer{}},
-			"points":   {Validator: &schema.Integer{}},
+			"views": {Validator: &schema.Integer{}},
+			// likes and points count the like and point reactions, kept
+			// up to date on /feed/{id}/reactions
+			"likes":  {ReadOnly: true, Validator: &schema.Integer{}},
+			"shares": {Validator: &schema.Integer{}},
+			// comments counts the published comments, kept up to date by
+			// the comments resource
+			"comments": {ReadOnly: true, Validator: &schema.Integer{}},
+			"points":   {ReadOnly: true, Validator: &schema.Integer{}},
 			"statictis": {
 				Validator: &schema.Dict{},
 			},
@@ -630,93 +844,27 @@ var (
 				},
 			},
 
-			"video": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"news": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"photo": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"place": {
-				Validator: &schema.Dict{},
-			},
-			"product": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"movie": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"trip": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"job": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"weather": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"music": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"book": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"flight": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"tv": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"health": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
+			"video":   verticalField("video"),
+			"news":    verticalField("news"),
+			"photo":   verticalField("photo"),
+			"place":   placeField,
+			"product": verticalField("product"),
+			"movie":   verticalField("movie"),
+			"trip":    verticalField("trip"),
+			"job":     verticalField("job"),
+			"weather": verticalField("weather"),
+			"music":   verticalField("music"),
+			"book":    verticalField("book"),
+			"flight":  verticalField("flight"),
+			"tv":      verticalField("tv"),
+			"health":  verticalField("health"),
 			"event": {Validator: &schema.Reference{
 				Path: "events",
 			}},
-			"trends": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"stars": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"funny": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.Dict{},
-			},
-			"things": {Validator: &schema.Dict{}},
+			"trends": verticalField("trends"),
+			"stars":  verticalField("stars"),
+			"funny":  verticalField("funny"),
+			"things": verticalField("things"),
 			"feed_data": {
 				Validator: &schema.Dict{},
 			},
@@ -767,11 +915,7 @@ var (
 			"content": {
 				Validator: &schema.Array{},
 			},
-			"source_created": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.String{},
-			},
+			"source_created": sourceCreatedField,
 			"lang": {
 				Filterable: true,
 				Sortable:   true,
@@ -794,6 +938,7 @@ var (
 			"country":   {Validator: &schema.Dict{}},
 			"owner":     {Validator: &schema.Dict{}},
 			"news_data": {Validator: &schema.Dict{}},
+			"place":     placeField,
 			"status": {
 				Filterable: true,
 				Sortable:   true,
@@ -836,11 +981,7 @@ var (
 			"embed": {
 				Validator: &schema.Dict{},
 			},
-			"source_created": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.String{},
-			},
+			"source_created": sourceCreatedField,
 			"lang": {
 				Filterable: true,
 				Sortable:   true,
@@ -908,11 +1049,7 @@ var (
 			"embed": {
 				Validator: &schema.Dict{},
 			},
-			"source_created": {
-				Filterable: true,
-				Sortable:   true,
-				Validator:  &schema.String{},
-			},
+			"source_created": sourceCreatedField,
 			"lang": {
 				Filterable: true,
 				Sortable:   true,
@@ -949,6 +1086,7 @@ var (
 			"country":    {Validator: &schema.Dict{}},
 			"owner":      {Validator: &schema.Dict{}},
 			"video_data": {Validator: &schema.Dict{}},
+			"place":      placeField,
 			"status": {
 				Filterable: true,
 				Sortable:   true,
@@ -973,6 +1111,20 @@ var (
 				},
 			},
 			"password": schema.PasswordField,
+			// Stops the recording of the user reading history
+			"history_paused": {
+				Default:   false,
+				Validator: &schema.Bool{},
+			},
+			// Roles granted to the user, like admin. They can only be changed by an admin.
+			"roles": {
+				Filterable: true,
+				Validator: &schema.Array{
+					ValuesValidator: &schema.String{
+						Allowed: []string{"admin", "editor"},
+					},
+				},
+			},
 		},
 	}
 
@@ -1019,108 +1171,447 @@ var (
 	jwtSecret = flag.String("jwt-secret", "secret", "The JWT secret passphrase")
 )
 
-func main() {
-	flag.Parse()
-
-	client, err := elastic.NewClient(
-		elastic.SetSniff(false),
-		elastic.SetURL("http://ES_HOST:9200"),
-	)
+// service is the REST API built on top of the resource graph. It is shared by
+// main and the end-to-end tests.
+type service struct {
+	index     resource.Index
+	resources map[string]*resource.Resource
+	// storers holds the storage handler of each resource, for internal
+	// operations which must not go through the resource hooks
+	storers map[string]resource.Storer
+	// types are the storage types of the resources
+	types     []string
+	clock     clock
+	trash     *trashBin
+	scheduler *scheduler
+	webhooks  *webhookDispatcher
+	stream    *streamBroker
+	history   *readingHistory
+	comments  *comments
+	reactions *reactions
+	// propagator refreshes the embedded copies of the updated items
+	propagator *copyPropagator
+	limiter    *rateLimiter
+	cache      *responseCache
+	actions    *actionRouter
+	handler    http.Handler
+}
 
-	//client, err := elastic.NewClient()
-	if err != nil {
-		log.Fatalf("Can't connect to Elasticsearch DB: %s", err)
+// newService binds all the resources on storage created by newStorer and
+// builds the HTTP handler serving them, configured from the command line flags
+func newService(newStorer storageFactory) (*service, error) {
+	s := &service{
+		resources: map[string]*resource.Resource{},
+		storers:   map[string]resource.Storer{},
+		clock:     systemClock{},
+		actions:   newActionRouter(),
 	}
-	db := "esocial_dev"
+	// mux serves the endpoints outside of the resources paths, next to the API
+	mux := http.NewServeMux()
 
 	// Create a REST API resource index
 	index := resource.NewIndex()
+	s.index = index
+	store := func(typ string) resource.Storer {
+		s.types = append(s.types, typ)
+		return newStorer(typ)
+	}
+	bind := func(name string, sch schema.Schema, storer resource.Storer) *resource.Resource {
+		s.storers[name] = storer
+		r := index.Bind(name, sch, storer, resource.Conf{
+			AllowedModes: resource.ReadWrite,
+		})
+		s.resources[name] = r
+		return r
+	}
 
 	// Bind user on /users
-	users := index.Bind("users", user, es.NewHandler(client, db, "users"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
-	})
-
-	// Init the db with some users (user registration is not handled by this example)
-	secret, _ := schema.Password{}.Validate("secret")
-	users.Insert(context.Background(), nil, []*resource.Item{
-		{ID: "jack", Updated: time.Now(), ETag: "abcd", Payload: map[string]interface{}{
-			"id":       "jack",
-			"name":     "Jack Sparrow",
-			"password": secret,
-		}},
-		{ID: "john", Updated: time.Now(), ETag: "efgh", Payload: map[string]interface{}{
-			"id":       "john",
-			"name":     "John Doe",
-			"password": secret,
-		}},
-	})
-
+	users := bind("users", user, store("users"))
 	// Bind post on /posts
-	posts := index.Bind("posts", post, es.NewHandler(client, db, "posts"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
-	})
+	posts := bind("posts", post, store("posts"))
 
-	category := index.Bind("categories", category, es.NewHandler(client, db, "categories"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
-	})
-
-	data := index.Bind("data", data, es.NewHandler(client, db, "data"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
+	// Content resources are soft deleted to the trash, and the status of
+	// the editorial ones follows the workflow
+	s.trash = newTrashBin(users, s.clock)
+	wf, err := newWorkflow(*workflowSpec, users, s.clock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid workflow: %s", err)
+	}
+	editorial := map[string]bool{}
+	for _, name := range strings.Split(*workflowResources, ",") {
+		editorial[strings.TrimSpace(name)] = true
+	}
+	content := func(name string, sch schema.Schema, typ string) *resource.Resource {
+		sch = extendSchema(sch, softDeleteFields)
+		if editorial[name] {
+			sch = extendSchema(extendSchema(sch, wf.Fields()), scheduleFields)
+		}
+		r := bind(name, sch, s.trash.Wrap(name, "user", store(typ)))
+		if editorial[name] {
+			wf.Use(r)
+		}
+		return r
+	}
+	category := content("categories", category, "categories")
+	data := content("data", data, "data")
+	feeds := content("feed", feed, "feed")
+	news := content("news", news, "news")
+	videos := content("video", video, "video")
+	photos := content("photo", photo, "photo")
+	country := bind("country", country, store("countries"))
+	channel := content("channel", channel, "channels")
+	// Bind the events referenced by the feed items
+	events := bind("events", event, store("events"))
+	// Bind the users subscriptions, private to each user
+	subscriptions := bind("subscriptions", subscription, store("subscriptions"))
+	// Bind the users bookmarks, private to each user too
+	bookmarked := bind("bookmarks", bookmark, store("bookmarks"))
+	// Bind the users reading history, recorded on /me/history
+	historyStorer := store("history")
+	history := index.Bind("history", historyEntry, historyStorer, resource.Conf{
+		AllowedModes: []resource.Mode{resource.Read, resource.List, resource.Delete, resource.Clear},
 	})
-	feeds := index.Bind("feed", feed, es.NewHandler(client, db, "feed"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
+	s.resources["history"], s.storers["history"] = history, historyStorer
+	// Bind the comments on the content items, removed one by one
+	commentStorer := store("comments")
+	commented := index.Bind("comments", comment, commentStorer, resource.Conf{
+		AllowedModes: []resource.Mode{resource.Create, resource.Read, resource.Update, resource.Delete, resource.List},
 	})
-	index.Bind("news", news, es.NewHandler(client, db, "news"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
+	s.resources["comments"], s.storers["comments"] = commented, commentStorer
+	// Bind the users reactions, added and removed on /{resource}/{id}/reactions
+	reactionStorer := store("reactions")
+	reacted := index.Bind("reactions", reaction, reactionStorer, resource.Conf{
+		AllowedModes: resource.ReadOnly,
 	})
-	videos := index.Bind("video", video, es.NewHandler(client, db, "video"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
+	s.resources["reactions"], s.storers["reactions"] = reacted, reactionStorer
+	for _, name := range s.trash.Resources() {
+		s.trash.resources[name] = s.resources[name]
+	}
+	s.actions.HandleCollection(s.trash.Resources(), "trash", s.trash.List)
+	s.actions.HandleItem(s.trash.Resources(), "restore", s.trash.Restore)
+	s.actions.HandleItem(wf.Resources(), "transition", wf.Transition)
+	for _, r := range []*resource.Resource{feeds, news, videos, events} {
+		r.Use(traceHook("geoHook", geoHook{field: geoFields[r.Name()]}))
+	}
+	s.actions.HandleCollection(geoResources, "clusters", geoClusters{users: users, storers: s.storers}.Serve)
+	for _, name := range sourceTimeResources {
+		s.resources[name].Use(traceHook("timeRangeHook", timeRangeHook{field: "source_created", clock: s.clock}))
+	}
+	feeds.Use(traceHook("feedTypeHook", feedTypeHook{}))
+	if s.scheduler, err = newScheduler(wf, s.clock, *publishStatus, *unpublishStatus); err != nil {
+		return nil, fmt.Errorf("invalid scheduler configuration: %s", err)
+	}
+
+	// Protect resources
+	users.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "id", users: users}))
+	users.Use(traceHook("RolesHook", RolesHook{users: users}))
+	videos.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	feeds.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	data.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	photos.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	country.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	channel.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	category.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	events.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	events.Use(traceHook("eventsHook", eventsHook{clock: s.clock}))
+	s.actions.HandleItem([]string{"categories"}, "events.ics", eventCalendar{
+		users:      users,
+		categories: category,
+		events:     events,
+		storer:     s.storers["events"],
+		clock:      s.clock,
+	}.Serve)
+	posts.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	subscriptions.Use(traceHook("OwnerResourceHook", OwnerResourceHook{AuthResourceHook{UserField: "user", users: users}}))
+	bookmarked.Use(traceHook("OwnerResourceHook", OwnerResourceHook{AuthResourceHook{UserField: "user", users: users}}))
+	bms := &bookmarks{
+		bookmarks: bookmarked,
+		resources: map[string]*resource.Resource{"feed": feeds, "news": news, "video": videos, "photo": photos},
+	}
+	bookmarked.Use(traceHook("bookmarks", bms))
+	mux.Handle("/me/bookmarks", bms)
+	s.trash.onPurge = append(s.trash.onPurge, bms.Purged)
+	history.Use(traceHook("OwnerResourceHook", OwnerResourceHook{AuthResourceHook{UserField: "user", users: users}}))
+	s.history = &readingHistory{
+		users:     users,
+		history:   history,
+		storer:    historyStorer,
+		resources: bms.resources,
+		clock:     s.clock,
+	}
+	mux.Handle("/me/history", s.history)
+	commented.Use(traceHook("AuthResourceHook", AuthResourceHook{UserField: "user", users: users}))
+	s.comments = &comments{
+		users:         users,
+		comments:      commented,
+		resources:     bms.resources,
+		storers:       s.storers,
+		clock:         s.clock,
+		editWindow:    *commentEditWindow,
+		maxDepth:      *commentMaxDepth,
+		premoderation: *commentPremoderated,
+	}
+	commented.Use(traceHook("comments", s.comments))
+	s.actions.HandleItem([]string{"comments"}, "moderate", s.comments.Moderate)
+	s.actions.HandleItem(bookmarkedResources, "comments", s.comments.Thread)
+	s.trash.onPurge = append(s.trash.onPurge, s.comments.Purged)
+	reacted.Use(traceHook("OwnerResourceHook", OwnerResourceHook{AuthResourceHook{UserField: "user", users: users}}))
+	s.reactions = &reactions{
+		users:     users,
+		storer:    reactionStorer,
+		resources: bms.resources,
+		storers:   s.storers,
+		clock:     s.clock,
+	}
+	for _, r := range []*resource.Resource{feeds, news, videos, photos} {
+		r.Use(traceHook("reactionsHook", s.reactions.Hook(r.Name())))
+	}
+	s.actions.HandleItem(bookmarkedResources, "reactions", s.reactions.Serve)
+	s.trash.onPurge = append(s.trash.onPurge, s.reactions.Purged)
+
+	// Keep the previous versions of the content items
+	caps, err := parseRevisionCaps(*revisionCaps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revision caps: %s", err)
+	}
+	revs := newRevisions(store("revisions"), caps, s.clock)
+	for _, r := range []*resource.Resource{category, data, feeds, news, videos, photos, channel} {
+		revs.Use(r)
+	}
+	s.actions.HandleItem(revs.Resources(), "revisions", revs.Serve)
+	s.trash.onPurge = append(s.trash.onPurge, revs.Purged)
+
+	// Record all mutations in the read-only audit log, only readable by admins
+	auditStorer := store("audit")
+	audit := index.Bind("audit", auditEntry, auditStorer, resource.Conf{
+		AllowedModes: resource.ReadOnly,
 	})
-	photos := index.Bind("photo", photo, es.NewHandler(client, db, "photo"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
+	s.resources["audit"], s.storers["audit"] = audit, auditStorer
+	audit.Use(traceHook("AdminResourceHook", AdminResourceHook{users: users}))
+	auditLog := &auditLog{audit: audit, storer: auditStorer}
+	for _, r := range []*resource.Resource{users, posts, category, data, feeds, news, videos, photos, country, channel, events, subscriptions, bookmarked, commented} {
+		r.Use(traceHook("auditHook", auditLog.Hook(r.Name(), r.Schema())))
+	}
+	s.trash.onPurge = append(s.trash.onPurge, auditLog.Purged)
+
+	// Notify the registered webhooks of the content changes
+	webhooks := bind("webhooks", webhook, store("webhooks"))
+	webhooks.Use(traceHook("AdminResourceHook", AdminResourceHook{users: users}))
+	deliveryStorer := store("webhook_deliveries")
+	deliveries := webhooks.Bind("deliveries", "webhook", webhookDelivery, deliveryStorer, resource.Conf{
+		AllowedModes: resource.ReadOnly,
 	})
-	country := index.Bind("country", video, es.NewHandler(client, db, "countries"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
+	deliveries.Use(traceHook("AdminResourceHook", AdminResourceHook{users: users}))
+	s.webhooks = &webhookDispatcher{
+		webhooks:       s.storers["webhooks"],
+		deliveries:     deliveries,
+		deliveryStorer: deliveryStorer,
+		client:         &http.Client{Timeout: *webhookTimeout},
+		queue:          make(chan webhookJob, *webhookQueueSize),
+		clock:          s.clock,
+		maxAttempts:    *webhookMaxAttempts,
+		backoff:        *webhookBackoff,
+		disableAfter:   *webhookDisableAfter,
+	}
+	webhooks.Use(traceHook("webhookDispatcher", s.webhooks))
+	for _, r := range []*resource.Resource{posts, category, data, feeds, news, videos, photos, country, channel, events} {
+		r.Use(traceHook("webhookHook", s.webhooks.Hook(r.Name())))
+	}
+
+	// Refresh the copies of the categories, channels and countries embedded
+	// in the content items when they change, tracking the progress in the
+	// admins only propagations resource
+	propagationStorer := store("propagations")
+	propagations := index.Bind("propagations", propagationJob, propagationStorer, resource.Conf{
+		AllowedModes: resource.ReadOnly,
 	})
-	channel := index.Bind("channel", channel, es.NewHandler(client, db, "channels"), resource.Conf{
-		AllowedModes: resource.ReadWrite,
+	s.resources["propagations"], s.storers["propagations"] = propagations, propagationStorer
+	propagations.Use(traceHook("AdminResourceHook", AdminResourceHook{users: users}))
+	s.propagator = &copyPropagator{
+		users:     users,
+		jobs:      propagations,
+		storer:    propagationStorer,
+		resources: s.resources,
+		storers:   s.storers,
+		clock:     s.clock,
+		rate:      *propagationRate,
+		batch:     *propagationBatch,
+	}
+	for _, r := range []*resource.Resource{category, channel, country} {
+		r.Use(traceHook("propagationHook", s.propagator.Hook(r.Name())))
+	}
+	s.actions.HandleCollection([]string{"propagations"}, "report", s.propagator.Report)
+
+	// Push the new and updated content to the live streams
+	s.stream = newStreamBroker(users, s.clock, *streamHistory, *streamBuffer, *streamHeartbeat, *streamTicketTTL)
+	for _, r := range []*resource.Resource{feeds, news, videos, photos} {
+		r.Use(traceHook("streamHook", s.stream.Hook(r.Name())))
+	}
+	mux.Handle("/stream", s.stream)
+	mux.HandleFunc("/stream/tickets", s.stream.Tickets)
+
+	// Serve the users personal feed from their subscriptions
+	statuses := map[string]string{}
+	for _, name := range wf.Resources() {
+		statuses[name] = *publishStatus
+	}
+	mux.Handle("/me/feed", &personalFeed{
+		users:         users,
+		subscriptions: subscriptions,
+		resources:     []*resource.Resource{feeds, news, videos},
+		statuses:      statuses,
+		window:        *personalFeedWindow,
+		candidates:    *personalFeedCandidates,
+		snapshots:     newFeedSnapshots(*personalFeedSnapshotTTL),
+		clock:         s.clock,
 	})
 
-	// Protect resources
-	users.Use(AuthResourceHook{UserField: "id", users: users})
-	videos.Use(AuthResourceHook{UserField: "user", users: users})
-	feeds.Use(AuthResourceHook{UserField: "user", users: users})
-	data.Use(AuthResourceHook{UserField: "user", users: users})
-	photos.Use(AuthResourceHook{UserField: "user", users: users})
-	country.Use(AuthResourceHook{UserField: "user", users: users})
-	channel.Use(AuthResourceHook{UserField: "user", users: users})
-	category.Use(AuthResourceHook{UserField: "user", users: users})
-	posts.Use(AuthResourceHook{UserField: "user", users: users})
+	ttls, err := parseCacheTTLs(*cacheTTLs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache TTLs: %s", err)
+	}
+	s.cache = newResponseCache(s.clock, ttls, *cacheStale, *cacheMaxEntries)
+	for _, r := range []*resource.Resource{users, posts, category, data, feeds, news, videos, photos, country, channel, events} {
+		r.Use(traceHook("cacheInvalidationHook", cacheInvalidationHook{cache: s.cache, resource: r.Name()}))
+	}
+	s.comments.invalidate = s.cache.Invalidate
+	s.reactions.invalidate = s.cache.Invalidate
+	// The items of the resources with reactions hold the user ones
+	for name := range s.reactions.resources {
+		s.cache.variants[name] = true
+	}
+	s.propagator.invalidate = s.cache.Invalidate
 
 	// Create API HTTP handler for the resource graph
 	api, err := rest.NewHandler(index)
 	if err != nil {
-		log.Fatalf("Invalid API configuration: %s", err)
+		return nil, fmt.Errorf("invalid API configuration: %s", err)
+	}
+
+	limits, err := parseRateLimits(*rateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limits: %s", err)
 	}
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %s", err)
+	}
+	s.limiter = newRateLimiter(s.clock, limits, proxies)
 
 	// Setup logger
-	c := alice.New()
-	c.Append(xlog.NewHandler(xlog.Config{}))
-	c.Append(xaccess.NewHandler())
-	c.Append(xlog.RequestHandler("req"))
-	c.Append(xlog.RemoteAddrHandler("ip"))
-	c.Append(xlog.UserAgentHandler("ua"))
-	c.Append(xlog.RefererHandler("ref"))
-	c.Append(xlog.RequestIDHandler("req_id", "Request-Id"))
+	c := alice.New(NewTraceHandler())
+	c = c.Append(traceMiddleware("xlog", xlog.NewHandler(xlog.Config{})))
+	c = c.Append(traceMiddleware("xaccess", xaccess.NewHandler()))
+	c = c.Append(xlog.RequestHandler("req"))
+	c = c.Append(xlog.RemoteAddrHandler("ip"))
+	c = c.Append(xlog.UserAgentHandler("ua"))
+	c = c.Append(xlog.RefererHandler("ref"))
+	c = c.Append(xlog.RequestIDHandler("req_id", "Request-Id"))
+	c = c.Append(NewTraceCorrelationHandler("req_id"))
+	c = c.Append(traceMiddleware("ratelimit", s.limiter.Handler))
+	c = c.Append(NewActorHandler())
+	c = c.Append(s.actions.Handler)
+	c = c.Append(s.cache.Handler)
+	mux.Handle("/", api)
+	s.handler = c.Then(mux)
+	return s, nil
+}
+
+// startWorkers starts the service background jobs on bg
+func (s *service) startWorkers(bg *workers) {
+	bg.Every("trash-purge", *trashPurgeInterval, func(ctx context.Context) {
+		s.trash.Purge(ctx, *trashRetention)
+	})
+	bg.Every("scheduler", *schedulerInterval, s.scheduler.Run)
+	bg.Every("webhook-retries", *webhookRetryInterval, s.webhooks.Retry)
+	bg.Every("history-purge", *historyPurgeInterval, func(ctx context.Context) {
+		s.history.Purge(ctx, *historyRetention)
+	})
+	bg.Every("reaction-reconcile", *reactionReconcileInterval, s.reactions.Reconcile)
+	bg.Every("propagation", *propagationInterval, s.propagator.Run)
+	for i := 0; i < *webhookWorkers; i++ {
+		bg.Go(fmt.Sprintf("webhooks-%d", i), s.webhooks.Run)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		log.Fatalf("Can't setup tracing: %s", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Printf("Can't flush traces: %s", err)
+		}
+	}()
+
+	client, newStorer, err := openStorage(*storageBackend)
+	if err != nil {
+		log.Fatalf("Can't open storage: %s", err)
+	}
+	s, err := newService(newStorer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "seed" {
+		err := runSeed(s, *storageBackend, flag.Args()[1:])
+		if client != nil {
+			client.Stop()
+		}
+		if err != nil {
+			log.Fatalf("Can't seed fixtures: %s", err)
+		}
+		return
+	}
+	if *seedOnStart {
+		// Init the db with the environment fixtures (user registration is not handled by this service)
+		if err := checkSeedOnStart(*storageBackend); err != nil {
+			log.Printf("Not seeding fixtures: %s", err)
+		} else if err := s.seed(context.Background(), *fixtures, *env); err != nil {
+			log.Printf("Can't seed fixtures: %s", err)
+		}
+	}
+
 	resource.LoggerLevel = resource.LogLevelDebug
 	resource.Logger = func(ctx context.Context, level resource.LogLevel, msg string, fields map[string]interface{}) {
 		xlog.FromContext(ctx).OutputF(xlog.Level(level), 2, msg, fields)
 	}
+
+	if _, err := jwtKey(); err != nil {
+		log.Printf("Can't load the JWT key: %s", err)
+	}
+	ready := readinessHandler{index: *esIndex, types: s.types}
+	if client != nil {
+		if err := createTypes(client, *esIndex, s.types); err != nil {
+			log.Printf("Can't create the Elasticsearch types: %s", err)
+		}
+		if ready.client, err = newProbeClient(); err != nil {
+			log.Fatalf("Can't create the Elasticsearch probe client: %s", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	// Probes are kept out of the logging chain
+	mux.HandleFunc("/healthz", livenessHandler)
+	mux.Handle("/readyz", ready)
 	// Bind the API under /
-	http.Handle("/", c.Then(api))
+	mux.Handle("/", s.handler)
 
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatal(err)
+	bg := newWorkers()
+	s.startWorkers(bg)
+	srv := newServer(mux)
+	// Streams never become idle, end them for the shutdown not to wait
+	srv.RegisterOnShutdown(s.stream.Close)
+	err = listenAndServe(srv, func(ctx context.Context) {
+		bg.Stop(ctx)
+		if client != nil {
+			client.Stop()
+		}
+	})
+	if err != nil && err != http.ErrServerClosed {
+		log.Print(err)
 	}
 }
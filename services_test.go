@@ -0,0 +1,2435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cool-rest/rest-layer-mem"
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"github.com/cool-rest/testify/assert"
+	"github.com/cool-rest/xlog"
+	"github.com/dgrijalva/jwt-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// newTestService builds the full handler chain on the in-memory backend with
+// the test fixtures: jack and john as users and admin as administrator
+func newTestService(t *testing.T) (*service, *httptest.Server) {
+	*rateLimits = ""
+	*cacheTTLs = ""
+	_, newStorer, err := openStorage("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newService(newStorer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.seed(context.Background(), "fixtures", "test"); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.handler)
+	return s, ts
+}
+
+// tokenFor returns a JWT token for userID signed with the configured secret
+func tokenFor(t *testing.T, userID string) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": userID}).SignedString([]byte(*jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// call sends a request to the test server and returns the status and body
+func call(t *testing.T, ts *httptest.Server, method, path, token string, payload interface{}) (int, []byte) {
+	var body *bytes.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, b
+}
+
+// send sends req to the test server and returns the response, with its body
+// read, for the tests checking headers
+func send(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, b
+}
+
+func decodeItem(t *testing.T, b []byte) map[string]interface{} {
+	item := map[string]interface{}{}
+	if err := json.Unmarshal(b, &item); err != nil {
+		t.Fatalf("invalid item %q: %s", b, err)
+	}
+	return item
+}
+
+func decodeList(t *testing.T, b []byte) []map[string]interface{} {
+	list := []map[string]interface{}{}
+	if err := json.Unmarshal(b, &list); err != nil {
+		t.Fatalf("invalid list %q: %s", b, err)
+	}
+	return list
+}
+
+// create inserts payload in the resource at path as userID and returns the
+// path of the item
+func create(t *testing.T, ts *httptest.Server, path, userID string, payload map[string]interface{}) string {
+	code, b := call(t, ts, "POST", path, tokenFor(t, userID), payload)
+	if code != http.StatusCreated {
+		t.Fatalf("can't create %s: %d %s", path, code, b)
+	}
+	return path + "/" + decodeItem(t, b)["id"].(string)
+}
+
+func TestPersonalFeed(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	for _, sub := range []map[string]interface{}{{"kind": "tag", "value": "sport"}, {"kind": "channel", "value": "espn"}} {
+		status, b := call(t, ts, "POST", "/subscriptions", jack, sub)
+		assert.Equal(t, http.StatusCreated, status, string(b))
+	}
+	status, b := call(t, ts, "GET", "/subscriptions", tokenFor(t, "john"), nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 0, "subscriptions are private")
+	}
+
+	publish(t, ts, create(t, ts, "/feed", "john", map[string]interface{}{"title": "Match", "tags": []string{"sport"}}))
+	publish(t, ts, create(t, ts, "/news", "john", map[string]interface{}{"title": "Interview", "channel": map[string]interface{}{"slug": "espn"}}))
+	create(t, ts, "/feed", "john", map[string]interface{}{"title": "Draft", "tags": []string{"sport"}})
+	publish(t, ts, create(t, ts, "/video", "john", map[string]interface{}{"title": "Concert", "tags": []string{"music"}}))
+
+	get := func(path string) ([]map[string]interface{}, string) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Authorization", jack)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, res.StatusCode, b)
+		}
+		next := ""
+		if link := res.Header.Get("Link"); link != "" {
+			next = link[1:strings.Index(link, ">")]
+		}
+		return decodeList(t, b), next
+	}
+
+	page, next := get("/me/feed?limit=1")
+	if assert.Len(t, page, 1) && assert.NotEmpty(t, next) {
+		assert.Equal(t, "news", page[0]["resource"], "most recent first")
+		// New arrivals don't shift the next pages
+		publish(t, ts, create(t, ts, "/feed", "john", map[string]interface{}{"title": "Late", "tags": []string{"sport"}}))
+		page, next = get(next)
+		if assert.Len(t, page, 1) {
+			assert.Equal(t, "Match", page[0]["item"].(map[string]interface{})["title"])
+		}
+		assert.Empty(t, next)
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	path := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Read later"})
+	id := path[len("/feed/"):]
+	status, b := call(t, ts, "POST", "/bookmarks", jack, map[string]interface{}{"resource": "feed", "item": id, "folder": "later", "tags": []string{"long"}})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	assert.Equal(t, "jack", decodeItem(t, b)["user"])
+	status, _ = call(t, ts, "POST", "/bookmarks", jack, map[string]interface{}{"resource": "feed", "item": id})
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = call(t, ts, "POST", "/bookmarks", jack, map[string]interface{}{"resource": "feed", "item": "unknown"})
+	assert.Equal(t, 422, status)
+	status, b = call(t, ts, "GET", "/bookmarks", tokenFor(t, "john"), nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 0, "bookmarks are private")
+	}
+
+	for query, count := range map[string]int{"": 1, "?folder=later": 1, "?tag=long": 1, "?folder=other": 0} {
+		status, b = call(t, ts, "GET", "/me/bookmarks"+query, jack, nil)
+		if assert.Equal(t, http.StatusOK, status, string(b)) {
+			list := decodeList(t, b)
+			if assert.Len(t, list, count, query) && count > 0 {
+				assert.Equal(t, "Read later", list[0]["item_data"].(map[string]interface{})["title"])
+			}
+		}
+	}
+
+	// Bookmarks of trashed items are hidden, then dropped on purge
+	call(t, ts, "DELETE", path, tokenFor(t, "john"), nil)
+	_, b = call(t, ts, "GET", "/me/bookmarks", jack, nil)
+	assert.Len(t, decodeList(t, b), 0)
+	s.trash.Purge(context.Background(), -time.Hour)
+	_, b = call(t, ts, "GET", "/bookmarks", jack, nil)
+	assert.Len(t, decodeList(t, b), 0)
+}
+
+func TestPersonalFeedRanking(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Minute, 0} {
+		func() {
+			defer func(ttl time.Duration) { *personalFeedSnapshotTTL = ttl }(*personalFeedSnapshotTTL)
+			*personalFeedSnapshotTTL = ttl
+			s, ts := newTestService(t)
+			defer ts.Close()
+			jack := tokenFor(t, "jack")
+
+			status, b := call(t, ts, "POST", "/subscriptions", jack, map[string]interface{}{"kind": "tag", "value": "sport"})
+			assert.Equal(t, http.StatusCreated, status, string(b))
+			paths := []string{}
+			for _, title := range []string{"First", "Second", "Third"} {
+				path := create(t, ts, "/feed", "john", map[string]interface{}{"title": title, "tags": []string{"sport"}})
+				publish(t, ts, path)
+				paths = append(paths, path)
+			}
+
+			titles := []string{}
+			next := "/me/feed?limit=1"
+			for i := 0; next != "" && i < 5; i++ {
+				req, _ := http.NewRequest("GET", ts.URL+next, nil)
+				req.Header.Set("Authorization", jack)
+				res, b := send(t, req)
+				if !assert.Equal(t, http.StatusOK, res.StatusCode, string(b)) {
+					return
+				}
+				for _, entry := range decodeList(t, b) {
+					titles = append(titles, entry["item"].(map[string]interface{})["title"].(string))
+				}
+				next = ""
+				if link := res.Header.Get("Link"); link != "" {
+					next = link[1:strings.Index(link, ">")]
+				}
+				if i == 0 {
+					// The oldest item becomes the most popular
+					lookup := resource.NewLookup()
+					lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: strings.TrimPrefix(paths[0], "/feed/")}})
+					list, err := s.storers["feed"].Find(context.Background(), lookup, 1, 1)
+					if assert.NoError(t, err) && assert.Len(t, list.Items, 1) {
+						payload := map[string]interface{}{"likes": 1000}
+						for k, v := range list.Items[0].Payload {
+							if k != "likes" {
+								payload[k] = v
+							}
+						}
+						item, err := resource.NewItem(payload)
+						if assert.NoError(t, err) {
+							assert.NoError(t, s.storers["feed"].Update(context.Background(), item, list.Items[0]))
+						}
+					}
+				}
+			}
+			if ttl > 0 {
+				assert.Equal(t, []string{"Third", "Second", "First"}, titles, "pages follow the first ranking")
+			} else {
+				assert.Equal(t, []string{"Third", "Second"}, titles, "pages continue after the cursor")
+			}
+		}()
+	}
+}
+
+// validPayloads holds a minimal valid item and an update for every resource
+var validPayloads = []struct {
+	resource string
+	insert   map[string]interface{}
+	update   map[string]interface{}
+}{
+	{"posts", map[string]interface{}{"title": "Hello"}, map[string]interface{}{"title": "Hello world"}},
+	{"categories", map[string]interface{}{"name": "Sport", "slug": "sport"}, map[string]interface{}{"name": "Sports"}},
+	{"data", map[string]interface{}{"url": "http://example.com/data"}, map[string]interface{}{"status": "done"}},
+	{"feed", map[string]interface{}{"title": "Feed", "url": "http://example.com/feed"}, map[string]interface{}{"title": "Feed 2"}},
+	{"news", map[string]interface{}{"title": "News", "url": "http://example.com/news"}, map[string]interface{}{"title": "News 2"}},
+	{"video", map[string]interface{}{"title": "Video", "duration": "PT1M"}, map[string]interface{}{"title": "Video 2"}},
+	{"photo", map[string]interface{}{"title": "Photo"}, map[string]interface{}{"title": "Photo 2"}},
+	{"country", map[string]interface{}{"name": "France", "code": "FR"}, map[string]interface{}{"name": "République française"}},
+	{"channel", map[string]interface{}{"name": "Channel", "slug": "channel"}, map[string]interface{}{"name": "Channel 2"}},
+}
+
+func TestResourcesCRUD(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	for _, tt := range validPayloads {
+		path := "/" + tt.resource
+		status, b := call(t, ts, "POST", path, jack, tt.insert)
+		if !assert.Equal(t, http.StatusCreated, status, "%s: insert: %s", tt.resource, b) {
+			continue
+		}
+		item := decodeItem(t, b)
+		id, _ := item["id"].(string)
+		if !assert.NotEmpty(t, id, tt.resource) {
+			continue
+		}
+		itemPath := path + "/" + id
+
+		status, b = call(t, ts, "GET", itemPath, jack, nil)
+		if assert.Equal(t, http.StatusOK, status, "%s: get: %s", tt.resource, b) {
+			got := decodeItem(t, b)
+			for field, value := range tt.insert {
+				assert.Equal(t, value, got[field], "%s.%s", tt.resource, field)
+			}
+		}
+
+		status, b = call(t, ts, "GET", path, jack, nil)
+		if assert.Equal(t, http.StatusOK, status, "%s: list: %s", tt.resource, b) {
+			assert.Len(t, decodeList(t, b), 1, tt.resource)
+		}
+
+		status, b = call(t, ts, "PATCH", itemPath, jack, tt.update)
+		if assert.Equal(t, http.StatusOK, status, "%s: update: %s", tt.resource, b) {
+			got := decodeItem(t, b)
+			for field, value := range tt.update {
+				assert.Equal(t, value, got[field], "%s.%s", tt.resource, field)
+			}
+		}
+
+		status, b = call(t, ts, "DELETE", itemPath, jack, nil)
+		assert.Equal(t, http.StatusNoContent, status, "%s: delete: %s", tt.resource, b)
+
+		status, _ = call(t, ts, "GET", itemPath, jack, nil)
+		assert.Equal(t, http.StatusNotFound, status, "%s: get after delete", tt.resource)
+	}
+}
+
+func TestAuthResourceHook(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	john := tokenFor(t, "john")
+	badToken := "not-a-token"
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": "jack"}).SignedString([]byte("not the secret"))
+
+	for _, tt := range validPayloads {
+		path := "/" + tt.resource
+		status, b := call(t, ts, "POST", path, jack, tt.insert)
+		if !assert.Equal(t, http.StatusCreated, status, "%s: insert: %s", tt.resource, b) {
+			continue
+		}
+		id := decodeItem(t, b)["id"].(string)
+		itemPath := path + "/" + id
+
+		// OnFind
+		for name, token := range map[string]string{"anonymous": "", "bad token": badToken, "forged token": forged} {
+			status, _ = call(t, ts, "GET", path, token, nil)
+			assert.Equal(t, http.StatusUnauthorized, status, "%s: find %s", tt.resource, name)
+		}
+		status, _ = call(t, ts, "GET", path, john, nil)
+		assert.Equal(t, http.StatusOK, status, "%s: find non-owner", tt.resource)
+
+		// OnGot
+		for name, token := range map[string]string{"anonymous": "", "bad token": badToken, "forged token": forged} {
+			status, _ = call(t, ts, "GET", itemPath, token, nil)
+			assert.Equal(t, http.StatusUnauthorized, status, "%s: get %s", tt.resource, name)
+		}
+
+		// OnInsert
+		for name, token := range map[string]string{"anonymous": "", "bad token": badToken} {
+			status, _ = call(t, ts, "POST", path, token, tt.insert)
+			assert.Equal(t, http.StatusUnauthorized, status, "%s: insert %s", tt.resource, name)
+		}
+
+		// OnUpdate
+		for name, token := range map[string]string{"anonymous": "", "bad token": badToken, "non-owner": john} {
+			status, _ = call(t, ts, "PATCH", itemPath, token, tt.update)
+			assert.Equal(t, http.StatusUnauthorized, status, "%s: update %s", tt.resource, name)
+		}
+
+		// OnDelete
+		for name, token := range map[string]string{"anonymous": "", "bad token": badToken, "non-owner": john} {
+			status, _ = call(t, ts, "DELETE", itemPath, token, nil)
+			assert.Equal(t, http.StatusUnauthorized, status, "%s: delete %s", tt.resource, name)
+		}
+
+		// OnClear only removes the items owned by the user
+		for name, token := range map[string]string{"anonymous": "", "bad token": badToken} {
+			status, _ = call(t, ts, "DELETE", path, token, nil)
+			assert.Equal(t, http.StatusUnauthorized, status, "%s: clear %s", tt.resource, name)
+		}
+		status, b = call(t, ts, "DELETE", path, john, nil)
+		assert.Equal(t, http.StatusNoContent, status, "%s: clear non-owner: %s", tt.resource, b)
+		status, _ = call(t, ts, "GET", itemPath, jack, nil)
+		assert.Equal(t, http.StatusOK, status, "%s: get after non-owner clear", tt.resource)
+
+		// Owner
+		status, b = call(t, ts, "PATCH", itemPath, jack, tt.update)
+		assert.Equal(t, http.StatusOK, status, "%s: update owner: %s", tt.resource, b)
+		status, b = call(t, ts, "DELETE", path, jack, nil)
+		assert.Equal(t, http.StatusNoContent, status, "%s: clear owner: %s", tt.resource, b)
+		status, _ = call(t, ts, "GET", itemPath, jack, nil)
+		assert.Equal(t, http.StatusNotFound, status, "%s: get after owner clear", tt.resource)
+	}
+}
+
+func TestInsertForAnotherUser(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+
+	status, b := call(t, ts, "POST", "/posts", tokenFor(t, "jack"), map[string]interface{}{
+		"title": "Hello",
+		"user":  "john",
+	})
+	assert.Equal(t, http.StatusUnauthorized, status, string(b))
+}
+
+func TestUnknownUserToken(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+
+	status, _ := call(t, ts, "GET", "/feed", tokenFor(t, "nobody"), nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestUsers(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	status, b := call(t, ts, "GET", "/users/jack", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		item := decodeItem(t, b)
+		assert.Equal(t, "Jack Sparrow", item["name"])
+		assert.Nil(t, item["password"], "password must not be exposed")
+	}
+
+	status, b = call(t, ts, "PATCH", "/users/jack", jack, map[string]interface{}{"name": "Captain Jack Sparrow"})
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		assert.Equal(t, "Captain Jack Sparrow", decodeItem(t, b)["name"])
+	}
+
+	status, _ = call(t, ts, "PATCH", "/users/john", jack, map[string]interface{}{"name": "Not John"})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = call(t, ts, "DELETE", "/users/john", jack, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestSchemaValidation(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	tests := []struct {
+		resource string
+		payload  map[string]interface{}
+		field    string
+	}{
+		{"country", map[string]interface{}{"name": "France"}, "code"},
+		{"country", map[string]interface{}{"name": strings.Repeat("a", 151), "code": "FR"}, "name"},
+		{"posts", map[string]interface{}{"body": "no title"}, "title"},
+		{"posts", map[string]interface{}{"title": strings.Repeat("a", 151)}, "title"},
+		{"feed", map[string]interface{}{"title": 42}, "title"},
+		{"feed", map[string]interface{}{"likes": "many"}, "likes"},
+		{"channel", map[string]interface{}{"tags": []interface{}{1, 2}}, "tags"},
+		{"categories", map[string]interface{}{"unknown": "field"}, "unknown"},
+	}
+	for _, tt := range tests {
+		status, b := call(t, ts, "POST", "/"+tt.resource, jack, tt.payload)
+		if !assert.Equal(t, 422, status, "%s %v: %s", tt.resource, tt.payload, b) {
+			continue
+		}
+		issues, _ := decodeItem(t, b)["issues"].(map[string]interface{})
+		assert.Contains(t, issues, tt.field, fmt.Sprintf("%s: %s", tt.resource, b))
+	}
+}
+
+func TestSeedIsIdempotent(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if !assert.NoError(t, s.seed(ctx, "fixtures", "development")) {
+			return
+		}
+	}
+	for name, count := range map[string]int{"users": 3, "categories": 4, "country": 3, "channel": 2} {
+		list, err := s.storers[name].Find(ctx, resource.NewLookup(), 1, 100)
+		if assert.NoError(t, err, name) {
+			assert.Len(t, list.Items, count, name)
+		}
+	}
+
+	// Seeded users can authenticate
+	status, _ := call(t, ts, "GET", "/users/john", tokenFor(t, "john"), nil)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestTrash(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	john := tokenFor(t, "john")
+	admin := tokenFor(t, "admin")
+
+	status, b := call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Oops"})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	id := decodeItem(t, b)["id"].(string)
+
+	status, _ = call(t, ts, "DELETE", "/feed/"+id, jack, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = call(t, ts, "GET", "/feed/"+id, jack, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, b = call(t, ts, "GET", "/feed", jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 0)
+	}
+
+	status, _ = call(t, ts, "GET", "/feed/trash", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	for token, count := range map[string]int{jack: 1, john: 0, admin: 1} {
+		status, b = call(t, ts, "GET", "/feed/trash", token, nil)
+		if assert.Equal(t, http.StatusOK, status, string(b)) {
+			list := decodeList(t, b)
+			if assert.Len(t, list, count) && count > 0 {
+				assert.Equal(t, id, list[0]["id"])
+				assert.Equal(t, "jack", list[0]["deleted_by"])
+			}
+		}
+	}
+
+	status, _ = call(t, ts, "POST", "/feed/"+id+"/restore", john, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, b = call(t, ts, "POST", "/feed/"+id+"/restore", jack, nil)
+	assert.Equal(t, http.StatusOK, status, string(b))
+	status, b = call(t, ts, "GET", "/feed/"+id, jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Nil(t, decodeItem(t, b)["deleted_at"])
+	}
+
+	// Admins restore anyone's items
+	call(t, ts, "DELETE", "/feed/"+id, jack, nil)
+	status, _ = call(t, ts, "POST", "/feed/"+id+"/restore", admin, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	// Purge hard deletes the items past the retention
+	call(t, ts, "DELETE", "/feed/"+id, jack, nil)
+	s.trash.Purge(context.Background(), time.Hour)
+	status, b = call(t, ts, "GET", "/feed/trash", jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 1, "deleted within retention")
+	}
+	s.trash.Purge(context.Background(), -time.Hour)
+	status, b = call(t, ts, "GET", "/feed/trash", jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 0, "purged")
+	}
+}
+
+func TestTrashedIDs(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	status, b := call(t, ts, "PUT", "/feed/0123456789abcdefghij", jack, map[string]interface{}{"title": "First"})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	call(t, ts, "DELETE", "/feed/0123456789abcdefghij", jack, nil)
+	status, b = call(t, ts, "PUT", "/feed/0123456789abcdefghij", jack, map[string]interface{}{"title": "Second"})
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, string(b), "in the trash")
+	status, _ = call(t, ts, "POST", "/feed/0123456789abcdefghij/restore", jack, nil)
+	assert.Equal(t, http.StatusOK, status)
+	status, b = call(t, ts, "GET", "/feed/0123456789abcdefghij", jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Equal(t, "First", decodeItem(t, b)["title"])
+	}
+}
+
+// failingDeletes fails to delete the item with id
+type failingDeletes struct {
+	resource.Storer
+	id string
+}
+
+func (s failingDeletes) Delete(ctx context.Context, item *resource.Item) error {
+	if item.ID == s.id {
+		return errors.New("storage unavailable")
+	}
+	return s.Storer.Delete(ctx, item)
+}
+
+func TestTrashPurgeFailures(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	paths := []string{}
+	for _, title := range []string{"Stuck", "Gone", "Gone too"} {
+		path := create(t, ts, "/feed", "jack", map[string]interface{}{"title": title})
+		call(t, ts, "DELETE", path, jack, nil)
+		paths = append(paths, path)
+	}
+	sd := s.trash.storers["feed"]
+	s.trash.storers["feed"] = softDeleteStorer{Storer: failingDeletes{Storer: sd.Storer, id: strings.TrimPrefix(paths[0], "/feed/")}, clock: sd.clock}
+	s.trash.Purge(context.Background(), -time.Hour)
+	status, b := call(t, ts, "GET", "/feed/trash", jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		if list := decodeList(t, b); assert.Len(t, list, 1, "the other items are purged") {
+			assert.Equal(t, "Stuck", list[0]["title"])
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+
+	status, _ := call(t, ts, "PATCH", "/users/jack", tokenFor(t, "jack"), map[string]interface{}{"roles": []string{"admin"}})
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestWorkflow(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	john := tokenFor(t, "john")
+	admin := tokenFor(t, "admin")
+
+	status, b := call(t, ts, "POST", "/news", jack, map[string]interface{}{"title": "Scoop", "status": "published"})
+	assert.Equal(t, 422, status, string(b))
+	status, b = call(t, ts, "POST", "/news", jack, map[string]interface{}{"title": "Scoop"})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	item := decodeItem(t, b)
+	assert.Equal(t, "draft", item["status"])
+	path := "/news/" + item["id"].(string)
+
+	status, _ = call(t, ts, "PATCH", path, jack, map[string]interface{}{"status": "published"})
+	assert.Equal(t, 422, status, "no draft to published transition")
+	status, _ = call(t, ts, "POST", path+"/transition", john, map[string]interface{}{"to": "review"})
+	assert.Equal(t, http.StatusForbidden, status, "not the owner")
+	status, b = call(t, ts, "POST", path+"/transition", jack, map[string]interface{}{"to": "review"})
+	assert.Equal(t, http.StatusOK, status, string(b))
+	status, _ = call(t, ts, "POST", path+"/transition", jack, map[string]interface{}{"to": "published"})
+	assert.Equal(t, http.StatusForbidden, status, "owners don't publish")
+	status, b = call(t, ts, "POST", path+"/transition", admin, map[string]interface{}{"to": "published"})
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		item = decodeItem(t, b)
+		assert.Equal(t, "published", item["status"])
+		history, _ := item["status_history"].([]interface{})
+		if assert.Len(t, history, 2) {
+			assert.Equal(t, "review", history[1].(map[string]interface{})["from"])
+			assert.Equal(t, "admin", history[1].(map[string]interface{})["by"])
+		}
+	}
+	status, _ = call(t, ts, "PATCH", path, jack, map[string]interface{}{"status_history": []interface{}{}})
+	assert.Equal(t, 422, status, "history is read only")
+}
+
+func TestAudit(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	admin := tokenFor(t, "admin")
+
+	status, b := call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Audited"})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	id := decodeItem(t, b)["id"].(string)
+	call(t, ts, "PATCH", "/feed/"+id, jack, map[string]interface{}{"title": "Audited twice"})
+	call(t, ts, "DELETE", "/feed/"+id, jack, nil)
+
+	status, _ = call(t, ts, "GET", "/audit", jack, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = call(t, ts, "POST", "/audit", admin, map[string]interface{}{"action": "insert"})
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	filter := url.QueryEscape(fmt.Sprintf(`{"resource":"feed","item_id":%q}`, id))
+	status, b = call(t, ts, "GET", "/audit?sort=created&filter="+filter, admin, nil)
+	if !assert.Equal(t, http.StatusOK, status, string(b)) {
+		return
+	}
+	entries := decodeList(t, b)
+	if assert.Len(t, entries, 3) {
+		for i, action := range []string{"insert", "update", "delete"} {
+			assert.Equal(t, action, entries[i]["action"])
+			assert.Equal(t, "jack", entries[i]["actor"])
+		}
+		change, _ := entries[1]["diff"].(map[string]interface{})["title"].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"from": "Audited", "to": "Audited twice"}, change)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	status, b := call(t, ts, "POST", "/video", jack, map[string]interface{}{"title": "First cut", "duration": "PT1M"})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	path := "/video/" + decodeItem(t, b)["id"].(string)
+	call(t, ts, "PATCH", path, jack, map[string]interface{}{"title": "Second cut"})
+	call(t, ts, "PATCH", path, jack, map[string]interface{}{"title": "Final cut"})
+
+	status, b = call(t, ts, "GET", path+"/revisions", jack, nil)
+	if !assert.Equal(t, http.StatusOK, status, string(b)) {
+		return
+	}
+	revs := decodeList(t, b)
+	if !assert.Len(t, revs, 2) {
+		return
+	}
+	first := revs[1]["etag"].(string)
+	assert.Equal(t, "First cut", revs[1]["payload"].(map[string]interface{})["title"])
+
+	status, b = call(t, ts, "GET", path+"/revisions/"+first, jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Equal(t, first, decodeItem(t, b)["etag"])
+	}
+	status, _ = call(t, ts, "GET", path+"/revisions/unknown", jack, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, b = call(t, ts, "GET", path+"/revisions/"+first+"/diff/current", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		assert.Equal(t, map[string]interface{}{"from": "First cut", "to": "Final cut"}, decodeItem(t, b)["title"])
+	}
+
+	status, _ = call(t, ts, "POST", path+"/revisions/"+first+"/rollback", tokenFor(t, "john"), nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, b = call(t, ts, "POST", path+"/revisions/"+first+"/rollback", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		assert.Equal(t, "First cut", decodeItem(t, b)["title"])
+	}
+	status, b = call(t, ts, "GET", path+"/revisions", jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 3, "the rollback is a new revision")
+	}
+}
+
+func TestRevisionCap(t *testing.T) {
+	caps := *revisionCaps
+	*revisionCaps = "video=2"
+	defer func() { *revisionCaps = caps }()
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	path := create(t, ts, "/video", "jack", map[string]interface{}{"title": "cut 0"})
+	for i := 1; i <= 4; i++ {
+		status, b := call(t, ts, "PATCH", path, jack, map[string]interface{}{"title": fmt.Sprintf("cut %d", i)})
+		assert.Equal(t, http.StatusOK, status, string(b))
+	}
+	status, b := call(t, ts, "GET", path+"/revisions", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		titles := []interface{}{}
+		for _, rev := range decodeList(t, b) {
+			titles = append(titles, rev["payload"].(map[string]interface{})["title"])
+		}
+		assert.Equal(t, []interface{}{"cut 3", "cut 2"}, titles, "only the newest revisions are kept")
+	}
+}
+
+func TestRollbackValidatesRevision(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	path := create(t, ts, "/feed", "jack", map[string]interface{}{"title": "A long draft"})
+	call(t, ts, "PATCH", path, jack, map[string]interface{}{"title": "Final"})
+	status, b := call(t, ts, "GET", path+"/revisions", jack, nil)
+	if !assert.Equal(t, http.StatusOK, status, string(b)) {
+		return
+	}
+	revs := decodeList(t, b)
+	if !assert.Len(t, revs, 1) {
+		return
+	}
+
+	// The schema changed since the revision
+	fields := s.resources["feed"].Schema().Fields
+	title := fields["title"]
+	defer func() { fields["title"] = title }()
+	shorter := title
+	shorter.Validator = &schema.String{MaxLen: 5}
+	fields["title"] = shorter
+
+	status, b = call(t, ts, "POST", path+"/revisions/"+revs[0]["etag"].(string)+"/rollback", jack, nil)
+	if assert.Equal(t, 422, status, string(b)) {
+		issues, _ := decodeItem(t, b)["issues"].(map[string]interface{})
+		assert.Contains(t, issues, "title")
+	}
+	status, b = call(t, ts, "GET", path, jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Equal(t, "Final", decodeItem(t, b)["title"])
+	}
+}
+
+func TestRollbackKeepsReadOnlyFields(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	path := create(t, ts, "/feed", "jack", map[string]interface{}{"title": "Draft"})
+	call(t, ts, "PATCH", path, jack, map[string]interface{}{"title": "Final"})
+	status, b := call(t, ts, "GET", path+"/revisions", jack, nil)
+	if !assert.Equal(t, http.StatusOK, status, string(b)) {
+		return
+	}
+	revs := decodeList(t, b)
+	if !assert.Len(t, revs, 1) {
+		return
+	}
+	status, _ = call(t, ts, "PUT", path+"/reactions/like", jack, nil)
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, b = call(t, ts, "POST", path+"/revisions/"+revs[0]["etag"].(string)+"/rollback", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		item := decodeItem(t, b)
+		assert.Equal(t, "Draft", item["title"])
+		assert.Equal(t, 1.0, item["likes"], "counters are not rolled back")
+	}
+}
+
+func TestSeedIsOptIn(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	defer func(e string) { *env = e }(*env)
+
+	assert.False(t, *seedOnStart)
+	assert.NoError(t, checkSeedOnStart("mem"))
+	assert.Error(t, checkSeedOnStart("es"), "Elasticsearch needs an explicit -env")
+	assert.Error(t, runSeed(s, "es", nil))
+	assert.NoError(t, runSeed(s, "es", []string{"-set", "development"}))
+	*env = "production"
+	assert.Error(t, checkSeedOnStart("mem"))
+	assert.NoError(t, flag.Set("env", "staging"))
+	assert.NoError(t, checkSeedOnStart("es"))
+}
+
+// fakeElasticsearch serves the cluster health and the existence of the
+// index and types, after the delay set with the returned function
+func fakeElasticsearch(status string, index string, types []string) (*httptest.Server, func(time.Duration)) {
+	known := map[string]bool{"/" + index: true}
+	for _, typ := range types {
+		known["/"+index+"/"+typ] = true
+		known["/"+index+"/_mapping/"+typ] = true
+	}
+	var delay int64
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		switch {
+		case r.URL.Path == "/_cluster/health":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"cluster_name": "test", "status": status})
+		case r.URL.Path == "/":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"version": map[string]interface{}{"number": "2.4.6"}})
+		case known[r.URL.Path]:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return es, func(d time.Duration) { atomic.StoreInt64(&delay, int64(d)) }
+}
+
+func TestProbes(t *testing.T) {
+	defer func(url string, timeout time.Duration) {
+		*esURL, *esHealthTimeout = url, timeout
+	}(*esURL, *esHealthTimeout)
+	*esHealthTimeout = 200 * time.Millisecond
+	probe := func(h http.Handler) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code, decodeItem(t, rec.Body.Bytes())
+	}
+	checks := func(body map[string]interface{}) map[string]string {
+		statuses := map[string]string{}
+		for name, check := range body["checks"].(map[string]interface{}) {
+			statuses[name] = check.(map[string]interface{})["status"].(string)
+		}
+		return statuses
+	}
+	ready := func(es *httptest.Server, types ...string) http.Handler {
+		*esURL = es.URL
+		client, err := newProbeClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readinessHandler{client: client, index: "test", types: types}
+	}
+
+	status, body := probe(http.HandlerFunc(livenessHandler))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body["status"])
+
+	// Without Elasticsearch only the JWT key is checked
+	status, body = probe(readinessHandler{})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]string{"jwt_key": "ok"}, checks(body))
+	defer func(secret string) { *jwtSecret = secret }(*jwtSecret)
+	*jwtSecret = ""
+	status, _ = probe(readinessHandler{})
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	*jwtSecret = "secret"
+
+	es, delay := fakeElasticsearch("green", "test", []string{"feed"})
+	defer es.Close()
+	status, body = probe(ready(es, "feed"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]string{"elasticsearch": "ok", "index:test": "ok", "type:feed": "ok", "jwt_key": "ok"}, checks(body))
+	status, body = probe(ready(es, "feed", "users"))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "failed", checks(body)["type:users"], "every type is checked")
+
+	red, _ := fakeElasticsearch("red", "test", []string{"feed"})
+	defer red.Close()
+	status, _ = probe(ready(red, "feed"))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// The checks don't wait for an unresponsive cluster
+	h := ready(es, "feed")
+	delay(time.Second)
+	start := time.Now()
+	status, body = probe(h)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, map[string]string{"elasticsearch": "failed", "index:test": "failed", "type:feed": "failed", "jwt_key": "ok"}, checks(body))
+	assert.True(t, time.Since(start) < time.Second, time.Since(start).String())
+	delay(0)
+}
+
+// findingHook looks up its storer from OnFind, like the authentication hook
+// looking up the user of the request
+type findingHook struct {
+	storer resource.Storer
+}
+
+func (h findingHook) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	_, err := h.storer.Find(ctx, resource.NewLookup(), 1, 1)
+	return err
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var fields map[string]interface{}
+	logged := xlog.NewHandler(xlog.Config{Output: xlog.OutputFunc(func(f map[string]interface{}) error {
+		fields = f
+		return nil
+	})})
+	hook := traceHook("AuthResourceHook", findingHook{storer: newTracedStorer("memory", "", "users", mem.NewHandler())})
+	h := NewTraceHandler()(logged(xlog.RequestIDHandler("req_id", "Request-Id")(NewTraceCorrelationHandler("req_id")(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := hook.OnFind(r.Context(), r, resource.NewLookup(), 1, 1); err != nil {
+				t.Fatal(err)
+			}
+			xlog.FromRequest(r).Info("served")
+		})))))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/feed", nil)
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, traceID, rec.Header().Get("Trace-Id"), "the trace of the caller is continued")
+
+	// The trace id is a field of the request logs
+	assert.Equal(t, traceID, fields["trace_id"])
+	assert.NotEmpty(t, fields["req_id"])
+
+	spans := map[trace.SpanID]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() == traceID {
+			spans[span.SpanContext.SpanID()] = span
+		}
+	}
+	attribute := func(span tracetest.SpanStub, key string) string {
+		for _, kv := range span.Attributes {
+			if string(kv.Key) == key {
+				return kv.Value.AsString()
+			}
+		}
+		return ""
+	}
+	// ancestors returns the names of the ancestors of span, the closest first
+	ancestors := func(span tracetest.SpanStub) []string {
+		names := []string{}
+		for parent, found := spans[span.Parent.SpanID()]; found; parent, found = spans[parent.Parent.SpanID()] {
+			names = append(names, parent.Name)
+		}
+		return names
+	}
+	server, users := 0, 0
+	for _, span := range spans {
+		switch span.Name {
+		case "http.request":
+			server++
+			assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+			assert.Equal(t, rec.Header().Get("Request-Id"), attribute(span, "req_id"))
+		case "memory.find":
+			users++
+			assert.Equal(t, trace.SpanKindClient, span.SpanKind)
+			assert.Equal(t, "users", attribute(span, "db.type"))
+			assert.Equal(t, []string{"AuthResourceHook.OnFind", "http.request"}, ancestors(span))
+		}
+	}
+	assert.Equal(t, 1, server)
+	assert.Equal(t, 1, users)
+}
+
+func TestWorkers(t *testing.T) {
+	bg := newWorkers()
+	running := make(chan struct{})
+	var finished, ticks int32
+	bg.Go("job", func(ctx context.Context) {
+		close(running)
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	})
+	bg.Every("ticker", time.Millisecond, func(ctx context.Context) {
+		atomic.AddInt32(&ticks, 1)
+	})
+	<-running
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&ticks) < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	bg.Stop(context.Background())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&finished), "Stop waits for the running jobs")
+	n := atomic.LoadInt32(&ticks)
+	assert.True(t, n >= 3, "%d ticks", n)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&ticks), "Every stops on shutdown")
+
+	// Stop gives up waiting once its context is done
+	bg = newWorkers()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	bg.Go("stuck", func(ctx context.Context) {
+		<-stuck
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	bg.Stop(ctx)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestListenAndServeShutdown(t *testing.T) {
+	// Keep SIGTERM from killing the test process
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	defer func(addr string) { *listenAddr = addr }(*listenAddr)
+	*listenAddr = addr
+
+	var mu sync.Mutex
+	events := []string{}
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		record("request")
+		w.Write([]byte("done"))
+	}))
+	shutdown := make(chan struct{})
+	srv.RegisterOnShutdown(func() { close(shutdown) })
+	done := make(chan error, 1)
+	go func() {
+		done <- listenAndServe(srv, func(ctx context.Context) {
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline, "shutdown is bounded by -shutdown-timeout")
+			record("onShutdown")
+		})
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			res, err := http.Get("http://" + addr)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			body <- string(b)
+			return
+		}
+		body <- ""
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not started")
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown functions not called")
+	}
+	close(release)
+	assert.Equal(t, "done", <-body, "in-flight requests complete")
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listenAndServe did not return")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"request", "onShutdown"}, events, "background jobs stop after the requests")
+}
+
+// fakeClock is a clock set by the tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestScheduler(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	admin := tokenFor(t, "admin")
+	clock := &fakeClock{now: time.Now()}
+	s.scheduler.clock = clock
+
+	status, b := call(t, ts, "POST", "/news", jack, map[string]interface{}{
+		"title":        "Breaking",
+		"publish_at":   clock.now.Add(time.Hour).Format(time.RFC3339),
+		"unpublish_at": clock.now.Add(2 * time.Hour).Format(time.RFC3339),
+	})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	path := "/news/" + decodeItem(t, b)["id"].(string)
+	statusOf := func() string {
+		_, b := call(t, ts, "GET", path, jack, nil)
+		return decodeItem(t, b)["status"].(string)
+	}
+
+	// Drafts are not published
+	clock.now = clock.now.Add(90 * time.Minute)
+	s.scheduler.Run(context.Background())
+	assert.Equal(t, "draft", statusOf())
+
+	call(t, ts, "POST", path+"/transition", jack, map[string]interface{}{"to": "review"})
+	s.scheduler.Run(context.Background())
+	assert.Equal(t, "published", statusOf())
+
+	// Running again, like another instance would, changes nothing
+	s.scheduler.Run(context.Background())
+	_, b = call(t, ts, "GET", path, admin, nil)
+	item := decodeItem(t, b)
+	assert.Equal(t, "published", item["status"])
+	assert.Nil(t, item["publish_at"])
+	assert.Len(t, item["status_history"], 2)
+
+	clock.now = clock.now.Add(time.Hour)
+	s.scheduler.Run(context.Background())
+	assert.Equal(t, "archived", statusOf())
+}
+
+func TestWebhooks(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	s.webhooks.backoff = time.Millisecond
+	s.webhooks.maxAttempts = 2
+	s.webhooks.disableAfter = 2
+	bg := newWorkers()
+	bg.Go("webhooks", s.webhooks.Run)
+	bg.Every("webhook-retries", 5*time.Millisecond, s.webhooks.Retry)
+	defer bg.Stop(context.Background())
+	jack := tokenFor(t, "jack")
+	admin := tokenFor(t, "admin")
+	secret := "0123456789abcdef"
+
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	var fail int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- b
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+	wait := func() (*http.Request, []byte) {
+		select {
+		case r := <-received:
+			return r, <-bodies
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not called")
+			return nil, nil
+		}
+	}
+
+	hook := map[string]interface{}{"url": receiver.URL, "secret": secret, "resources": []string{"feed"}, "events": []string{"insert"}}
+	status, _ := call(t, ts, "POST", "/webhooks", jack, hook)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, b := call(t, ts, "POST", "/webhooks", admin, hook)
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	created := decodeItem(t, b)
+	assert.Nil(t, created["secret"], "secret is hidden")
+	hookPath := "/webhooks/" + created["id"].(string)
+
+	// Updates and other resources are filtered out
+	call(t, ts, "POST", "/news", jack, map[string]interface{}{"title": "Not sent"})
+	call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Sent"})
+	r, body := wait()
+	assert.Equal(t, "insert", r.Header.Get("X-Webhook-Event"))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Webhook-Signature"))
+	event := decodeItem(t, body)
+	assert.Equal(t, "feed", event["resource"])
+	assert.Equal(t, "Sent", event["item"].(map[string]interface{})["title"])
+	assert.Equal(t, "jack", event["actor"])
+
+	// Failing webhooks are retried, then disabled
+	atomic.StoreInt32(&fail, 1)
+	call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Failed"})
+	wait()
+	wait()
+	call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Failed again"})
+	wait()
+	wait()
+	time.Sleep(100 * time.Millisecond)
+	_, b = call(t, ts, "GET", hookPath, admin, nil)
+	assert.Equal(t, false, decodeItem(t, b)["active"])
+	status, b = call(t, ts, "GET", hookPath+"/deliveries?filter="+url.QueryEscape(`{"success":false}`), admin, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		assert.Len(t, decodeList(t, b), 4)
+	}
+}
+
+// readEvent reads the next Server-Sent Event of a stream, skipping comments
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(event) > 0 {
+				return event
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		event[kv[0]] = kv[1]
+	}
+}
+
+func TestStream(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	clock := &fakeClock{now: time.Now()}
+	s.stream.clock = clock
+	ticket := func() string {
+		status, b := call(t, ts, "POST", "/stream/tickets", jack, nil)
+		if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+			t.FailNow()
+		}
+		return decodeItem(t, b)["ticket"].(string)
+	}
+
+	status, _ := call(t, ts, "GET", "/stream", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = call(t, ts, "POST", "/stream/tickets", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = call(t, ts, "GET", "/stream?access_token="+jack, "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status, "tokens are not taken from the URL")
+	expired := ticket()
+	clock.now = clock.now.Add(time.Minute)
+	status, _ = call(t, ts, "GET", "/stream?ticket="+expired, "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status, "tickets expire")
+
+	used := ticket()
+	res, err := http.Get(ts.URL + "/stream?resource=feed&tag=sport&ticket=" + used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	status, _ = call(t, ts, "GET", "/stream?ticket="+used, "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status, "tickets are used once")
+
+	call(t, ts, "POST", "/news", jack, map[string]interface{}{"title": "Other resource", "tags": []string{"sport"}})
+	call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Other tag", "tags": []string{"music"}})
+	call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Goal", "tags": []string{"sport"}})
+	event := readEvent(t, bufio.NewReader(res.Body))
+	assert.Equal(t, "insert", event["event"])
+	data := decodeItem(t, []byte(event["data"]))
+	assert.Equal(t, "Goal", data["item"].(map[string]interface{})["title"])
+
+	// Reconnecting clients get the events they missed
+	req, _ := http.NewRequest("GET", ts.URL+"/stream?resource=feed", nil)
+	req.Header.Set("Authorization", jack)
+	req.Header.Set("Last-Event-ID", "0")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+	r := bufio.NewReader(resumed.Body)
+	assert.Equal(t, "Other tag", decodeItem(t, []byte(readEvent(t, r)["data"]))["item"].(map[string]interface{})["title"])
+	missed := readEvent(t, r)
+	assert.Equal(t, event["id"], missed["id"])
+}
+
+// publish moves the item at path through the workflow up to published
+func publish(t *testing.T, ts *httptest.Server, path string) {
+	admin := tokenFor(t, "admin")
+	for _, status := range []string{"review", "published"} {
+		if code, b := call(t, ts, "POST", path+"/transition", admin, map[string]interface{}{"to": status}); code != http.StatusOK {
+			t.Fatalf("can't move %s to %s: %d %s", path, status, code, b)
+		}
+	}
+}
+
+func TestWebhooksShutdown(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	admin := tokenFor(t, "admin")
+
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Webhook-Delivery")
+	}))
+	defer receiver.Close()
+	status, b := call(t, ts, "POST", "/webhooks", admin, map[string]interface{}{"url": receiver.URL, "secret": "0123456789abcdef"})
+	if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+		return
+	}
+	hookPath := "/webhooks/" + decodeItem(t, b)["id"].(string)
+
+	// The events queued on shutdown are stored
+	call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "Queued"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.webhooks.Run(ctx)
+	_, b = call(t, ts, "GET", hookPath+"/deliveries", admin, nil)
+	pending := decodeList(t, b)
+	if !assert.Len(t, pending, 1) {
+		return
+	}
+	assert.Equal(t, 0.0, pending[0]["attempt"])
+	assert.NotNil(t, pending[0]["next_attempt"])
+
+	// and delivered on the next start
+	bg := newWorkers()
+	bg.Go("webhooks", s.webhooks.Run)
+	bg.Every("webhook-retries", 5*time.Millisecond, s.webhooks.Retry)
+	defer bg.Stop(context.Background())
+	select {
+	case id := <-received:
+		assert.Equal(t, pending[0]["event_id"], id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, b = call(t, ts, "GET", hookPath+"/deliveries?sort=created", admin, nil)
+	if deliveries := decodeList(t, b); assert.Len(t, deliveries, 2) {
+		assert.Nil(t, deliveries[0]["next_attempt"], "retries are taken once")
+		assert.Equal(t, true, deliveries[1]["success"])
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	limiter := newRateLimiter(clock, map[string]rateLimit{"videos:GET": {Limit: 2, Window: time.Minute}}, nil)
+	h := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(xff string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "/videos", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", xff)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result(), rec.Body.Bytes()
+	}
+
+	res, _ := get("192.0.2.1")
+	assert.NotEqual(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "1", res.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", res.Header.Get("RateLimit-Reset"))
+
+	clock.now = clock.now.Add(15 * time.Second)
+	res, _ = get("192.0.2.1")
+	assert.NotEqual(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "0", res.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "45", res.Header.Get("RateLimit-Reset"))
+
+	// X-Forwarded-For is ignored from untrusted peers
+	res, b := get("192.0.2.2")
+	if assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, string(b)) {
+		body := decodeItem(t, b)
+		assert.Equal(t, 429.0, body["code"])
+		assert.Equal(t, "Rate limit exceeded, retry in 45 seconds", body["message"])
+		assert.Equal(t, "45", res.Header.Get("Retry-After"))
+		assert.Equal(t, "0", res.Header.Get("RateLimit-Remaining"))
+	}
+
+	// The window resets
+	clock.now = clock.now.Add(45 * time.Second)
+	res, _ = get("192.0.2.1")
+	assert.NotEqual(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", res.Header.Get("RateLimit-Reset"))
+	assert.Equal(t, "", res.Header.Get("Retry-After"))
+
+	// Behind a trusted proxy each forwarded client has its own window
+	trusted, err := parseTrustedProxies("127.0.0.1,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.trusted = trusted
+	get("198.51.100.1")
+	res, _ = get("198.51.100.1")
+	assert.Equal(t, "0", res.Header.Get("RateLimit-Remaining"))
+	res, _ = get("198.51.100.2")
+	assert.NotEqual(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("RateLimit-Remaining"))
+	// Hops prepended by the client are not trusted
+	res, _ = get("198.51.100.2, 198.51.100.1")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+
+	// Requests matching no rule are not limited
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/feed", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("RateLimit-Limit"))
+}
+
+func TestParseRateLimits(t *testing.T) {
+	rules, err := parseRateLimits("*:*=600/m, feed:post=10/s")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]rateLimit{
+		"*:*":       {Limit: 600, Window: time.Minute},
+		"feed:POST": {Limit: 10, Window: time.Second},
+	}, rules)
+	for _, spec := range []string{"feed=10/m", "feed:GET=0/m", "feed:GET=10/d"} {
+		_, err := parseRateLimits(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	cache := newResponseCache(clock, map[string]time.Duration{"feed": 30 * time.Second}, time.Minute, 100)
+	var mu sync.Mutex
+	title := "Cached"
+	h := cache.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		userID, _ := UserIDFromToken(r)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"title": title, "user": userID})
+	}))
+	jack := tokenFor(t, "jack")
+	get := func(path, token string) (*http.Response, map[string]interface{}) {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result(), decodeItem(t, rec.Body.Bytes())
+	}
+
+	res, _ := get("/feed/1", jack)
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Equal(t, "0", res.Header.Get("Age"))
+	clock.now = clock.now.Add(10 * time.Second)
+	res, item := get("/feed/1", jack)
+	assert.Equal(t, "HIT", res.Header.Get("X-Cache"))
+	assert.Equal(t, "10", res.Header.Get("Age"))
+	assert.Equal(t, "max-age=20, stale-while-revalidate=60", res.Header.Get("Cache-Control"))
+	assert.Equal(t, "Cached", item["title"])
+
+	// Responses are cached per user and normalized URL
+	res, item = get("/feed/1", tokenFor(t, "john"))
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Equal(t, "john", item["user"])
+	res, item = get("/feed/1", "")
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Equal(t, "", item["user"])
+	get("/feed/1?b=2&a=1", jack)
+	res, _ = get("/feed/1?a=1&b=2", jack)
+	assert.Equal(t, "HIT", res.Header.Get("X-Cache"), "parameters are normalized")
+
+	// Other resources and conditional requests are not cached
+	res, _ = get("/users/jack", jack)
+	assert.Equal(t, "", res.Header.Get("X-Cache"))
+	req := httptest.NewRequest("GET", "/feed/1", nil)
+	req.Header.Set("If-None-Match", `"abcd"`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, "", rec.Header().Get("X-Cache"))
+
+	// Writes to the resource drop its cached responses
+	mu.Lock()
+	title = "Changed"
+	mu.Unlock()
+	var err error
+	cacheInvalidationHook{cache: cache, resource: "feed"}.OnUpdated(context.Background(), nil, nil, nil, &err)
+	res, item = get("/feed/1", jack)
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Equal(t, "Changed", item["title"])
+
+	// Expired responses are served stale while being refreshed
+	mu.Lock()
+	title = "Refreshed"
+	mu.Unlock()
+	clock.now = clock.now.Add(35 * time.Second)
+	res, item = get("/feed/1", jack)
+	assert.Equal(t, "STALE", res.Header.Get("X-Cache"))
+	assert.Equal(t, "35", res.Header.Get("Age"))
+	assert.Equal(t, "max-age=0, stale-while-revalidate=60", res.Header.Get("Cache-Control"))
+	assert.Equal(t, "Changed", item["title"])
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if res, item = get("/feed/1", jack); res.Header.Get("X-Cache") == "HIT" {
+			break
+		}
+	}
+	assert.Equal(t, "HIT", res.Header.Get("X-Cache"))
+	assert.Equal(t, "Refreshed", item["title"])
+
+	// Past the stale period responses are dropped
+	clock.now = clock.now.Add(91 * time.Second)
+	res, _ = get("/feed/1", jack)
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+}
+
+func TestICalendarOrganizer(t *testing.T) {
+	item, err := resource.NewItem(map[string]interface{}{
+		"id":        "1",
+		"title":     "Injected",
+		"start":     time.Now(),
+		"organizer": map[string]interface{}{"name": "Evil \"Club\"\r\nATTENDEE:mailto:x@x.io\x00\x7f", "email": "club@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cal := string(icalendar("Events", []*resource.Item{item}, time.Now()))
+	assert.Contains(t, cal, "\r\nORGANIZER;CN=\"Evil ClubATTENDEE:mailto:x@x.io\":mailto:club@example.com\r\n")
+	assert.NotContains(t, cal, "\r\nATTENDEE")
+}
+
+// TestResponseCacheReactions checks the cached items follow their comments
+// and reactions, which are per user
+func TestResponseCacheReactions(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	clock := &fakeClock{now: time.Now()}
+	s.cache.clock = clock
+	s.cache.ttls = map[string]time.Duration{"feed": 30 * time.Second}
+	s.cache.stale = time.Minute
+	jack := tokenFor(t, "jack")
+	john := tokenFor(t, "john")
+
+	path := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Cached"})
+	get := func(token string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		res, b := send(t, req)
+		return res, decodeItem(t, b)
+	}
+
+	get(jack)
+	res, _ := get(jack)
+	assert.Equal(t, "HIT", res.Header.Get("X-Cache"))
+
+	// The writes to the comments of the item drop its cached responses
+	status, b := call(t, ts, "POST", "/comments", jack, map[string]interface{}{"resource": "feed", "item": path[len("/feed/"):], "body": "First"})
+	assert.Equal(t, http.StatusCreated, status, string(b))
+	res, item := get(jack)
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Equal(t, float64(1), item["comments"])
+
+	// So do its reactions, cached per user
+	status, b = call(t, ts, "PUT", path+"/reactions/like", jack, nil)
+	assert.Equal(t, http.StatusCreated, status, string(b))
+	res, item = get(jack)
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Equal(t, []interface{}{"like"}, item["my_reactions"])
+	res, _ = get(jack)
+	assert.Equal(t, "HIT", res.Header.Get("X-Cache"))
+	res, item = get(john)
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Equal(t, []interface{}{}, item["my_reactions"])
+	res, item = get("")
+	assert.Equal(t, "MISS", res.Header.Get("X-Cache"))
+	assert.Nil(t, item["my_reactions"])
+	anonymousETag := res.Header.Get("Etag")
+	res, _ = get(jack)
+	assert.NotEqual(t, anonymousETag, res.Header.Get("Etag"), "so are the ETags of the items with reactions")
+}
+
+func TestResponseCacheVariants(t *testing.T) {
+	cache := newResponseCache(systemClock{}, map[string]time.Duration{"feed": 30 * time.Second}, time.Minute, 100)
+	cache.variants["feed"] = true
+	// The items are served with a single ETag, whatever the user
+	h := cache.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const etag = `"v1"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			writeError(w, http.StatusPreconditionFailed, "Precondition Failed")
+			return
+		}
+		w.Header().Set("Etag", etag)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"title": "Decorated"})
+	}))
+	jack := tokenFor(t, "jack")
+	john := tokenFor(t, "john")
+	call := func(method, token, header, etag string) *http.Response {
+		req := httptest.NewRequest(method, "/feed/1", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		if etag != "" {
+			req.Header.Set(header, etag)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	get := func(token, etag string) *http.Response {
+		return call("GET", token, "If-None-Match", etag)
+	}
+
+	jackETag := get(jack, "").Header.Get("Etag")
+	johnETag := get(john, "").Header.Get("Etag")
+	assert.NotEqual(t, `"v1"`, jackETag)
+	assert.NotEqual(t, jackETag, johnETag, "ETags are per user")
+	assert.Equal(t, `"v1"`, get("", "").Header.Get("Etag"), "but for anonymous users")
+	res := get(jack, "")
+	assert.Equal(t, "HIT", res.Header.Get("X-Cache"))
+	assert.Equal(t, jackETag, res.Header.Get("Etag"), "cached responses too")
+	assert.Equal(t, http.StatusNotModified, get(jack, jackETag).StatusCode)
+	assert.Equal(t, http.StatusOK, get(john, jackETag).StatusCode, "not validated for another user")
+
+	assert.Equal(t, http.StatusOK, call("PATCH", john, "If-Match", johnETag).StatusCode)
+	assert.Equal(t, http.StatusPreconditionFailed, call("PATCH", john, "If-Match", jackETag).StatusCode)
+}
+
+func TestRefreshContext(t *testing.T) {
+	ctx := NewContextWithUser(NewContextWithActor(context.Background(), "jack"), &resource.Item{ID: "jack"})
+	fresh := refreshContext(ctx)
+	actor, ok := ActorFromContext(fresh)
+	assert.True(t, ok)
+	assert.Equal(t, "jack", actor)
+	_, ok = UserFromContext(fresh)
+	assert.False(t, ok, "request values are left out")
+	assert.False(t, isSystemContext(fresh))
+	assert.True(t, isSystemContext(refreshContext(NewContextWithSystemActor(ctx, "scheduler"))))
+}
+
+func TestHistory(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	video := create(t, ts, "/video", "john", map[string]interface{}{"title": "Documentary", "duration": "PT1M40S"})
+	feed := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Article"})
+	read := func(path string, position int) map[string]interface{} {
+		parts := strings.Split(path, "/")
+		status, b := call(t, ts, "POST", "/me/history", jack, map[string]interface{}{"resource": parts[1], "item": parts[2], "position": position})
+		if !assert.Equal(t, http.StatusOK, status, string(b)) {
+			return nil
+		}
+		return decodeItem(t, b)
+	}
+	inProgress := func() []map[string]interface{} {
+		_, b := call(t, ts, "GET", "/me/history?in_progress=true", jack, nil)
+		return decodeList(t, b)
+	}
+
+	entry := read(video, 50)
+	assert.Equal(t, false, entry["completed"])
+	assert.Equal(t, float64(100), entry["duration"])
+	if list := inProgress(); assert.Len(t, list, 1) {
+		assert.Equal(t, float64(50), list[0]["position"])
+		assert.Equal(t, "Documentary", list[0]["item_data"].(map[string]interface{})["title"])
+	}
+	entry = read(video, 97)
+	assert.Equal(t, true, entry["completed"])
+	assert.Equal(t, float64(2), entry["reads"])
+	assert.Len(t, inProgress(), 0)
+	assert.Equal(t, true, read(feed, 0)["completed"])
+
+	status, b := call(t, ts, "GET", "/me/history", jack, nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 2)
+	}
+	status, b = call(t, ts, "GET", "/history", tokenFor(t, "john"), nil)
+	if assert.Equal(t, http.StatusOK, status) {
+		assert.Len(t, decodeList(t, b), 0, "history is private")
+	}
+
+	// Paused history is not recorded
+	call(t, ts, "PATCH", "/users/jack", jack, map[string]interface{}{"history_paused": true})
+	status, _ = call(t, ts, "POST", "/me/history", jack, map[string]interface{}{"resource": "video", "item": strings.Split(video, "/")[2], "position": 10})
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Len(t, inProgress(), 0)
+
+	status, _ = call(t, ts, "DELETE", "/history", jack, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+	_, b = call(t, ts, "GET", "/me/history", jack, nil)
+	assert.Len(t, decodeList(t, b), 0)
+}
+
+func TestParseDuration(t *testing.T) {
+	for v, want := range map[interface{}]time.Duration{
+		"PT1M":     time.Minute,
+		"PT1H2M3S": time.Hour + 2*time.Minute + 3*time.Second,
+		"P1DT1S":   24*time.Hour + time.Second,
+		"1:02:03":  time.Hour + 2*time.Minute + 3*time.Second,
+		"02:03":    2*time.Minute + 3*time.Second,
+		"90":       90 * time.Second,
+		90.5:       90*time.Second + 500*time.Millisecond,
+		"PT":       0,
+		"soon":     0,
+		nil:        0,
+	} {
+		d, ok := parseDuration(v)
+		assert.Equal(t, want, d, fmt.Sprint(v))
+		assert.Equal(t, want > 0, ok, fmt.Sprint(v))
+	}
+}
+
+func TestComments(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	john := tokenFor(t, "john")
+	admin := tokenFor(t, "admin")
+
+	path := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Debate"})
+	id := path[len("/feed/"):]
+	counter := func() interface{} {
+		_, b := call(t, ts, "GET", path, john, nil)
+		return decodeItem(t, b)["comments"]
+	}
+	post := func(token string, payload map[string]interface{}) map[string]interface{} {
+		payload["resource"], payload["item"] = "feed", id
+		status, b := call(t, ts, "POST", "/comments", token, payload)
+		if !assert.Equal(t, http.StatusCreated, status, string(b)) {
+			t.FailNow()
+		}
+		return decodeItem(t, b)
+	}
+
+	root := post(jack, map[string]interface{}{"body": "First"})
+	assert.Equal(t, "jack", root["user"])
+	assert.Equal(t, root["id"], root["thread"])
+	reply := post(john, map[string]interface{}{"body": "Reply", "parent": root["id"]})
+	assert.Equal(t, root["id"], reply["thread"])
+	assert.Equal(t, float64(1), reply["depth"])
+	assert.Equal(t, float64(2), counter())
+
+	other := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Other"})
+	status, _ := call(t, ts, "POST", "/comments", jack, map[string]interface{}{"resource": "feed", "item": other[len("/feed/"):], "body": "Off topic", "parent": root["id"]})
+	assert.Equal(t, 422, status)
+	status, _ = call(t, ts, "POST", "/comments", jack, map[string]interface{}{"resource": "feed", "item": "unknown", "body": "Lost"})
+	assert.Equal(t, 422, status)
+	status, _ = call(t, ts, "PATCH", path, john, map[string]interface{}{"comments": 100})
+	assert.Equal(t, 422, status, "the counter is read-only")
+
+	// Authors edit their comments within the edit window
+	status, b := call(t, ts, "PATCH", "/comments/"+reply["id"].(string), jack, map[string]interface{}{"body": "Hijacked"})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, b = call(t, ts, "PATCH", "/comments/"+reply["id"].(string), john, map[string]interface{}{"body": "Edited"})
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		assert.NotNil(t, decodeItem(t, b)["edited"])
+	}
+	s.comments.clock = &fakeClock{now: time.Now().Add(time.Hour)}
+	status, _ = call(t, ts, "PATCH", "/comments/"+reply["id"].(string), john, map[string]interface{}{"body": "Too late"})
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// Hidden comments are not counted and only seen by their author
+	status, _ = call(t, ts, "POST", "/comments/"+reply["id"].(string)+"/moderate", jack, map[string]interface{}{"status": "hidden"})
+	assert.Equal(t, http.StatusForbidden, status)
+	status, b = call(t, ts, "POST", "/comments/"+reply["id"].(string)+"/moderate", admin, map[string]interface{}{"status": "hidden"})
+	assert.Equal(t, http.StatusOK, status, string(b))
+	assert.Equal(t, float64(1), counter())
+	_, b = call(t, ts, "GET", "/comments", jack, nil)
+	assert.Len(t, decodeList(t, b), 1)
+	_, b = call(t, ts, "GET", "/comments", john, nil)
+	assert.Len(t, decodeList(t, b), 2)
+
+	// Threads keep the replies of deleted comments
+	status, _ = call(t, ts, "DELETE", "/comments/"+root["id"].(string), jack, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, float64(0), counter())
+	status, b = call(t, ts, "GET", path+"/comments", john, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		tree := decodeList(t, b)
+		if assert.Len(t, tree, 1) {
+			assert.Equal(t, "deleted", tree[0]["status"])
+			replies := tree[0]["replies"].([]interface{})
+			if assert.Len(t, replies, 1) {
+				assert.Equal(t, "Edited", replies[0].(map[string]interface{})["body"])
+			}
+		}
+	}
+	_, b = call(t, ts, "GET", path+"/comments", jack, nil)
+	assert.Len(t, decodeList(t, b), 0, "hidden replies are left out")
+}
+
+func TestReactions(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	john := tokenFor(t, "john")
+
+	path := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Likeable"})
+	read := func(token string) map[string]interface{} {
+		_, b := call(t, ts, "GET", path, token, nil)
+		return decodeItem(t, b)
+	}
+
+	status, b := call(t, ts, "PUT", path+"/reactions/like", jack, nil)
+	assert.Equal(t, http.StatusCreated, status, string(b))
+	status, _ = call(t, ts, "PUT", path+"/reactions/like", jack, nil)
+	assert.Equal(t, http.StatusOK, status, "adding is idempotent")
+	call(t, ts, "PUT", path+"/reactions/point", jack, nil)
+	call(t, ts, "PUT", path+"/reactions/like", john, nil)
+	status, _ = call(t, ts, "PUT", path+"/reactions/love", jack, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = call(t, ts, "PUT", path+"/reactions/like", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	item := read(jack)
+	assert.Equal(t, float64(2), item["likes"])
+	assert.Equal(t, float64(1), item["points"])
+	assert.Equal(t, []interface{}{"like", "point"}, item["my_reactions"])
+	_, b = call(t, ts, "GET", "/feed", john, nil)
+	if list := decodeList(t, b); assert.Len(t, list, 1) {
+		assert.Equal(t, []interface{}{"like"}, list[0]["my_reactions"])
+	}
+	status, b = call(t, ts, "GET", path+"/reactions", john, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		summary := decodeItem(t, b)
+		assert.Equal(t, map[string]interface{}{"like": float64(2), "point": float64(1)}, summary["counts"])
+		assert.Equal(t, []interface{}{"like"}, summary["mine"])
+	}
+	status, _ = call(t, ts, "PATCH", path, john, map[string]interface{}{"likes": 1000})
+	assert.Equal(t, 422, status, "counters are read-only")
+
+	// Only the items sent as is are flagged
+	call(t, ts, "PATCH", path, john, map[string]interface{}{"title": "Liked"})
+	_, b = call(t, ts, "GET", path+"/revisions", jack, nil)
+	if revs := decodeList(t, b); assert.Len(t, revs, 1) {
+		status, b = call(t, ts, "GET", path+"/revisions/"+revs[0]["etag"].(string)+"/diff/current", jack, nil)
+		if assert.Equal(t, http.StatusOK, status, string(b)) {
+			changes := decodeItem(t, b)
+			assert.NotNil(t, changes["title"])
+			assert.Nil(t, changes["my_reactions"])
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		status, _ = call(t, ts, "DELETE", path+"/reactions/like", jack, nil)
+		assert.Equal(t, http.StatusNoContent, status, "removing is idempotent")
+	}
+	item = read(jack)
+	assert.Equal(t, float64(1), item["likes"])
+	assert.Equal(t, []interface{}{"point"}, item["my_reactions"])
+	_, b = call(t, ts, "GET", "/reactions", jack, nil)
+	assert.Len(t, decodeList(t, b), 1, "users list their own reactions")
+
+	// Drifted counters are fixed by the reconciliation, including those of
+	// the items left without reactions
+	storer := s.storers["feed"]
+	other := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Unliked"})
+	_, err := setCounters(context.Background(), storer, strings.TrimPrefix(path, "/feed/"), map[string]int{"likes": 1000, "points": 0})
+	assert.NoError(t, err)
+	_, err = setCounters(context.Background(), storer, strings.TrimPrefix(other, "/feed/"), map[string]int{"likes": 5})
+	assert.NoError(t, err)
+	s.reactions.Reconcile(context.Background())
+	item = read(john)
+	assert.Equal(t, float64(1), item["likes"])
+	assert.Equal(t, float64(1), item["points"])
+	_, b = call(t, ts, "GET", other, john, nil)
+	assert.Equal(t, float64(0), decodeItem(t, b)["likes"])
+}
+
+func TestGeoSearch(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	for name, p := range map[string]geoPoint{
+		"Paris":  {48.8566, 2.3522},
+		"Lyon":   {45.7640, 4.8357},
+		"London": {51.5074, -0.1278},
+	} {
+		create(t, ts, "/feed", "jack", map[string]interface{}{
+			"title": name,
+			"place": map[string]interface{}{"name": name, "location": map[string]interface{}{"lat": p.Lat, "lon": p.Lon}},
+		})
+	}
+	create(t, ts, "/feed", "jack", map[string]interface{}{"title": "Nowhere"})
+	titles := func(query string) []string {
+		status, b := call(t, ts, "GET", "/feed?"+query, jack, nil)
+		if !assert.Equal(t, http.StatusOK, status, string(b)) {
+			return nil
+		}
+		titles := []string{}
+		for _, item := range decodeList(t, b) {
+			titles = append(titles, item["title"].(string))
+		}
+		return titles
+	}
+
+	assert.Equal(t, []string{"Paris"}, titles("near=48.86,2.35&radius=50km"))
+	assert.Equal(t, []string{"Paris", "Lyon"}, titles("near=48.86,2.35&radius=500km"), "nearest first")
+	assert.Equal(t, []string{"Lyon", "Paris", "London"}, titles("near=45.75,4.85&radius=1000mi"))
+	assert.Equal(t, []string{"Paris", "London"}, titles("near=45.75,4.85&radius=1000mi&filter="+url.QueryEscape(`{"title":{"$ne":"Lyon"}}`)), "filtered nearest first")
+	inBox := titles("bbox=51.1,-5.1,42.3,8.2")
+	sort.Strings(inBox)
+	assert.Equal(t, []string{"Lyon", "Paris"}, inBox)
+	for _, query := range []string{"near=100,2", "near=48.86", "near=48.86,2.35&radius=far", "bbox=1,2,3"} {
+		status, _ := call(t, ts, "GET", "/feed?"+query, jack, nil)
+		assert.Equal(t, 422, status, query)
+	}
+	status, _ := call(t, ts, "POST", "/feed", jack, map[string]interface{}{
+		"title": "Off the map",
+		"place": map[string]interface{}{"location": map[string]interface{}{"lat": 91, "lon": 0}},
+	})
+	assert.Equal(t, 422, status)
+
+	status, b := call(t, ts, "GET", "/feed/clusters?precision=1", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		cells := decodeList(t, b)
+		if assert.Len(t, cells, 2) {
+			assert.Equal(t, "u", cells[0]["geohash"])
+			assert.Equal(t, float64(2), cells[0]["count"])
+			assert.Equal(t, "g", cells[1]["geohash"])
+		}
+	}
+	status, b = call(t, ts, "GET", "/feed/clusters?precision=3&bbox=51.1,-5.1,42.3,8.2", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		assert.Len(t, decodeList(t, b), 2)
+	}
+}
+
+func TestSplitGeoExpressions(t *testing.T) {
+	near := geoDistance{Field: "place.location", Center: geoPoint{48.86, 2.35}, Radius: 1000, Sort: true}
+	box := geoBox{Field: "place.location", TopLeft: geoPoint{51.1, -5.1}, BottomRight: geoPoint{42.3, 8.2}}
+	title := schema.Equal{Field: "title", Value: "Paris"}
+	geo, rest, found := splitGeoExpressions(schema.Query{title, near, box})
+	assert.Equal(t, schema.Query{near, box}, geo)
+	assert.Equal(t, schema.Query{title}, rest)
+	if assert.NotNil(t, found) {
+		assert.Equal(t, near, *found)
+	}
+	geo, rest, found = splitGeoExpressions(schema.Query{title})
+	assert.Empty(t, geo)
+	assert.Equal(t, schema.Query{title}, rest)
+	assert.Nil(t, found)
+}
+
+func TestGeohash(t *testing.T) {
+	p := geoPoint{Lat: 57.64911, Lon: 10.40744}
+	assert.Equal(t, "u4pruydqqvj", geohash(p, 11))
+	center := geohashCenter("u4pruydqqvj")
+	assert.True(t, math.Abs(p.Lat-center.Lat) < 1e-5 && math.Abs(p.Lon-center.Lon) < 1e-5, "%v", center)
+	d := geoPoint{48.8566, 2.3522}.distance(geoPoint{45.7640, 4.8357})
+	assert.True(t, d > 389000 && d < 393000, "%f", d)
+}
+
+func TestParseSourceTime(t *testing.T) {
+	want := time.Date(2016, 3, 2, 14, 30, 0, 0, time.UTC)
+	for _, v := range []interface{}{
+		"2016-03-02T14:30:00Z",
+		"2016-03-02T16:30:00+02:00",
+		"Wed, 02 Mar 2016 14:30:00 GMT",
+		"Wed, 2 Mar 2016 15:30:00 +0100",
+		"2016-03-02 14:30:00",
+		"2016-03-02 14:30",
+		"March 2, 2016 14:30",
+		"2 Mar 2016 14:30",
+		"02/03/2016 14:30",
+		"02.03.2016 14:30",
+		"1456929000",
+		float64(1456929000),
+		float64(1456929000000),
+	} {
+		got, err := parseSourceTime(v, true)
+		if assert.NoError(t, err, "%v", v) {
+			assert.True(t, want.Equal(got), "%v: %s", v, got)
+		}
+	}
+	got, err := parseSourceTime("03/02/2016 14:30", false)
+	assert.NoError(t, err)
+	assert.True(t, want.Equal(got), "month first: %s", got)
+	got, err = parseSourceTime("13/02/2016", false)
+	assert.NoError(t, err)
+	assert.Equal(t, time.February, got.Month(), "a day over 12 can't be a month")
+	for _, v := range []interface{}{"yesterday", "31/02/2016", "2016-13-01", "NaN", true, nil} {
+		_, err := parseSourceTime(v, true)
+		assert.Error(t, err, "%v", v)
+	}
+
+	// The items read back from Elasticsearch hold their times as strings
+	now := time.Now()
+	created := now.Add(-time.Hour).Truncate(time.Second)
+	assert.Equal(t, rank(map[string]interface{}{"created": created}, now),
+		rank(map[string]interface{}{"created": created.Format(time.RFC3339)}, now), "ranks are decayed by age")
+}
+
+func TestSourceCreatedRanges(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	now := time.Now().UTC()
+	for title, created := range map[string]interface{}{
+		"hour":  now.Add(-time.Hour).Format(time.RFC1123Z),
+		"day":   float64(now.Add(-30 * time.Hour).Unix()),
+		"week":  now.Add(-6 * 24 * time.Hour).Format("02/01/2006 15:04"),
+		"older": "2 Jan 2006",
+	} {
+		create(t, ts, "/feed", "jack", map[string]interface{}{"title": title, "source_created": created})
+	}
+	titles := func(query string) []string {
+		status, b := call(t, ts, "GET", "/feed?sort=-source_created&"+query, jack, nil)
+		if !assert.Equal(t, http.StatusOK, status, string(b)) {
+			return nil
+		}
+		titles := []string{}
+		for _, item := range decodeList(t, b) {
+			titles = append(titles, item["title"].(string))
+		}
+		return titles
+	}
+
+	assert.Equal(t, []string{"hour", "day", "week", "older"}, titles(""), "sorted by time")
+	assert.Equal(t, []string{"hour"}, titles("since=24h"))
+	assert.Equal(t, []string{"hour", "day", "week"}, titles("since=1w"))
+	assert.Equal(t, []string{"day", "week"}, titles("between=7d,2h"))
+	assert.Equal(t, []string{"older"}, titles("between=,2006-01-02"), "end days are included")
+	assert.Equal(t, []string{"hour", "day", "week"}, titles("between=2010-01-01,"))
+	for _, query := range []string{"since=soon", "between=2h", "between=2h,7d", "between=someday,"} {
+		status, _ := call(t, ts, "GET", "/feed?"+query, jack, nil)
+		assert.Equal(t, 422, status, query)
+	}
+	status, _ := call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "bad", "source_created": "someday"})
+	assert.Equal(t, 422, status)
+}
+
+func TestFeedVerticals(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	create(t, ts, "/feed", "jack", map[string]interface{}{
+		"title":     "anvil",
+		"feed_type": "product",
+		"product":   map[string]interface{}{"name": "Anvil", "brand": "Acme", "price": 42.5},
+	})
+	create(t, ts, "/feed", "jack", map[string]interface{}{
+		"title":     "rocket",
+		"feed_type": "product",
+		"product":   map[string]interface{}{"name": "Rocket", "brand": "Ajax", "price": 900},
+	})
+	create(t, ts, "/feed", "jack", map[string]interface{}{
+		"title":     "heat",
+		"feed_type": "movie",
+		"movie":     map[string]interface{}{"title": "Heat", "year": 1995, "genres": []string{"crime"}},
+	})
+	create(t, ts, "/feed", "jack", map[string]interface{}{"title": "plain"})
+
+	status, b := call(t, ts, "GET", `/feed?filter={"product.brand":"Acme"}`, jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		list := decodeList(t, b)
+		if assert.Len(t, list, 1) {
+			assert.Equal(t, "anvil", list[0]["title"])
+		}
+	}
+	status, b = call(t, ts, "GET", `/feed?filter={"movie.year":{"$lt":2000}}`, jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		assert.Len(t, decodeList(t, b), 1)
+	}
+
+	for name, payload := range map[string]map[string]interface{}{
+		"missing vertical": {"feed_type": "movie"},
+		"other vertical":   {"feed_type": "movie", "movie": map[string]interface{}{"title": "Up"}, "book": map[string]interface{}{"title": "Up"}},
+		"untyped vertical": {"product": map[string]interface{}{"name": "Anvil"}},
+		"unknown type":     {"feed_type": "cheese"},
+		"invalid field":    {"feed_type": "movie", "movie": map[string]interface{}{"title": "Up", "rating": 11}},
+		"unknown field":    {"feed_type": "movie", "movie": map[string]interface{}{"title": "Up", "color": "red"}},
+		"required field":   {"feed_type": "movie", "movie": map[string]interface{}{"year": 2009}},
+	} {
+		status, b := call(t, ts, "POST", "/feed", jack, payload)
+		assert.Equal(t, 422, status, name+": "+string(b))
+	}
+
+	// Items stored before the check stay editable until their type changes
+	path := create(t, ts, "/feed", "jack", map[string]interface{}{"title": "legacy"})
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: path[len("/feed/"):]}})
+	storer := s.storers["feed"]
+	list, err := storer.Find(context.Background(), lookup, 1, 1)
+	if assert.NoError(t, err) && assert.Len(t, list.Items, 1) {
+		payload := map[string]interface{}{}
+		for k, v := range list.Items[0].Payload {
+			payload[k] = v
+		}
+		payload["feed_type"] = "movie"
+		item, err := resource.NewItem(payload)
+		if assert.NoError(t, err) {
+			assert.NoError(t, storer.Update(context.Background(), item, list.Items[0]))
+		}
+	}
+	status, b = call(t, ts, "PATCH", path, jack, map[string]interface{}{"title": "renamed"})
+	assert.Equal(t, http.StatusOK, status, string(b))
+	status, b = call(t, ts, "PATCH", path, jack, map[string]interface{}{"feed_type": "book"})
+	assert.Equal(t, 422, status, string(b))
+}
+
+func TestReactionsConcurrentAdds(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	path := create(t, ts, "/feed", "john", map[string]interface{}{"title": "Likeable"})
+
+	statuses := make(chan int, 10)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			status, _ := call(t, ts, "PUT", path+"/reactions/like", jack, nil)
+			statuses <- status
+		}()
+	}
+	created := 0
+	for i := 0; i < cap(statuses); i++ {
+		switch status := <-statuses; status {
+		case http.StatusCreated:
+			created++
+		default:
+			assert.Equal(t, http.StatusOK, status)
+		}
+	}
+	assert.Equal(t, 1, created)
+	_, b := call(t, ts, "GET", path, jack, nil)
+	assert.Equal(t, float64(1), decodeItem(t, b)["likes"])
+}
+
+func TestPropagation(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+	admin := tokenFor(t, "admin")
+
+	path := create(t, ts, "/categories", "jack", map[string]interface{}{"name": "Sport", "slug": "sport"})
+	id := path[len("/categories/"):]
+	status, b := call(t, ts, "GET", path, jack, nil)
+	if !assert.Equal(t, http.StatusOK, status, string(b)) {
+		return
+	}
+	copied := map[string]interface{}{"id": id, "name": "Sport"}
+	for _, res := range []string{"/feed", "/feed", "/news"} {
+		create(t, ts, res, "jack", map[string]interface{}{"title": "match", "category": copied})
+	}
+	create(t, ts, "/feed", "jack", map[string]interface{}{"title": "other", "category": map[string]interface{}{"id": "other", "name": "Other"}})
+
+	status, b = call(t, ts, "PATCH", path, jack, map[string]interface{}{"name": "Sports"})
+	if !assert.Equal(t, http.StatusOK, status, string(b)) {
+		return
+	}
+	status, _ = call(t, ts, "GET", "/propagations/report", jack, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, b = call(t, ts, "GET", "/propagations/report?resource=categories", admin, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		report := decodeItem(t, b)
+		assert.Equal(t, 3.0, report["stale"])
+		assert.Equal(t, 1.0, report["pending"])
+	}
+
+	s.propagator.Run(context.Background())
+	status, b = call(t, ts, "GET", "/propagations?filter={\"item\":\""+id+"\"}", admin, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		jobs := decodeList(t, b)
+		if assert.Len(t, jobs, 1) {
+			assert.Equal(t, "done", jobs[0]["status"])
+			assert.Equal(t, 3.0, jobs[0]["total"])
+			assert.Equal(t, map[string]interface{}{"channel": 0.0, "data": 0.0, "feed": 2.0, "news": 1.0, "photo": 0.0, "video": 0.0}, jobs[0]["copies"])
+		}
+	}
+	status, b = call(t, ts, "GET", "/feed?filter={\"title\":\"match\"}", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		for _, item := range decodeList(t, b) {
+			category := item["category"].(map[string]interface{})
+			assert.Equal(t, "Sports", category["name"])
+			assert.NotNil(t, category["updated"])
+			assert.Nil(t, category["slug"], "copies keep their fields")
+		}
+	}
+	status, b = call(t, ts, "GET", "/feed?filter={\"title\":\"other\"}", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		list := decodeList(t, b)
+		if assert.Len(t, list, 1) {
+			assert.Equal(t, "Other", list[0]["category"].(map[string]interface{})["name"])
+		}
+	}
+	status, b = call(t, ts, "GET", "/propagations/report", admin, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		report := decodeItem(t, b)
+		assert.Equal(t, 0.0, report["stale"])
+		assert.Equal(t, 0.0, report["pending"])
+		assert.Equal(t, []interface{}{}, report["items"])
+	}
+}
+
+func TestEvents(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	categoryPath := create(t, ts, "/categories", "jack", map[string]interface{}{"name": "Concerts", "slug": "concerts"})
+	category := categoryPath[len("/categories/"):]
+	now := time.Now().UTC()
+	upcoming := create(t, ts, "/events", "jack", map[string]interface{}{
+		"title":    "Jazz, live; at night",
+		"start":    now.Add(24 * time.Hour).Format(time.RFC3339),
+		"end":      now.Add(27 * time.Hour).Format(time.RFC3339),
+		"timezone": "Europe/Paris",
+		"venue": map[string]interface{}{
+			"name":     "New Morning",
+			"city":     "Paris",
+			"location": map[string]interface{}{"lat": 48.8728, "lon": 2.3534},
+		},
+		"organizer": map[string]interface{}{"name": "Jazz Club", "email": "club@example.com"},
+		"tickets":   []interface{}{map[string]interface{}{"url": "https://tickets.example.com/jazz", "price": 25}},
+		"category":  category,
+	})
+	past := create(t, ts, "/events", "jack", map[string]interface{}{
+		"title":    "Opening",
+		"start":    now.Add(-48 * time.Hour).Format(time.RFC3339),
+		"category": category,
+		"status":   "cancelled",
+	})
+	upcomingID, pastID := upcoming[len("/events/"):], past[len("/events/"):]
+
+	status, b := call(t, ts, "GET", past, jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		item := decodeItem(t, b)
+		assert.Equal(t, item["start"], item["end"], "end defaults to start")
+		assert.Equal(t, "UTC", item["timezone"])
+	}
+	ids := func(query string) []string {
+		status, b := call(t, ts, "GET", "/events?"+query, jack, nil)
+		if !assert.Equal(t, http.StatusOK, status, string(b)) {
+			return nil
+		}
+		ids := []string{}
+		for _, item := range decodeList(t, b) {
+			ids = append(ids, item["id"].(string))
+		}
+		return ids
+	}
+	assert.Equal(t, []string{upcomingID}, ids("when=upcoming"))
+	assert.Equal(t, []string{pastID}, ids("when=past"))
+	assert.Equal(t, []string{upcomingID}, ids("near=48.87,2.35&radius=1km"))
+	status, _ = call(t, ts, "GET", "/events?when=someday", jack, nil)
+	assert.Equal(t, 422, status)
+
+	for name, payload := range map[string]map[string]interface{}{
+		"end before start": {"title": "Bad", "start": now.Format(time.RFC3339), "end": now.Add(-time.Hour).Format(time.RFC3339)},
+		"unknown timezone": {"title": "Bad", "start": now.Format(time.RFC3339), "timezone": "Mars/Olympus"},
+		"unknown status":   {"title": "Bad", "start": now.Format(time.RFC3339), "status": "maybe"},
+	} {
+		status, b := call(t, ts, "POST", "/events", jack, payload)
+		assert.Equal(t, 422, status, name+": "+string(b))
+	}
+
+	// Feed items reference the events
+	create(t, ts, "/feed", "jack", map[string]interface{}{"title": "jazz", "feed_type": "event", "event": upcomingID})
+	status, _ = call(t, ts, "POST", "/feed", jack, map[string]interface{}{"title": "nowhere", "feed_type": "event", "event": "missing"})
+	assert.Equal(t, 422, status)
+
+	status, b = call(t, ts, "GET", categoryPath+"/events.ics", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		cal := string(b)
+		assert.True(t, strings.HasPrefix(cal, "BEGIN:VCALENDAR\r\n"))
+		assert.Contains(t, cal, "X-WR-CALNAME:Concerts\r\n")
+		assert.Contains(t, cal, "UID:"+upcomingID+"@events\r\n")
+		assert.Contains(t, cal, "DTSTART:"+now.Add(24*time.Hour).Format("20060102T150405Z")+"\r\n")
+		assert.Contains(t, cal, `SUMMARY:Jazz\, live\; at night`+"\r\n")
+		assert.Contains(t, cal, "LOCATION:New Morning\\, Paris\r\n")
+		assert.Contains(t, cal, "ORGANIZER;CN=\"Jazz Club\":mailto:club@example.com\r\n")
+		assert.Contains(t, cal, "URL:https://tickets.example.com/jazz\r\n")
+		assert.Contains(t, cal, "STATUS:CANCELLED\r\n")
+		assert.Equal(t, 2, strings.Count(cal, "BEGIN:VEVENT"))
+	}
+	status, _ = call(t, ts, "GET", categoryPath+"/events.ics", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestEventsWhen(t *testing.T) {
+	_, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	for _, when := range []string{"upcoming|past", "upcoming,past", "UPCOMING", "someday"} {
+		status, b := call(t, ts, "GET", "/events?when="+url.QueryEscape(when), jack, nil)
+		assert.Equal(t, 422, status, when+": "+string(b))
+	}
+	for _, when := range []string{"", "upcoming", "past"} {
+		status, b := call(t, ts, "GET", "/events?when="+when, jack, nil)
+		assert.Equal(t, http.StatusOK, status, when+": "+string(b))
+	}
+}
+
+func TestEventsCalendarLimit(t *testing.T) {
+	s, ts := newTestService(t)
+	defer ts.Close()
+	jack := tokenFor(t, "jack")
+
+	categoryPath := create(t, ts, "/categories", "jack", map[string]interface{}{"name": "Busy", "slug": "busy"})
+	category := categoryPath[len("/categories/"):]
+	now := time.Now().UTC().Truncate(time.Second)
+	items := []*resource.Item{}
+	add := func(id string, start time.Time) {
+		item, err := resource.NewItem(map[string]interface{}{
+			"id": id, "title": id, "category": category, "user": "jack",
+			"start": start, "end": start.Add(time.Hour), "timezone": "UTC",
+		})
+		if assert.NoError(t, err) {
+			items = append(items, item)
+		}
+	}
+	// Events ended long ago are left out, the latest upcoming ones past the limit
+	add("ancient", now.Add(-calendarWindow-2*time.Hour))
+	add("recent", now.Add(-calendarWindow+time.Hour))
+	for i := 0; i < calendarLimit; i++ {
+		add(fmt.Sprintf("upcoming-%04d", i), now.Add(time.Duration(i+1)*time.Hour))
+	}
+	assert.NoError(t, s.storers["events"].Insert(context.Background(), items))
+
+	status, b := call(t, ts, "GET", categoryPath+"/events.ics", jack, nil)
+	if assert.Equal(t, http.StatusOK, status, string(b)) {
+		cal := string(b)
+		assert.Equal(t, calendarLimit, strings.Count(cal, "BEGIN:VEVENT"))
+		assert.NotContains(t, cal, "UID:ancient@events\r\n")
+		assert.Contains(t, cal, "UID:recent@events\r\n")
+		assert.Contains(t, cal, fmt.Sprintf("UID:upcoming-%04d@events\r\n", calendarLimit-2))
+		assert.NotContains(t, cal, fmt.Sprintf("UID:upcoming-%04d@events\r\n", calendarLimit-1))
+	}
+}
+
+func TestICalendarFolding(t *testing.T) {
+	cal := &icalWriter{}
+	cal.line("DESCRIPTION", strings.Repeat("é", 60))
+	for _, line := range strings.Split(strings.TrimSuffix(cal.String(), "\r\n"), "\r\n") {
+		assert.True(t, len(line) <= 75, line)
+		assert.True(t, utf8.ValidString(strings.TrimPrefix(line, " ")), line)
+	}
+	assert.Equal(t, "DESCRIPTION:"+strings.Repeat("é", 60), strings.Replace(strings.TrimSuffix(cal.String(), "\r\n"), "\r\n ", "", -1))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/cool-rest/rest-layer-es"
+	"github.com/cool-rest/rest-layer-mem"
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+var storageBackend = flag.String("storage", "es", "Storage backend: es for Elasticsearch or mem for an in-memory store lost on exit")
+
+// storageFactory creates the storage handler of the resource stored as typ
+type storageFactory func(typ string) resource.Storer
+
+// openStorage connects the selected storage backend. The Elasticsearch
+// client is nil when the service does not run on Elasticsearch.
+func openStorage(backend string) (*elastic.Client, storageFactory, error) {
+	switch backend {
+	case "es":
+		client, err := connectElasticsearch()
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't connect to Elasticsearch DB: %s", err)
+		}
+		db := *esIndex
+		if err := putMappings(client, db); err != nil {
+			return nil, nil, fmt.Errorf("can't map the typed fields: %s", err)
+		}
+		return client, func(typ string) resource.Storer {
+			return newTracedStorer("elasticsearch", db, typ, newGeoStorer(client, db, typ, es.NewHandler(client, db, typ)))
+		}, nil
+	case "mem":
+		return nil, func(typ string) resource.Storer {
+			return newTracedStorer("memory", "", typ, newGeoStorer(nil, "", typ, mem.NewHandler()))
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// scanBatch is the number of items of the batches of scan
+const scanBatch = 500
+
+// scan calls fn with the items of storer matching query by batches ordered
+// by id, v validating the sort. It pages on the last ID seen rather than
+// with an offset, which Elasticsearch limits to the first 10000 results.
+func scan(ctx context.Context, storer resource.Storer, v schema.Validator, query schema.Query, fn func(items []*resource.Item) error) error {
+	var last interface{}
+	for {
+		lookup := resource.NewLookup()
+		if len(query) > 0 {
+			lookup.AddQuery(query)
+		}
+		if last != nil {
+			lookup.AddQuery(schema.Query{schema.GreaterThan{Field: "id", Value: last}})
+		}
+		if err := lookup.SetSort("id", v); err != nil {
+			return err
+		}
+		list, err := storer.Find(ctx, lookup, 1, scanBatch)
+		if err != nil {
+			return err
+		}
+		if len(list.Items) > 0 {
+			if err := fn(list.Items); err != nil {
+				return err
+			}
+			last = list.Items[len(list.Items)-1].ID
+		}
+		if len(list.Items) < scanBatch {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// esMappings returns the mappings of the fields which must not be mapped
+// dynamically, by type and field
+func esMappings() map[string]map[string]interface{} {
+	mappings := map[string]map[string]interface{}{}
+	set := func(typ, field string, mapping interface{}) {
+		if mappings[typ] == nil {
+			mappings[typ] = map[string]interface{}{}
+		}
+		mappings[typ][field] = mapping
+	}
+	for typ, field := range geoFields {
+		set(typ, field, map[string]interface{}{"type": "geo_point"})
+	}
+	for _, typ := range sourceTimeResources {
+		set(typ, "source_created", map[string]interface{}{"type": "date"})
+	}
+	return mappings
+}
+
+// putMappings maps the typed fields, creating the index if needed. It must
+// run before the items are indexed, a field can't be mapped once it has been
+// dynamically mapped with another type.
+func putMappings(client *elastic.Client, index string) error {
+	exists, err := client.IndexExists(index).Do()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := client.CreateIndex(index).Do(); err != nil {
+			return err
+		}
+	}
+	for typ, fields := range esMappings() {
+		for field, mapping := range fields {
+			names := strings.Split(field, ".")
+			for i := len(names) - 1; i >= 0; i-- {
+				mapping = map[string]interface{}{"properties": map[string]interface{}{names[i]: mapping}}
+			}
+			if _, err := client.PutMapping().Index(index).Type(typ).BodyJson(mapping.(map[string]interface{})).Do(); err != nil {
+				log.Printf("Can't map %s.%s, reindex %s to use it: %s", typ, field, typ, err)
+			}
+		}
+	}
+	return nil
+}
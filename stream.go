@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"golang.org/x/net/context"
+)
+
+var (
+	streamHistory   = flag.Int("stream-history", 1000, "Number of past events kept to resume streams from their Last-Event-ID")
+	streamBuffer    = flag.Int("stream-buffer", 64, "Number of events buffered per stream connection before disconnecting it as too slow")
+	streamHeartbeat = flag.Duration("stream-heartbeat", 15*time.Second, "Interval between two keep alive comments sent on idle streams")
+	streamTicketTTL = flag.Duration("stream-ticket-ttl", 30*time.Second, "How long the single use tickets opening a stream without an Authorization header stay valid")
+)
+
+// streamEvent is an item change pushed to the streams
+type streamEvent struct {
+	ID       uint64
+	Type     string
+	Resource string
+	Item     map[string]interface{}
+}
+
+// streamFilter selects the events of a stream from its query parameters.
+// Embedded channel, category and country copies match on their id, slug or
+// code.
+type streamFilter struct {
+	resources map[string]bool
+	channel   string
+	category  string
+	country   string
+	tag       string
+}
+
+func newStreamFilter(r *http.Request) streamFilter {
+	q := r.URL.Query()
+	f := streamFilter{
+		channel:  q.Get("channel"),
+		category: q.Get("category"),
+		country:  q.Get("country"),
+		tag:      q.Get("tag"),
+	}
+	if names, found := q["resource"]; found {
+		f.resources = map[string]bool{}
+		for _, name := range names {
+			f.resources[name] = true
+		}
+	}
+	return f
+}
+
+// Match tells if e passes the filter
+func (f streamFilter) Match(e streamEvent) bool {
+	if f.resources != nil && !f.resources[e.Resource] {
+		return false
+	}
+	if f.tag != "" {
+		if tags, _ := e.Item["tags"].([]interface{}); len(tags) == 0 || !contains(tags, f.tag) {
+			return false
+		}
+	}
+	return embeddedMatches(e.Item["channel"], f.channel) &&
+		embeddedMatches(e.Item["category"], f.category) &&
+		embeddedMatches(e.Item["country"], f.country)
+}
+
+// embeddedMatches tells if the v reference or embedded copy is want, an
+// empty want matching everything
+func embeddedMatches(v interface{}, want string) bool {
+	if want == "" {
+		return true
+	}
+	switch v := v.(type) {
+	case string:
+		return v == want
+	case map[string]interface{}:
+		for _, key := range []string{"id", "slug", "code"} {
+			if fmt.Sprint(v[key]) == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamSubscriber is a stream connection
+type streamSubscriber struct {
+	filter streamFilter
+	events chan streamEvent
+	// slow is closed when the subscriber is dropped for not keeping up
+	slow chan struct{}
+}
+
+// streamBroker pushes the inserted and updated items to the /stream
+// connections with Server-Sent Events. The last events are kept so clients
+// reconnecting with a Last-Event-ID header don't miss any. Event IDs are
+// local to the instance. Connections too slow to consume their events are
+// closed and expected to reconnect and resume.
+type streamBroker struct {
+	users     *resource.Resource
+	clock     clock
+	mu        sync.Mutex
+	seq       uint64
+	history   []streamEvent
+	size      int
+	buffer    int
+	heartbeat time.Duration
+	ticketTTL time.Duration
+	// tickets holds the expiry of the issued stream tickets
+	tickets map[string]time.Time
+	subs    map[*streamSubscriber]bool
+	done    chan struct{}
+	closed  bool
+}
+
+func newStreamBroker(users *resource.Resource, c clock, size, buffer int, heartbeat, ticketTTL time.Duration) *streamBroker {
+	return &streamBroker{
+		users:     users,
+		clock:     c,
+		size:      size,
+		buffer:    buffer,
+		heartbeat: heartbeat,
+		ticketTTL: ticketTTL,
+		tickets:   map[string]time.Time{},
+		subs:      map[*streamSubscriber]bool{},
+		done:      make(chan struct{}),
+	}
+}
+
+// Hook returns the hook publishing the changes of the name resource
+func (b *streamBroker) Hook(name string) streamHook {
+	return streamHook{broker: b, resource: name}
+}
+
+// Publish sends an event to the subscribers
+func (b *streamBroker) Publish(typ, res string, item *resource.Item) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e := streamEvent{ID: b.seq, Type: typ, Resource: res, Item: item.Payload}
+	b.history = append(b.history, e)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+	for sub := range b.subs {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.slow)
+		}
+	}
+}
+
+// subscribe registers a subscriber, returning the past events after lastID
+// it missed
+func (b *streamBroker) subscribe(filter streamFilter, lastID uint64, resume bool) (*streamSubscriber, []streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := &streamSubscriber{
+		filter: filter,
+		events: make(chan streamEvent, b.buffer),
+		slow:   make(chan struct{}),
+	}
+	b.subs[sub] = true
+	missed := []streamEvent{}
+	if resume {
+		for _, e := range b.history {
+			if e.ID > lastID && filter.Match(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	return sub, missed
+}
+
+func (b *streamBroker) unsubscribe(sub *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, sub)
+}
+
+// Close ends all the streams, on shutdown
+func (b *streamBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// Tickets serves POST /stream/tickets, issuing a ticket to open a stream
+// with GET /stream?ticket={ticket}. Browsers' EventSource can't set headers
+// and JWT tokens must not be put in URLs, which end up in the logs: tickets
+// can be used once, shortly after being issued.
+func (b *streamBroker) Tickets(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+	if _, found := UserFromToken(b.users, r.Context(), r); !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		writeError(w, http.StatusInternalServerError, "Can't issue a ticket")
+		return
+	}
+	ticket := hex.EncodeToString(buf)
+	now := b.clock.Now()
+	expires := now.Add(b.ticketTTL)
+	b.mu.Lock()
+	for t, e := range b.tickets {
+		if !now.Before(e) {
+			delete(b.tickets, t)
+		}
+	}
+	b.tickets[ticket] = expires
+	b.mu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"ticket":  ticket,
+		"expires": expires,
+	})
+}
+
+// redeem consumes a ticket and tells if it was valid
+func (b *streamBroker) redeem(ticket string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expires, found := b.tickets[ticket]
+	delete(b.tickets, ticket)
+	return found && b.clock.Now().Before(expires)
+}
+
+// ServeHTTP serves GET /stream. The JWT token is read from the
+// Authorization header or, for browsers, a ticket issued by
+// POST /stream/tickets is given in the ticket query parameter.
+func (b *streamBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	authorized := false
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		authorized = b.redeem(ticket)
+	} else {
+		_, authorized = UserFromToken(b.users, r.Context(), r)
+	}
+	if !authorized {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	rc := http.NewResponseController(w)
+	// Streams outlive the server write timeout
+	rc.SetWriteDeadline(time.Time{})
+
+	lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub, missed := b.subscribe(newStreamFilter(r), lastID, err == nil)
+	defer b.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		if err := writeStreamEvent(w, e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		log.Printf("Can't stream: %s", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(b.heartbeat)
+	defer heartbeat.Stop()
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.done:
+			return
+		case <-sub.slow:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e := <-sub.events:
+			if err := writeStreamEvent(w, e); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes e in the Server-Sent Events format
+func writeStreamEvent(w http.ResponseWriter, e streamEvent) error {
+	data, err := json.Marshal(map[string]interface{}{"resource": e.Resource, "item": e.Item})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// streamHook publishes the changes of a resource to the streams
+type streamHook struct {
+	broker   *streamBroker
+	resource string
+}
+
+// OnInserted implements resource.InsertedEventHandler interface
+func (h streamHook) OnInserted(ctx context.Context, r *http.Request, items []*resource.Item, err *error) {
+	if *err != nil {
+		return
+	}
+	for _, item := range items {
+		h.broker.Publish("insert", h.resource, item)
+	}
+}
+
+// OnUpdated implements resource.UpdatedEventHandler interface
+func (h streamHook) OnUpdated(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item, err *error) {
+	if *err == nil {
+		h.broker.Publish("update", h.resource, item)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	personalFeedWindow      = flag.Duration("me-feed-window", 7*24*time.Hour, "How far back /me/feed looks for items")
+	personalFeedCandidates  = flag.Int("me-feed-candidates", 200, "Maximum number of most recent items per resource ranked by /me/feed")
+	personalFeedSnapshotTTL = flag.Duration("me-feed-snapshot-ttl", 10*time.Minute, "How long the ranking of a /me/feed first page is kept for its next pages")
+)
+
+// subscription is something a user follows
+var subscription = schema.Schema{
+	Fields: schema.Fields{
+		"id":      schema.IDField,
+		"created": schema.CreatedField,
+		// user is the follower, set by the OwnerResourceHook
+		"user": {
+			Filterable: true,
+			Validator: &schema.Reference{
+				Path: "users",
+			},
+		},
+		"kind": {
+			Required:   true,
+			Filterable: true,
+			Validator: &schema.String{
+				Allowed: []string{"channel", "category", "topic", "tag"},
+			},
+		},
+		// value is the id or slug of the followed channel or category, or the
+		// followed topic or tag
+		"value": {
+			Required:   true,
+			Filterable: true,
+			Validator:  &schema.String{},
+		},
+	},
+}
+
+// personalFeed serves /me/feed, the recent items of the resources matching
+// the user subscriptions
+type personalFeed struct {
+	users         *resource.Resource
+	subscriptions *resource.Resource
+	resources     []*resource.Resource
+	// statuses holds the status of the visible items of the resources
+	// following the workflow
+	statuses   map[string]string
+	window     time.Duration
+	candidates int
+	snapshots  *feedSnapshots
+	clock      clock
+}
+
+// feedCursor anchors the pages of a personal feed at the time of its first
+// page so items arriving meanwhile don't shift the next pages, and continues
+// after the last entry of the previous page
+type feedCursor struct {
+	until time.Time
+	score float64
+	id    string
+}
+
+func (c feedCursor) String() string {
+	s := fmt.Sprintf("%d.%s.%s", c.until.UnixNano(), strconv.FormatFloat(c.score, 'g', -1, 64), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseFeedCursor(s string) (feedCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return feedCursor{}, err
+	}
+	parts := strings.SplitN(string(b), ".", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return feedCursor{}, fmt.Errorf("malformed cursor")
+	}
+	until, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return feedCursor{}, err
+	}
+	score, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return feedCursor{}, err
+	}
+	return feedCursor{until: time.Unix(0, until), score: score, id: parts[2]}, nil
+}
+
+// after tells if e is ranked after the last entry of the previous page
+func (c feedCursor) after(e feedEntry) bool {
+	return e.score < c.score || e.score == c.score && e.id() > c.id
+}
+
+// feedEntry is an item of a personal feed
+type feedEntry struct {
+	resource string
+	item     *resource.Item
+	score    float64
+}
+
+func (e feedEntry) id() string {
+	return fmt.Sprint(e.item.ID)
+}
+
+// feedSnapshots keeps the ranking of the first pages of the personal feeds so
+// the counters changing meanwhile don't reorder the next pages. Without a
+// snapshot, on another instance or once expired, the next pages are ranked
+// again and continue after the cursor.
+type feedSnapshots struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]feedSnapshot
+}
+
+type feedSnapshot struct {
+	entries []feedEntry
+	expires time.Time
+}
+
+func newFeedSnapshots(ttl time.Duration) *feedSnapshots {
+	return &feedSnapshots{ttl: ttl, entries: map[string]feedSnapshot{}}
+}
+
+func (s *feedSnapshots) get(key string, now time.Time) ([]feedEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap, found := s.entries[key]
+	if !found || !now.Before(snap.expires) {
+		return nil, false
+	}
+	return snap.entries, true
+}
+
+func (s *feedSnapshots) put(key string, entries []feedEntry, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, snap := range s.entries {
+		if !now.Before(snap.expires) {
+			delete(s.entries, k)
+		}
+	}
+	// Only the ranking is kept, the items are loaded again for each page
+	ranked := make([]feedEntry, len(entries))
+	for i, e := range entries {
+		ranked[i] = feedEntry{resource: e.resource, item: &resource.Item{ID: e.item.ID}, score: e.score}
+	}
+	s.entries[key] = feedSnapshot{entries: ranked, expires: now.Add(s.ttl)}
+}
+
+// popularity sums the engagement counters of an item
+func popularity(payload map[string]interface{}) int {
+	return intValue(payload["likes"]) + 2*intValue(payload["shares"]) + intValue(payload["comments"]) +
+		intValue(payload["points"]) + intValue(payload["views"])/10
+}
+
+// rank scores an item by popularity, decayed by its age at until
+func rank(payload map[string]interface{}, until time.Time) float64 {
+	age := 0.0
+	if created, err := parseSourceTime(payload["created"], true); err == nil {
+		age = until.Sub(created).Hours()
+	}
+	return float64(1+popularity(payload)) / math.Pow(math.Max(age, 0)+2, 1.5)
+}
+
+// subscriptionQuery returns the query matching the items followed by the
+// subscriptions, nil if none
+func subscriptionQuery(subs []*resource.Item) schema.Expression {
+	values := map[string][]schema.Value{}
+	for _, sub := range subs {
+		kind, _ := sub.Payload["kind"].(string)
+		values[kind] = append(values[kind], sub.Payload["value"])
+	}
+	or := schema.Or{}
+	for kind, fields := range map[string][]string{
+		"channel":  {"channel.id", "channel.slug"},
+		"category": {"category.id", "category.slug"},
+		"topic":    {"topics"},
+		"tag":      {"tags"},
+	} {
+		if len(values[kind]) == 0 {
+			continue
+		}
+		for _, field := range fields {
+			or = append(or, schema.In{Field: field, Values: values[kind]})
+		}
+	}
+	if len(or) == 0 {
+		return nil
+	}
+	return or
+}
+
+// ServeHTTP serves GET /me/feed. Pages are requested with the cursor given
+// in the Link header of the previous one.
+func (f *personalFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	user, found := UserFromToken(f.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	now := f.clock.Now()
+	cursor := feedCursor{until: now}
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		var err error
+		if cursor, err = parseFeedCursor(c); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+	}
+	_, limit := pagination(r, 20)
+
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	key := fmt.Sprintf("%v.%d", user.ID, cursor.until.UnixNano())
+	entries, found := f.snapshots.get(key, now)
+	if !found {
+		var err error
+		if entries, err = f.entries(ctx, user, cursor.until); err != nil {
+			writeResourceError(w, err)
+			return
+		}
+		f.snapshots.put(key, entries, now)
+	}
+	start := 0
+	if cursor.id != "" {
+		for start < len(entries) && !cursor.after(entries[start]) {
+			start++
+		}
+	}
+	end := start + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	items, err := f.load(ctx, entries[start:end])
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	page := []map[string]interface{}{}
+	for _, e := range entries[start:end] {
+		if item, found := items[e.resource+"/"+e.id()]; found {
+			page = append(page, map[string]interface{}{
+				"resource": e.resource,
+				"item":     item.Payload,
+			})
+		}
+	}
+	if end < len(entries) {
+		last := entries[end-1]
+		next := feedCursor{until: cursor.until, score: last.score, id: last.id()}
+		w.Header().Set("Link", fmt.Sprintf(`</me/feed?cursor=%s&limit=%d>; rel="next"`, next, limit))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// load returns the current version of the items of entries still visible,
+// by resource and id
+func (f *personalFeed) load(ctx context.Context, entries []feedEntry) (map[string]*resource.Item, error) {
+	ids := map[string][]schema.Value{}
+	for _, e := range entries {
+		ids[e.resource] = append(ids[e.resource], e.item.ID)
+	}
+	items := map[string]*resource.Item{}
+	for _, res := range f.resources {
+		if len(ids[res.Name()]) == 0 {
+			continue
+		}
+		q := schema.Query{schema.In{Field: "id", Values: ids[res.Name()]}}
+		if status, found := f.statuses[res.Name()]; found {
+			q = append(q, schema.Equal{Field: "status", Value: status})
+		}
+		lookup := resource.NewLookup()
+		lookup.AddQuery(q)
+		list, err := res.Find(ctx, nil, lookup, 1, len(ids[res.Name()]))
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			items[res.Name()+"/"+fmt.Sprint(item.ID)] = item
+		}
+	}
+	return items, nil
+}
+
+// entries returns the ranked items followed by user, created before until
+func (f *personalFeed) entries(ctx context.Context, user *resource.Item, until time.Time) ([]feedEntry, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "user", Value: user.ID}})
+	subs, err := f.subscriptions.Find(ctx, nil, lookup, 1, 1000)
+	if err != nil {
+		return nil, err
+	}
+	followed := subscriptionQuery(subs.Items)
+	if followed == nil {
+		return []feedEntry{}, nil
+	}
+	entries := []feedEntry{}
+	for _, res := range f.resources {
+		q := schema.Query{
+			followed,
+			schema.LowerOrEqual{Field: "created", Value: until},
+			schema.GreaterThan{Field: "created", Value: until.Add(-f.window)},
+		}
+		if status, found := f.statuses[res.Name()]; found {
+			q = append(q, schema.Equal{Field: "status", Value: status})
+		}
+		lookup := resource.NewLookup()
+		lookup.AddQuery(q)
+		if err := lookup.SetSort("-created", res.Validator()); err != nil {
+			return nil, err
+		}
+		list, err := res.Find(ctx, nil, lookup, 1, f.candidates)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			entries = append(entries, feedEntry{resource: res.Name(), item: item, score: rank(item.Payload, until)})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].score != entries[j].score {
+			return entries[i].score > entries[j].score
+		}
+		return entries[i].id() < entries[j].id()
+	})
+	return entries, nil
+}
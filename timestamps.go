@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var sourceDateOrder = flag.String("source-date-order", "dmy", "Order of the ambiguous numeric source dates like 02/03/2016: dmy or mdy")
+
+// sourceTimeResources are the resources whose items have a source_created
+// time
+var sourceTimeResources = []string{"feed", "news", "photo", "video"}
+
+// sourceTimeLayouts are the layouts of the source dates with a month name or
+// in an unambiguous order, tried in turn. Dates without time zone are UTC.
+var sourceTimeLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.RFC822Z,
+	time.RFC822,
+	time.RubyDate,
+	time.UnixDate,
+	time.ANSIC,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	"January 2, 2006 15:04",
+	"January 2, 2006",
+	"Jan 2, 2006 15:04",
+	"Jan 2, 2006",
+	"2 January 2006 15:04",
+	"2 January 2006",
+	"2 Jan 2006 15:04",
+	"2 Jan 2006",
+}
+
+// numericDate matches the localized numeric dates like 02/03/2016 or
+// 02.03.2016 14:30
+var numericDate = regexp.MustCompile(`^(\d{1,2})[/.-](\d{1,2})[/.-](\d{4})(?:[ T](\d{1,2}):(\d{2})(?::(\d{2}))?)?$`)
+
+// epoch matches the Unix epochs sent as strings
+var epoch = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+
+var errInvalidSourceTime = errors.New("not a supported date")
+
+// parseSourceTime normalizes a date sent by a source to UTC. It takes the
+// layouts of sourceTimeLayouts, the numeric dates in dayFirst order unless
+// a part is over 12, and the Unix epochs in seconds or milliseconds.
+func parseSourceTime(v interface{}, dayFirst bool) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v.UTC(), nil
+	case float64:
+		return epochTime(v), nil
+	case int:
+		return epochTime(float64(v)), nil
+	case int64:
+		return epochTime(float64(v)), nil
+	case string:
+		s := strings.TrimSpace(v)
+		if epoch.MatchString(s) {
+			f, _ := strconv.ParseFloat(s, 64)
+			return epochTime(f), nil
+		}
+		for _, layout := range sourceTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		if m := numericDate.FindStringSubmatch(s); m != nil {
+			n := make([]int, len(m))
+			for i := 1; i < len(m); i++ {
+				n[i], _ = strconv.Atoi(m[i])
+			}
+			day, month := n[1], n[2]
+			if day <= 12 && (month > 12 || !dayFirst) {
+				day, month = month, day
+			}
+			t := time.Date(n[3], time.Month(month), day, n[4], n[5], n[6], 0, time.UTC)
+			// time.Date normalizes the overflows, like February 30
+			if t.Day() == day && int(t.Month()) == month && t.Hour() == n[4] && t.Minute() == n[5] && t.Second() == n[6] {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, errInvalidSourceTime
+}
+
+// epochTime returns the time of a Unix epoch in seconds, or milliseconds if
+// it would be after year 5000 in seconds
+func epochTime(epoch float64) time.Time {
+	if math.Abs(epoch) > 1e11 {
+		epoch /= 1000
+	}
+	sec, frac := math.Modf(epoch)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// sourceTime validates the dates sent by the sources, normalizing them to
+// time.Time
+type sourceTime struct{}
+
+// Validate implements schema.FieldValidator interface
+func (v sourceTime) Validate(value interface{}) (interface{}, error) {
+	t, err := parseSourceTime(value, *sourceDateOrder != "mdy")
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// sourceCreatedField is the time an item was created at its source
+var sourceCreatedField = schema.Field{
+	Filterable: true,
+	Sortable:   true,
+	Validator:  sourceTime{},
+}
+
+// parseAge parses a relative duration of the since filter like 90m, 24h,
+// 7d or 2w
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// timeRangeHook filters the listings of a resource on a time field with the
+// since and between query parameters:
+//
+//	since=24h lists the items of the last 24 hours, also in d and w
+//	between=start,end lists the items from start to end included, given as
+//	source dates or durations ago; a missing bound leaves the range open and
+//	an end day is included
+type timeRangeHook struct {
+	field string
+	clock clock
+}
+
+// OnFind implements resource.FindEventHandler interface
+func (h timeRangeHook) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	if r == nil || isSystemContext(ctx) {
+		return nil
+	}
+	q, err := h.query(r.URL.Query().Get("since"), r.URL.Query().Get("between"))
+	if err != nil {
+		return &resource.Error{Code: 422, Message: err.Error()}
+	}
+	if len(q) > 0 {
+		lookup.AddQuery(q)
+	}
+	return nil
+}
+
+func (h timeRangeHook) query(since, between string) (schema.Query, error) {
+	now := h.clock.Now().UTC()
+	q := schema.Query{}
+	if since != "" {
+		age, err := parseAge(since)
+		if err != nil {
+			return nil, fmt.Errorf("since: %s", err)
+		}
+		q = append(q, schema.GreaterOrEqual{Field: h.field, Value: now.Add(-age)})
+	}
+	if between != "" {
+		bounds := strings.Split(between, ",")
+		if len(bounds) != 2 {
+			return nil, errors.New("between: expected start,end")
+		}
+		var times [2]time.Time
+		for i, bound := range bounds {
+			bound = strings.TrimSpace(bound)
+			if bound == "" {
+				continue
+			}
+			if age, err := parseAge(bound); err == nil {
+				times[i] = now.Add(-age)
+				continue
+			}
+			t, err := parseSourceTime(bound, *sourceDateOrder != "mdy")
+			if err != nil {
+				return nil, fmt.Errorf("between: %q is %s", bound, err)
+			}
+			// A day ends the range at its end
+			if i == 1 && !strings.Contains(bound, ":") && t.Equal(t.Truncate(24*time.Hour)) && !epoch.MatchString(bound) {
+				t = t.Add(24*time.Hour - time.Nanosecond)
+			}
+			times[i] = t
+		}
+		if !times[0].IsZero() {
+			q = append(q, schema.GreaterOrEqual{Field: h.field, Value: times[0]})
+		}
+		if !times[1].IsZero() {
+			q = append(q, schema.LowerOrEqual{Field: h.field, Value: times[1]})
+		}
+		if !times[0].IsZero() && !times[1].IsZero() && times[1].Before(times[0]) {
+			return nil, errors.New("between: end before start")
+		}
+	}
+	return q, nil
+}
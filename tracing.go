@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/xlog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+const serviceName = "news-search-service"
+
+var (
+	traceExporter     = flag.String("trace-exporter", "none", "Trace exporter: none, stdout or otlp")
+	traceOTLPEndpoint = flag.String("trace-otlp-endpoint", "localhost:4318", "OTLP/HTTP collector endpoint used by the otlp trace exporter")
+	traceOTLPInsecure = flag.Bool("trace-otlp-insecure", true, "Send OTLP traces over plain HTTP")
+	traceSampleRatio  = flag.Float64("trace-sample-ratio", 1, "Fraction of root traces to sample")
+)
+
+// tracer is used for every span started by the service. It goes through the
+// global provider so spans are no-ops until initTracing installs an exporter.
+var tracer = otel.Tracer(serviceName)
+
+// initTracing installs the global tracer provider selected by -trace-exporter
+// along with the W3C trace-context and baggage propagators. The returned
+// function flushes pending spans and must be called before exiting.
+func initTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch *traceExporter {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*traceOTLPEndpoint)}
+		if *traceOTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", *traceExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*traceSampleRatio))),
+		sdktrace.WithResource(sdkresource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// NewTraceHandler starts a server span for each request, continuing the trace
+// propagated by the caller in the traceparent header if present
+func NewTraceHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return otelhttp.NewHandler(next, "http.request")
+	}
+}
+
+// NewTraceCorrelationHandler ties the current trace with the request id set
+// by xlog.RequestIDHandler so logs and traces can be joined both ways
+func NewTraceCorrelationHandler(field string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			span := trace.SpanFromContext(ctx)
+			if id, ok := xlog.IDFromContext(ctx); ok {
+				span.SetAttributes(attribute.String(field, id.String()))
+			}
+			if sc := span.SpanContext(); sc.IsValid() {
+				xlog.FromContext(ctx).SetField("trace_id", sc.TraceID().String())
+				w.Header().Set("Trace-Id", sc.TraceID().String())
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// traceMiddleware wraps the middleware m so the time spent in it, until it
+// hands the request over to the next handler, is recorded as a span
+func traceMiddleware(name string, m func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parent := trace.SpanFromContext(r.Context())
+			ctx, span := tracer.Start(r.Context(), "middleware."+name)
+			ended := false
+			h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				span.End()
+				ended = true
+				// Continue the chain under the parent span, not the middleware one
+				next.ServeHTTP(w, r.WithContext(trace.ContextWithSpan(r.Context(), parent)))
+			}))
+			h.ServeHTTP(w, r.WithContext(ctx))
+			if !ended {
+				span.End()
+			}
+		})
+	}
+}
+
+// tracedStorer records every storage call as a client span
+type tracedStorer struct {
+	resource.Storer
+	system string
+	db     string
+	typ    string
+}
+
+// newTracedStorer wraps s so calls to the db/typ type of the system storage
+// backend are traced
+func newTracedStorer(system, db, typ string, s resource.Storer) resource.Storer {
+	return tracedStorer{Storer: s, system: system, db: db, typ: typ}
+}
+
+func (s tracedStorer) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, s.system+"."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", s.system),
+			attribute.String("db.name", s.db),
+			attribute.String("db.operation", op),
+			attribute.String("db.type", s.typ),
+		))
+}
+
+// Find implements resource.Storer interface
+func (s tracedStorer) Find(ctx context.Context, lookup *resource.Lookup, page, perPage int) (list *resource.ItemList, err error) {
+	ctx, span := s.start(ctx, "find")
+	defer func() { endSpan(span, err) }()
+	return s.Storer.Find(ctx, lookup, page, perPage)
+}
+
+// Insert implements resource.Storer interface
+func (s tracedStorer) Insert(ctx context.Context, items []*resource.Item) (err error) {
+	ctx, span := s.start(ctx, "insert")
+	span.SetAttributes(attribute.Int("db.items", len(items)))
+	defer func() { endSpan(span, err) }()
+	return s.Storer.Insert(ctx, items)
+}
+
+// Update implements resource.Storer interface
+func (s tracedStorer) Update(ctx context.Context, item *resource.Item, original *resource.Item) (err error) {
+	ctx, span := s.start(ctx, "update")
+	defer func() { endSpan(span, err) }()
+	return s.Storer.Update(ctx, item, original)
+}
+
+// Delete implements resource.Storer interface
+func (s tracedStorer) Delete(ctx context.Context, item *resource.Item) (err error) {
+	ctx, span := s.start(ctx, "delete")
+	defer func() { endSpan(span, err) }()
+	return s.Storer.Delete(ctx, item)
+}
+
+// Clear implements resource.Storer interface
+func (s tracedStorer) Clear(ctx context.Context, lookup *resource.Lookup) (deleted int, err error) {
+	ctx, span := s.start(ctx, "clear")
+	defer func() { endSpan(span, err) }()
+	return s.Storer.Clear(ctx, lookup)
+}
+
+// GeoGrid implements geoGridder interface when the traced storer does
+func (s tracedStorer) GeoGrid(ctx context.Context, lookup *resource.Lookup, field string, precision int) (cells []geoCell, err error) {
+	gridder, ok := s.Storer.(geoGridder)
+	if !ok {
+		return nil, errors.New("geo grid not supported")
+	}
+	ctx, span := s.start(ctx, "geogrid")
+	defer func() { endSpan(span, err) }()
+	return gridder.GeoGrid(ctx, lookup, field, precision)
+}
+
+// UpdateCopies implements copyUpdater interface when the traced storer does
+func (s tracedStorer) UpdateCopies(ctx context.Context, field string, source map[string]interface{}, rate, batch int) (updated int, err error) {
+	updater, ok := s.Storer.(copyUpdater)
+	if !ok {
+		return 0, errors.New("copy updates not supported")
+	}
+	ctx, span := s.start(ctx, "updatecopies")
+	defer func() { endSpan(span, err) }()
+	return updater.UpdateCopies(ctx, field, source, rate, batch)
+}
+
+// tracedHook wraps a resource event handler so each of its hooks is recorded
+// as a span. Hooks the wrapped handler does not implement are no-ops.
+type tracedHook struct {
+	name string
+	hook interface{}
+}
+
+// traceHook wraps hook so its calls are traced under the given name
+func traceHook(name string, hook interface{}) tracedHook {
+	return tracedHook{name: name, hook: hook}
+}
+
+func (h tracedHook) start(ctx context.Context, r *http.Request, event string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, h.name+"."+event)
+	if r != nil {
+		span.SetAttributes(attribute.String("http.route", r.URL.Path))
+	}
+	return ctx, span
+}
+
+// OnFind implements resource.FindEventHandler interface
+func (h tracedHook) OnFind(ctx context.Context, r *http.Request, lookup *resource.Lookup, page, perPage int) error {
+	hook, ok := h.hook.(resource.FindEventHandler)
+	if !ok {
+		return nil
+	}
+	ctx, span := h.start(ctx, r, "OnFind")
+	err := hook.OnFind(ctx, r, lookup, page, perPage)
+	endSpan(span, err)
+	return err
+}
+
+// OnFound implements resource.FoundEventHandler interface
+func (h tracedHook) OnFound(ctx context.Context, r *http.Request, lookup *resource.Lookup, list **resource.ItemList, err *error) {
+	hook, ok := h.hook.(resource.FoundEventHandler)
+	if !ok {
+		return
+	}
+	ctx, span := h.start(ctx, r, "OnFound")
+	hook.OnFound(ctx, r, lookup, list, err)
+	endSpan(span, *err)
+}
+
+// OnGet implements resource.GetEventHandler interface
+func (h tracedHook) OnGet(ctx context.Context, r *http.Request, id interface{}) error {
+	hook, ok := h.hook.(resource.GetEventHandler)
+	if !ok {
+		return nil
+	}
+	ctx, span := h.start(ctx, r, "OnGet")
+	err := hook.OnGet(ctx, r, id)
+	endSpan(span, err)
+	return err
+}
+
+// OnGot implements resource.GotEventHandler interface
+func (h tracedHook) OnGot(ctx context.Context, r *http.Request, item **resource.Item, err *error) {
+	hook, ok := h.hook.(resource.GotEventHandler)
+	if !ok {
+		return
+	}
+	ctx, span := h.start(ctx, r, "OnGot")
+	hook.OnGot(ctx, r, item, err)
+	endSpan(span, *err)
+}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (h tracedHook) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	hook, ok := h.hook.(resource.InsertEventHandler)
+	if !ok {
+		return nil
+	}
+	ctx, span := h.start(ctx, r, "OnInsert")
+	err := hook.OnInsert(ctx, r, items)
+	endSpan(span, err)
+	return err
+}
+
+// OnInserted implements resource.InsertedEventHandler interface
+func (h tracedHook) OnInserted(ctx context.Context, r *http.Request, items []*resource.Item, err *error) {
+	hook, ok := h.hook.(resource.InsertedEventHandler)
+	if !ok {
+		return
+	}
+	ctx, span := h.start(ctx, r, "OnInserted")
+	hook.OnInserted(ctx, r, items, err)
+	endSpan(span, *err)
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (h tracedHook) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	hook, ok := h.hook.(resource.UpdateEventHandler)
+	if !ok {
+		return nil
+	}
+	ctx, span := h.start(ctx, r, "OnUpdate")
+	err := hook.OnUpdate(ctx, r, item, original)
+	endSpan(span, err)
+	return err
+}
+
+// OnUpdated implements resource.UpdatedEventHandler interface
+func (h tracedHook) OnUpdated(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item, err *error) {
+	hook, ok := h.hook.(resource.UpdatedEventHandler)
+	if !ok {
+		return
+	}
+	ctx, span := h.start(ctx, r, "OnUpdated")
+	hook.OnUpdated(ctx, r, item, original, err)
+	endSpan(span, *err)
+}
+
+// OnDelete implements resource.DeleteEventHandler interface
+func (h tracedHook) OnDelete(ctx context.Context, r *http.Request, item *resource.Item) error {
+	hook, ok := h.hook.(resource.DeleteEventHandler)
+	if !ok {
+		return nil
+	}
+	ctx, span := h.start(ctx, r, "OnDelete")
+	err := hook.OnDelete(ctx, r, item)
+	endSpan(span, err)
+	return err
+}
+
+// OnDeleted implements resource.DeletedEventHandler interface
+func (h tracedHook) OnDeleted(ctx context.Context, r *http.Request, item *resource.Item, err *error) {
+	hook, ok := h.hook.(resource.DeletedEventHandler)
+	if !ok {
+		return
+	}
+	ctx, span := h.start(ctx, r, "OnDeleted")
+	hook.OnDeleted(ctx, r, item, err)
+	endSpan(span, *err)
+}
+
+// OnClear implements resource.ClearEventHandler interface
+func (h tracedHook) OnClear(ctx context.Context, r *http.Request, lookup *resource.Lookup) error {
+	hook, ok := h.hook.(resource.ClearEventHandler)
+	if !ok {
+		return nil
+	}
+	ctx, span := h.start(ctx, r, "OnClear")
+	err := hook.OnClear(ctx, r, lookup)
+	endSpan(span, err)
+	return err
+}
+
+// OnCleared implements resource.ClearedEventHandler interface
+func (h tracedHook) OnCleared(ctx context.Context, r *http.Request, lookup *resource.Lookup, deleted *int, err *error) {
+	hook, ok := h.hook.(resource.ClearedEventHandler)
+	if !ok {
+		return
+	}
+	ctx, span := h.start(ctx, r, "OnCleared")
+	hook.OnCleared(ctx, r, lookup, deleted, err)
+	endSpan(span, *err)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	trashRetention     = flag.Duration("trash-retention", 30*24*time.Hour, "How long deleted content stays in the trash before being purged")
+	trashPurgeInterval = flag.Duration("trash-purge-interval", time.Hour, "Interval between two trash purges")
+)
+
+// softDeleteFields are the fields set on items moved to the trash
+var softDeleteFields = schema.Fields{
+	"deleted_at": {
+		ReadOnly:   true,
+		Filterable: true,
+		Sortable:   true,
+		Validator:  &schema.Time{},
+	},
+	"deleted_by": {
+		ReadOnly:   true,
+		Filterable: true,
+		Validator:  &schema.String{},
+	},
+}
+
+// extendSchema returns a copy of s with fields added
+func extendSchema(s schema.Schema, fields schema.Fields) schema.Schema {
+	f := schema.Fields{}
+	for name, def := range s.Fields {
+		f[name] = def
+	}
+	for name, def := range fields {
+		f[name] = def
+	}
+	s.Fields = f
+	return s
+}
+
+// trashMode selects which items a softDeleteStorer lookup sees
+type trashMode int
+
+const (
+	// trashHidden hides deleted items, the default
+	trashHidden trashMode = iota
+	// trashOnly only shows deleted items
+	trashOnly
+)
+
+// withTrashMode returns a context where soft deleted lookups use mode
+func withTrashMode(ctx context.Context, mode trashMode) context.Context {
+	return context.WithValue(ctx, trashModeKey, mode)
+}
+
+// softDeleteStorer moves deleted items to the trash by marking them with
+// deleted_at and deleted_by instead of removing them, and hides them from
+// lookups unless asked otherwise with withTrashMode
+type softDeleteStorer struct {
+	resource.Storer
+	clock clock
+}
+
+// Find implements resource.Storer interface
+func (s softDeleteStorer) Find(ctx context.Context, lookup *resource.Lookup, page, perPage int) (*resource.ItemList, error) {
+	mode, _ := ctx.Value(trashModeKey).(trashMode)
+	if mode == trashOnly {
+		lookup.AddQuery(schema.Query{schema.Exist{Field: "deleted_at"}})
+	} else {
+		lookup.AddQuery(schema.Query{schema.NotExist{Field: "deleted_at"}})
+	}
+	return s.Storer.Find(ctx, lookup, page, perPage)
+}
+
+// GeoGrid implements geoGridder interface, leaving out the deleted items
+func (s softDeleteStorer) GeoGrid(ctx context.Context, lookup *resource.Lookup, field string, precision int) ([]geoCell, error) {
+	gridder, ok := s.Storer.(geoGridder)
+	if !ok {
+		return nil, errors.New("geo grid not supported")
+	}
+	lookup.AddQuery(schema.Query{schema.NotExist{Field: "deleted_at"}})
+	return gridder.GeoGrid(ctx, lookup, field, precision)
+}
+
+// UpdateCopies implements copyUpdater interface, refreshing the copies held
+// by the deleted items too for them to be up to date once restored
+func (s softDeleteStorer) UpdateCopies(ctx context.Context, field string, source map[string]interface{}, rate, batch int) (int, error) {
+	updater, ok := s.Storer.(copyUpdater)
+	if !ok {
+		return 0, errors.New("copy updates not supported")
+	}
+	return updater.UpdateCopies(ctx, field, source, rate, batch)
+}
+
+// Insert implements resource.Storer interface. The ids of the items in the
+// trash stay taken until they are purged: inserting one, with a PUT, fails
+// with a conflict telling to restore the item instead.
+func (s softDeleteStorer) Insert(ctx context.Context, items []*resource.Item) error {
+	err := s.Storer.Insert(ctx, items)
+	if err != resource.ErrConflict {
+		return err
+	}
+	ids := []schema.Value{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.In{Field: "id", Values: ids}})
+	list, ferr := s.Find(withTrashMode(ctx, trashOnly), lookup, 1, len(ids))
+	if ferr != nil || len(list.Items) == 0 {
+		return err
+	}
+	return &resource.Error{
+		Code:    http.StatusConflict,
+		Message: fmt.Sprintf("Item %v is in the trash, restore it instead", list.Items[0].ID),
+	}
+}
+
+// Delete implements resource.Storer interface
+func (s softDeleteStorer) Delete(ctx context.Context, item *resource.Item) error {
+	payload := map[string]interface{}{}
+	for k, v := range item.Payload {
+		payload[k] = v
+	}
+	payload["deleted_at"] = s.clock.Now()
+	if actor, ok := ActorFromContext(ctx); ok {
+		payload["deleted_by"] = actor
+	}
+	deleted, err := resource.NewItem(payload)
+	if err != nil {
+		return err
+	}
+	return s.Storer.Update(ctx, deleted, item)
+}
+
+// Clear implements resource.Storer interface
+func (s softDeleteStorer) Clear(ctx context.Context, lookup *resource.Lookup) (int, error) {
+	deleted := 0
+	for {
+		l := resource.NewLookup()
+		l.AddQuery(lookup.Filter())
+		// Deleted items leave the lookup results, so always read the first page
+		list, err := s.Find(withTrashMode(ctx, trashHidden), l, 1, 100)
+		if err != nil {
+			return deleted, err
+		}
+		if len(list.Items) == 0 {
+			return deleted, nil
+		}
+		for _, item := range list.Items {
+			if err := s.Delete(ctx, item); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+}
+
+// Purge permanently removes an item from the storage
+func (s softDeleteStorer) Purge(ctx context.Context, item *resource.Item) error {
+	return s.Storer.Delete(ctx, item)
+}
+
+// trashBin serves the trash of the soft deleted resources and purges it
+type trashBin struct {
+	users     *resource.Resource
+	resources map[string]*resource.Resource
+	storers   map[string]softDeleteStorer
+	// userFields holds the field storing the owner of each resource items
+	userFields map[string]string
+	clock      clock
+	// onPurge functions are called after an item is purged
+	onPurge []func(ctx context.Context, res string, item *resource.Item)
+}
+
+func newTrashBin(users *resource.Resource, c clock) *trashBin {
+	return &trashBin{
+		users:      users,
+		resources:  map[string]*resource.Resource{},
+		storers:    map[string]softDeleteStorer{},
+		userFields: map[string]string{},
+		clock:      c,
+	}
+}
+
+// Wrap returns a soft delete version of s for the name resource
+func (t *trashBin) Wrap(name, userField string, s resource.Storer) resource.Storer {
+	sd := softDeleteStorer{Storer: s, clock: t.clock}
+	t.storers[name] = sd
+	t.userFields[name] = userField
+	return sd
+}
+
+// Resources returns the names of the soft deleted resources
+func (t *trashBin) Resources() []string {
+	names := []string{}
+	for name := range t.storers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// authorize returns the authenticated user. Owners only see their own items
+// in the trash, admins see everything.
+func (t *trashBin) authorize(w http.ResponseWriter, r *http.Request) (*resource.Item, bool) {
+	user, found := UserFromToken(t.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return nil, false
+	}
+	return user, true
+}
+
+// List serves GET /{resource}/trash
+func (t *trashBin) List(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	user, ok := t.authorize(w, r)
+	if !ok {
+		return
+	}
+	lookup := resource.NewLookup()
+	if !hasRole(user, "admin") {
+		lookup.AddQuery(schema.Query{schema.Equal{Field: t.userFields[a.Resource], Value: user.ID}})
+	}
+	if err := lookup.SetSort("-deleted_at", t.resources[a.Resource].Validator()); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	page, perPage := pagination(r, 20)
+	ctx := withTrashMode(r.Context(), trashOnly)
+	list, err := t.storers[a.Resource].Find(ctx, lookup, page, perPage)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeItems(w, list)
+}
+
+// Restore serves POST /{resource}/{id}/restore
+func (t *trashBin) Restore(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+	user, ok := t.authorize(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: a.ID}})
+	list, err := t.storers[a.Resource].Find(withTrashMode(ctx, trashOnly), lookup, 1, 1)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	if len(list.Items) == 0 {
+		writeResourceError(w, resource.ErrNotFound)
+		return
+	}
+	original := list.Items[0]
+	if !hasRole(user, "admin") && original.Payload[t.userFields[a.Resource]] != user.ID {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	payload := map[string]interface{}{}
+	for k, v := range original.Payload {
+		payload[k] = v
+	}
+	delete(payload, "deleted_at")
+	delete(payload, "deleted_by")
+	payload["updated"] = t.clock.Now()
+	item, err := resource.NewItem(payload)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	// Go through the resource so the update hooks see the restored item
+	ctx = NewContextWithSystemActor(ctx, fmt.Sprint(user.ID))
+	if err := t.resources[a.Resource].Update(ctx, r, item, original); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeItem(w, http.StatusOK, item)
+}
+
+// Purge permanently removes the items deleted before the retention window.
+// The items failing to be purged are left for the next purge.
+func (t *trashBin) Purge(ctx context.Context, retention time.Duration) {
+	before := t.clock.Now().Add(-retention)
+	ctx = withTrashMode(NewContextWithSystemActor(ctx, "trash"), trashOnly)
+	for name, storer := range t.storers {
+		purged := 0
+		q := schema.Query{schema.LowerThan{Field: "deleted_at", Value: before}}
+		err := scan(ctx, storer, t.resources[name].Validator(), q, func(items []*resource.Item) error {
+			for _, item := range items {
+				if err := storer.Purge(ctx, item); err != nil {
+					log.Printf("Can't purge %s/%v: %s", name, item.ID, err)
+					continue
+				}
+				for _, fn := range t.onPurge {
+					fn(ctx, name, item)
+				}
+				purged++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Can't list %s trash: %s", name, err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d items from %s trash", purged, name)
+		}
+	}
+}
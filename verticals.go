@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+// maxInt32 bounds the numbers without a natural maximum
+const maxInt32 = 1<<31 - 1
+
+// timeField is a filterable and sortable time in any of the source formats
+var timeField = schema.Field{
+	Filterable: true,
+	Sortable:   true,
+	Validator:  sourceTime{},
+}
+
+// feedVerticals holds the schema of the payload of each feed vertical, kept
+// in the feed field named after the vertical and selected by feed_type.
+// Their fields are filtered with dotted paths like movie.year. The place of
+// an item isn't a vertical: any item may have one.
+var feedVerticals = map[string]*schema.Schema{
+	"video": {
+		Fields: schema.Fields{
+			"url":       {Required: true, Validator: &schema.String{}},
+			"provider":  {Filterable: true, Validator: &schema.String{}},
+			"thumbnail": {Validator: &schema.String{}},
+			// duration is in seconds
+			"duration": {Filterable: true, Sortable: true, Validator: &schema.Integer{Boundaries: &schema.Boundaries{Min: 0, Max: maxInt32}}},
+			"width":    {Validator: &schema.Integer{}},
+			"height":   {Validator: &schema.Integer{}},
+		},
+	},
+	"news": {
+		Fields: schema.Fields{
+			"source":    {Required: true, Filterable: true, Validator: &schema.String{}},
+			"author":    {Filterable: true, Validator: &schema.String{}},
+			"published": timeField,
+		},
+	},
+	"photo": {
+		Fields: schema.Fields{
+			"url":     {Required: true, Validator: &schema.String{}},
+			"caption": {Validator: &schema.String{}},
+			"credit":  {Filterable: true, Validator: &schema.String{}},
+			"width":   {Validator: &schema.Integer{}},
+			"height":  {Validator: &schema.Integer{}},
+		},
+	},
+	"product": {
+		Fields: schema.Fields{
+			"name":     {Required: true, Filterable: true, Validator: &schema.String{}},
+			"brand":    {Filterable: true, Validator: &schema.String{}},
+			"price":    {Filterable: true, Sortable: true, Validator: &schema.Float{Boundaries: &schema.Boundaries{Min: 0, Max: maxInt32}}},
+			"currency": {Filterable: true, Validator: &schema.String{MinLen: 3, MaxLen: 3}},
+			"availability": {
+				Filterable: true,
+				Validator: &schema.String{
+					Allowed: []string{"in_stock", "out_of_stock", "preorder"},
+				},
+			},
+			"url": {Validator: &schema.String{}},
+		},
+	},
+	"movie": {
+		Fields: schema.Fields{
+			"title":    {Required: true, Filterable: true, Validator: &schema.String{}},
+			"year":     {Filterable: true, Sortable: true, Validator: &schema.Integer{Boundaries: &schema.Boundaries{Min: 1870, Max: 3000}}},
+			"director": {Filterable: true, Validator: &schema.String{}},
+			"genres":   {Filterable: true, Validator: &schema.Array{ValuesValidator: &schema.String{}}},
+			"rating":   {Filterable: true, Sortable: true, Validator: &schema.Float{Boundaries: &schema.Boundaries{Min: 0, Max: 10}}},
+			// runtime is in minutes
+			"runtime": {Validator: &schema.Integer{}},
+		},
+	},
+	"trip": {
+		Fields: schema.Fields{
+			"origin":      {Filterable: true, Validator: &schema.String{}},
+			"destination": {Required: true, Filterable: true, Validator: &schema.String{}},
+			"start":       timeField,
+			"end":         timeField,
+			"price":       {Filterable: true, Sortable: true, Validator: &schema.Float{Boundaries: &schema.Boundaries{Min: 0, Max: maxInt32}}},
+		},
+	},
+	"job": {
+		Fields: schema.Fields{
+			"title":    {Required: true, Filterable: true, Validator: &schema.String{}},
+			"company":  {Filterable: true, Validator: &schema.String{}},
+			"location": {Filterable: true, Validator: &schema.String{}},
+			"remote":   {Filterable: true, Validator: &schema.Bool{}},
+			"contract": {
+				Filterable: true,
+				Validator: &schema.String{
+					Allowed: []string{"full_time", "part_time", "contract", "internship", "temporary"},
+				},
+			},
+			"salary_min": {Filterable: true, Sortable: true, Validator: &schema.Float{}},
+			"salary_max": {Filterable: true, Sortable: true, Validator: &schema.Float{}},
+			"currency":   {Validator: &schema.String{MinLen: 3, MaxLen: 3}},
+		},
+	},
+	"weather": {
+		Fields: schema.Fields{
+			"location": {Required: true, Filterable: true, Validator: &schema.String{}},
+			// temperature is in degrees Celsius
+			"temperature": {Filterable: true, Sortable: true, Validator: &schema.Float{}},
+			"condition":   {Filterable: true, Validator: &schema.String{}},
+			"humidity":    {Validator: &schema.Integer{Boundaries: &schema.Boundaries{Min: 0, Max: 100}}},
+			// wind is in km/h
+			"wind":        {Validator: &schema.Float{}},
+			"forecast_at": timeField,
+		},
+	},
+	"music": {
+		Fields: schema.Fields{
+			"title":  {Required: true, Filterable: true, Validator: &schema.String{}},
+			"artist": {Filterable: true, Validator: &schema.String{}},
+			"album":  {Filterable: true, Validator: &schema.String{}},
+			"genre":  {Filterable: true, Validator: &schema.String{}},
+			// duration is in seconds
+			"duration": {Validator: &schema.Integer{}},
+		},
+	},
+	"book": {
+		Fields: schema.Fields{
+			"title":     {Required: true, Filterable: true, Validator: &schema.String{}},
+			"author":    {Filterable: true, Validator: &schema.String{}},
+			"isbn":      {Filterable: true, Validator: &schema.String{MinLen: 10, MaxLen: 17}},
+			"publisher": {Filterable: true, Validator: &schema.String{}},
+			"year":      {Filterable: true, Sortable: true, Validator: &schema.Integer{}},
+		},
+	},
+	"flight": {
+		Fields: schema.Fields{
+			"number":      {Required: true, Filterable: true, Validator: &schema.String{}},
+			"airline":     {Filterable: true, Validator: &schema.String{}},
+			"origin":      {Required: true, Filterable: true, Validator: &schema.String{}},
+			"destination": {Required: true, Filterable: true, Validator: &schema.String{}},
+			"departure":   timeField,
+			"arrival":     timeField,
+			"status": {
+				Filterable: true,
+				Validator: &schema.String{
+					Allowed: []string{"scheduled", "delayed", "departed", "landed", "cancelled"},
+				},
+			},
+		},
+	},
+	"tv": {
+		Fields: schema.Fields{
+			"show":    {Required: true, Filterable: true, Validator: &schema.String{}},
+			"channel": {Filterable: true, Validator: &schema.String{}},
+			"season":  {Filterable: true, Validator: &schema.Integer{}},
+			"episode": {Filterable: true, Validator: &schema.Integer{}},
+			"airs_at": timeField,
+		},
+	},
+	"health": {
+		Fields: schema.Fields{
+			"topic":       {Required: true, Filterable: true, Validator: &schema.String{}},
+			"source":      {Filterable: true, Validator: &schema.String{}},
+			"reviewed_by": {Validator: &schema.String{}},
+		},
+	},
+	"trends": {
+		Fields: schema.Fields{
+			"keyword": {Required: true, Filterable: true, Validator: &schema.String{}},
+			"region":  {Filterable: true, Validator: &schema.String{}},
+			"rank":    {Filterable: true, Sortable: true, Validator: &schema.Integer{}},
+			"volume":  {Filterable: true, Sortable: true, Validator: &schema.Integer{}},
+		},
+	},
+	"stars": {
+		Fields: schema.Fields{
+			"name":       {Required: true, Filterable: true, Validator: &schema.String{}},
+			"profession": {Filterable: true, Validator: &schema.String{}},
+		},
+	},
+	"funny": {
+		Fields: schema.Fields{
+			"kind": {
+				Filterable: true,
+				Validator: &schema.String{
+					Allowed: []string{"joke", "meme", "gif", "video"},
+				},
+			},
+			"text": {Validator: &schema.String{}},
+			"url":  {Validator: &schema.String{}},
+		},
+	},
+	"things": {
+		Fields: schema.Fields{
+			"name":        {Required: true, Filterable: true, Validator: &schema.String{}},
+			"description": {Validator: &schema.String{}},
+			"url":         {Validator: &schema.String{}},
+		},
+	},
+}
+
+// feedTypes are the values of feed_type: the verticals, and event for the
+// items referencing an event in their event field
+var feedTypes = func() []string {
+	types := []string{"event"}
+	for name := range feedVerticals {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}()
+
+// verticalField returns the feed field holding the payload of a vertical
+func verticalField(name string) schema.Field {
+	return schema.Field{
+		Filterable: true,
+		Validator: &schema.Object{
+			Schema: feedVerticals[name],
+		},
+	}
+}
+
+// feedTypeHook checks the feed items hold the field of their feed_type
+// vertical and no other. Items without feed_type have no vertical.
+type feedTypeHook struct{}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (h feedTypeHook) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	for _, item := range items {
+		if err := h.check(item.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface. Only the
+// updates changing the feed_type or a vertical are checked, for the items
+// stored before the check to stay editable.
+func (h feedTypeHook) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	for _, name := range append([]string{"feed_type"}, feedTypes...) {
+		if !reflect.DeepEqual(item.Payload[name], original.Payload[name]) {
+			return h.check(item.Payload)
+		}
+	}
+	return nil
+}
+
+func (h feedTypeHook) check(payload map[string]interface{}) error {
+	typ, _ := payload["feed_type"].(string)
+	issues := map[string][]interface{}{}
+	for _, name := range feedTypes {
+		_, found := payload[name]
+		if name == typ && !found {
+			issues[name] = []interface{}{fmt.Sprintf("required by feed_type %s", typ)}
+		} else if name != typ && found {
+			if typ == "" {
+				issues[name] = []interface{}{"not allowed without feed_type"}
+			} else {
+				issues[name] = []interface{}{fmt.Sprintf("not allowed for feed_type %s", typ)}
+			}
+		}
+	}
+	if len(issues) > 0 {
+		return &resource.Error{Code: 422, Message: "Document contains error(s)", Issues: issues}
+	}
+	return nil
+}
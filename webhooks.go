@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	webhookWorkers       = flag.Int("webhook-workers", 4, "Number of concurrent webhook deliveries")
+	webhookQueueSize     = flag.Int("webhook-queue-size", 1000, "Maximum number of events waiting to be delivered to the webhooks, further events are dropped")
+	webhookTimeout       = flag.Duration("webhook-timeout", 10*time.Second, "Timeout of a webhook delivery attempt")
+	webhookMaxAttempts   = flag.Int("webhook-max-attempts", 5, "Maximum number of attempts to deliver an event to a webhook")
+	webhookBackoff       = flag.Duration("webhook-backoff", time.Second, "Delay before the first retry of a failed webhook delivery, doubled on each retry")
+	webhookRetryInterval = flag.Duration("webhook-retry-interval", time.Second, "Interval between two checks for the webhook deliveries due for a retry")
+	webhookDisableAfter  = flag.Int("webhook-disable-after", 10, "Number of consecutive failed deliveries after which a webhook is disabled")
+)
+
+var (
+	webhook = schema.Schema{
+		Fields: schema.Fields{
+			"id":      schema.IDField,
+			"created": schema.CreatedField,
+			"updated": schema.UpdatedField,
+			"url": {
+				Required:  true,
+				Validator: &schema.URL{},
+			},
+			// secret is the key of the HMAC signature of the deliveries
+			"secret": {
+				Required:  true,
+				Hidden:    true,
+				Validator: &schema.String{MinLen: 16},
+			},
+			// resources limits the deliveries to the events of these resources
+			"resources": {
+				Filterable: true,
+				Validator: &schema.Array{
+					ValuesValidator: &schema.String{},
+				},
+			},
+			// events limits the deliveries to these events
+			"events": {
+				Filterable: true,
+				Validator: &schema.Array{
+					ValuesValidator: &schema.String{
+						Allowed: []string{"insert", "update", "delete"},
+					},
+				},
+			},
+			"active": {
+				Filterable: true,
+				Default:    true,
+				Validator:  &schema.Bool{},
+			},
+			// failures counts the consecutive failed deliveries
+			"failures": {
+				ReadOnly:  true,
+				Validator: &schema.Integer{},
+			},
+			"last_error": {
+				ReadOnly:  true,
+				Validator: &schema.String{},
+			},
+			"disabled_at": {
+				ReadOnly:  true,
+				Validator: &schema.Time{},
+			},
+		},
+	}
+
+	// webhookDelivery is a delivery attempt of an event to a webhook
+	webhookDelivery = schema.Schema{
+		Fields: schema.Fields{
+			"id": schema.IDField,
+			"created": {
+				ReadOnly:   true,
+				Filterable: true,
+				Sortable:   true,
+				OnInit:     schema.Now,
+				Validator:  &schema.Time{},
+			},
+			"webhook": {
+				Filterable: true,
+				Validator:  &schema.String{},
+			},
+			"event_id": {
+				Filterable: true,
+				Validator:  &schema.String{},
+			},
+			"event": {
+				Filterable: true,
+				Validator:  &schema.String{},
+			},
+			"resource": {
+				Filterable: true,
+				Validator:  &schema.String{},
+			},
+			"item_id": {
+				Filterable: true,
+				Validator:  &schema.String{},
+			},
+			"attempt": {
+				Validator: &schema.Integer{},
+			},
+			"status_code": {
+				Filterable: true,
+				Validator:  &schema.Integer{},
+			},
+			"error": {
+				Validator: &schema.String{},
+			},
+			"duration_ms": {
+				Validator: &schema.Integer{},
+			},
+			"success": {
+				Filterable: true,
+				Validator:  &schema.Bool{},
+			},
+			// next_attempt is set on the failed or undelivered attempts to
+			// retry, until a worker takes them
+			"next_attempt": {
+				Filterable: true,
+				Sortable:   true,
+				Validator:  &schema.Time{},
+			},
+			// payload is the event to retry
+			"payload": {
+				Validator: &schema.Dict{},
+			},
+		},
+	}
+)
+
+// webhookRetryBatch is the maximum number of retries queued at once
+const webhookRetryBatch = 100
+
+// webhookEvent is the payload delivered to the webhooks
+type webhookEvent struct {
+	ID         string                 `json:"id"`
+	Event      string                 `json:"event"`
+	Resource   string                 `json:"resource"`
+	ItemID     string                 `json:"item_id"`
+	Item       map[string]interface{} `json:"item"`
+	Actor      string                 `json:"actor,omitempty"`
+	OccurredAt time.Time              `json:"occurred_at"`
+}
+
+// webhookJob is a queued delivery: a new event to deliver to the matching
+// webhooks, or a retry for a single webhook
+type webhookJob struct {
+	event webhookEvent
+	// hook is the webhook of a retry, nil for new events
+	hook    *resource.Item
+	attempt int
+}
+
+// newEventID returns a random event ID
+func newEventID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// webhookDispatcher delivers the resource events to the registered webhooks
+// in the background. Deliveries are POST requests with the JSON event as
+// body, signed in the X-Webhook-Signature header with the HMAC-SHA256 of
+// "{X-Webhook-Timestamp}.{body}" keyed by the webhook secret. Failed
+// deliveries are retried with an exponential backoff, every attempt is
+// logged in /webhooks/{id}/deliveries and webhooks failing too many times
+// in a row are disabled. Retries are stored in the delivery log with their
+// next_attempt time and queued again by Retry, so workers don't wait for
+// them, and the events still queued on shutdown are stored the same way.
+type webhookDispatcher struct {
+	webhooks   resource.Storer
+	deliveries *resource.Resource
+	// deliveryStorer stores the delivery log, written without going through
+	// the read-only deliveries resource
+	deliveryStorer resource.Storer
+	client         *http.Client
+	queue          chan webhookJob
+	clock          clock
+	maxAttempts    int
+	backoff        time.Duration
+	disableAfter   int
+	// mu serializes the updates of the webhooks failure counters
+	mu sync.Mutex
+}
+
+// Hook returns the hook emitting the events of the name resource
+func (d *webhookDispatcher) Hook(name string) webhookHook {
+	return webhookHook{dispatcher: d, resource: name}
+}
+
+// Enqueue schedules the delivery of an event without blocking. The event is
+// dropped if the queue is full.
+func (d *webhookDispatcher) Enqueue(ctx context.Context, event, res string, item *resource.Item) {
+	e := webhookEvent{
+		ID:         newEventID(),
+		Event:      event,
+		Resource:   res,
+		ItemID:     fmt.Sprint(item.ID),
+		Item:       item.Payload,
+		OccurredAt: d.clock.Now(),
+	}
+	e.Actor, _ = ActorFromContext(ctx)
+	select {
+	case d.queue <- webhookJob{event: e, attempt: 1}:
+	default:
+		log.Printf("Webhook queue full, dropping %s %s/%s event", event, res, e.ItemID)
+	}
+}
+
+// Run delivers the queued events until ctx is done, then stores the events
+// left in the queue to be retried on the next start
+func (d *webhookDispatcher) Run(ctx context.Context) {
+	ctx = NewContextWithSystemActor(ctx, "webhooks")
+	for {
+		// Stopping takes precedence over the queued jobs
+		select {
+		case <-ctx.Done():
+			d.drain(detach(ctx))
+			return
+		default:
+		}
+		select {
+		case <-ctx.Done():
+		case job := <-d.queue:
+			d.run(ctx, job)
+		}
+	}
+}
+
+// run delivers a queued job
+func (d *webhookDispatcher) run(ctx context.Context, job webhookJob) {
+	if job.hook != nil {
+		d.deliver(ctx, job.hook, job.event, job.attempt)
+		return
+	}
+	hooks, err := d.match(ctx, job.event)
+	if err != nil {
+		log.Printf("Can't list the webhooks of %s %s event: %s", job.event.Event, job.event.Resource, err)
+		return
+	}
+	for _, hook := range hooks {
+		d.deliver(ctx, hook, job.event, job.attempt)
+	}
+}
+
+// drain stores the jobs left in the queue as pending deliveries
+func (d *webhookDispatcher) drain(ctx context.Context) {
+	n := 0
+	for {
+		select {
+		case job := <-d.queue:
+			d.persist(ctx, job)
+			n++
+		default:
+			if n > 0 {
+				log.Printf("Stored %d undelivered webhook events for later", n)
+			}
+			return
+		}
+	}
+}
+
+// persist stores job as pending deliveries due now
+func (d *webhookDispatcher) persist(ctx context.Context, job webhookJob) {
+	hooks := []*resource.Item{job.hook}
+	if job.hook == nil {
+		var err error
+		if hooks, err = d.match(ctx, job.event); err != nil {
+			log.Printf("Can't list the webhooks of %s %s event: %s", job.event.Event, job.event.Resource, err)
+			return
+		}
+	}
+	for _, hook := range hooks {
+		entry := d.entry(hook, job.event, job.attempt-1)
+		d.retryAt(entry, job.event, d.clock.Now())
+		d.log(ctx, entry)
+	}
+}
+
+// Retry queues the pending deliveries due for a retry. Each is taken by
+// removing its next_attempt, so only one instance retries it.
+func (d *webhookDispatcher) Retry(ctx context.Context) {
+	ctx = NewContextWithSystemActor(ctx, "webhooks")
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.LowerOrEqual{Field: "next_attempt", Value: d.clock.Now()}})
+	if err := lookup.SetSort("next_attempt", d.deliveries.Validator()); err != nil {
+		log.Printf("Can't sort the webhook retries: %s", err)
+		return
+	}
+	list, err := d.deliveryStorer.Find(ctx, lookup, 1, webhookRetryBatch)
+	if err != nil {
+		log.Printf("Can't list the webhook retries: %s", err)
+		return
+	}
+	for _, entry := range list.Items {
+		job, ok := d.take(ctx, entry)
+		if !ok {
+			continue
+		}
+		select {
+		case d.queue <- job:
+		case <-ctx.Done():
+			d.persist(detach(ctx), job)
+			return
+		}
+	}
+}
+
+// take claims a pending delivery and returns its job, false if another
+// instance took it or its webhook is gone or disabled
+func (d *webhookDispatcher) take(ctx context.Context, entry *resource.Item) (webhookJob, bool) {
+	payload := map[string]interface{}{}
+	for k, v := range entry.Payload {
+		payload[k] = v
+	}
+	delete(payload, "next_attempt")
+	delete(payload, "payload")
+	item, err := resource.NewItem(payload)
+	if err == nil {
+		err = d.deliveryStorer.Update(ctx, item, entry)
+	}
+	if err != nil {
+		if err != resource.ErrConflict {
+			log.Printf("Can't take webhook delivery %v: %s", entry.ID, err)
+		}
+		return webhookJob{}, false
+	}
+	job := webhookJob{attempt: intValue(entry.Payload["attempt"]) + 1}
+	b, err := json.Marshal(entry.Payload["payload"])
+	if err == nil {
+		err = json.Unmarshal(b, &job.event)
+	}
+	if err != nil {
+		log.Printf("Invalid webhook delivery %v payload: %s", entry.ID, err)
+		return webhookJob{}, false
+	}
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{
+		schema.Equal{Field: "id", Value: entry.Payload["webhook"]},
+		schema.Equal{Field: "active", Value: true},
+	})
+	list, err := d.webhooks.Find(ctx, lookup, 1, 1)
+	if err != nil || len(list.Items) == 0 {
+		return webhookJob{}, false
+	}
+	job.hook = list.Items[0]
+	return job, true
+}
+
+// match returns the active webhooks interested in e
+func (d *webhookDispatcher) match(ctx context.Context, e webhookEvent) ([]*resource.Item, error) {
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "active", Value: true}})
+	list, err := d.webhooks.Find(ctx, lookup, 1, 1000)
+	if err != nil {
+		return nil, err
+	}
+	hooks := []*resource.Item{}
+	for _, hook := range list.Items {
+		if contains(hook.Payload["resources"], e.Resource) && contains(hook.Payload["events"], e.Event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+// contains tells if the filter list contains value, empty filters matching
+// everything
+func contains(filter interface{}, value string) bool {
+	values, _ := filter.([]interface{})
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver makes an attempt to send e to hook and logs it. Failed attempts
+// are logged with the time of their retry until the last one.
+func (d *webhookDispatcher) deliver(ctx context.Context, hook *resource.Item, e webhookEvent, attempt int) {
+	// The log outlives the attempts interrupted by a shutdown
+	store := detach(ctx)
+	if ctx.Err() != nil {
+		d.persist(store, webhookJob{event: e, hook: hook, attempt: attempt})
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Can't encode %s %s/%s event: %s", e.Event, e.Resource, e.ItemID, err)
+		return
+	}
+	entry := d.entry(hook, e, attempt)
+	err = d.attempt(ctx, hook, e, body, entry)
+	switch {
+	case err == nil:
+		d.result(store, hook.ID, nil)
+	case attempt >= d.maxAttempts:
+		d.result(store, hook.ID, err)
+	default:
+		d.retryAt(entry, e, d.clock.Now().Add(d.backoff<<uint(attempt-1)))
+	}
+	d.log(store, entry)
+}
+
+// entry returns the delivery log entry of an attempt to send e to hook
+func (d *webhookDispatcher) entry(hook *resource.Item, e webhookEvent, attempt int) map[string]interface{} {
+	return map[string]interface{}{
+		"webhook":  fmt.Sprint(hook.ID),
+		"event_id": e.ID,
+		"event":    e.Event,
+		"resource": e.Resource,
+		"item_id":  e.ItemID,
+		"attempt":  attempt,
+	}
+}
+
+// retryAt marks the delivery log entry as pending a retry of e at t
+func (d *webhookDispatcher) retryAt(entry map[string]interface{}, e webhookEvent, t time.Time) {
+	payload := map[string]interface{}{}
+	if b, err := json.Marshal(e); err == nil {
+		json.Unmarshal(b, &payload)
+	}
+	entry["next_attempt"] = t
+	entry["payload"] = payload
+}
+
+// attempt makes one delivery attempt, recording its outcome in entry
+func (d *webhookDispatcher) attempt(ctx context.Context, hook *resource.Item, e webhookEvent, body []byte, entry map[string]interface{}) error {
+	url, _ := hook.Payload["url"].(string)
+	secret, _ := hook.Payload["secret"].(string)
+	timestamp := strconv.FormatInt(d.clock.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	start := time.Now()
+	err := func() error {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", serviceName)
+		req.Header.Set("X-Webhook-Event", e.Event)
+		req.Header.Set("X-Webhook-Delivery", e.ID)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		res, err := d.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		entry["status_code"] = res.StatusCode
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("unexpected status %d", res.StatusCode)
+		}
+		return nil
+	}()
+	entry["duration_ms"] = int(time.Since(start) / time.Millisecond)
+	entry["success"] = err == nil
+	if err != nil {
+		entry["error"] = err.Error()
+	}
+	return err
+}
+
+// log appends a delivery attempt to the delivery log
+func (d *webhookDispatcher) log(ctx context.Context, payload map[string]interface{}) {
+	sch := d.deliveries.Schema()
+	changes, base := sch.Prepare(ctx, payload, nil, false)
+	doc, errs := sch.Validate(changes, base)
+	if len(errs) > 0 {
+		log.Printf("Invalid webhook delivery log entry: %v", errs)
+		return
+	}
+	item, err := resource.NewItem(doc)
+	if err == nil {
+		err = d.deliveryStorer.Insert(ctx, []*resource.Item{item})
+	}
+	if err != nil {
+		log.Printf("Can't log webhook delivery: %s", err)
+	}
+}
+
+// result updates the failure counter of the hookID webhook after a
+// delivery, disabling it after too many failures
+func (d *webhookDispatcher) result(ctx context.Context, hookID interface{}, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lookup := resource.NewLookup()
+	lookup.AddQuery(schema.Query{schema.Equal{Field: "id", Value: hookID}})
+	list, e := d.webhooks.Find(ctx, lookup, 1, 1)
+	if e != nil || len(list.Items) == 0 {
+		return
+	}
+	original := list.Items[0]
+	failures := intValue(original.Payload["failures"])
+	if err == nil && failures == 0 {
+		return
+	}
+	payload := map[string]interface{}{}
+	for k, v := range original.Payload {
+		payload[k] = v
+	}
+	if err == nil {
+		payload["failures"] = 0
+	} else {
+		failures++
+		payload["failures"] = failures
+		payload["last_error"] = err.Error()
+		if failures >= d.disableAfter {
+			payload["active"] = false
+			payload["disabled_at"] = d.clock.Now()
+			log.Printf("Disabling webhook %v after %d failed deliveries", hookID, failures)
+		}
+	}
+	item, e := resource.NewItem(payload)
+	if e == nil {
+		e = d.webhooks.Update(ctx, item, original)
+	}
+	if e != nil {
+		log.Printf("Can't update webhook %v: %s", hookID, e)
+	}
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface, resetting the
+// failure counter of re-enabled webhooks
+func (d *webhookDispatcher) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	if item.Payload["active"] == true && original.Payload["active"] == false {
+		delete(item.Payload, "failures")
+		delete(item.Payload, "disabled_at")
+		delete(item.Payload, "last_error")
+	}
+	return nil
+}
+
+// intValue returns the integer value of a field, which is a float64 when
+// decoded from JSON by the storage
+func intValue(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// webhookHook emits the events of a resource to the webhooks
+type webhookHook struct {
+	dispatcher *webhookDispatcher
+	resource   string
+}
+
+// OnInserted implements resource.InsertedEventHandler interface
+func (h webhookHook) OnInserted(ctx context.Context, r *http.Request, items []*resource.Item, err *error) {
+	if *err != nil {
+		return
+	}
+	for _, item := range items {
+		h.dispatcher.Enqueue(ctx, "insert", h.resource, item)
+	}
+}
+
+// OnUpdated implements resource.UpdatedEventHandler interface
+func (h webhookHook) OnUpdated(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item, err *error) {
+	if *err == nil {
+		h.dispatcher.Enqueue(ctx, "update", h.resource, item)
+	}
+}
+
+// OnDeleted implements resource.DeletedEventHandler interface
+func (h webhookHook) OnDeleted(ctx context.Context, r *http.Request, item *resource.Item, err *error) {
+	if *err == nil {
+		h.dispatcher.Enqueue(ctx, "delete", h.resource, item)
+	}
+}
+
+// detachedContext keeps the values of its parent but is never canceled, so
+// background work started by a request can outlive it
+type detachedContext struct {
+	context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
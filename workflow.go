@@ -0,0 +1,263 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cool-rest/rest-layer/resource"
+	"github.com/cool-rest/rest-layer/schema"
+	"golang.org/x/net/context"
+)
+
+var (
+	workflowSpec      = flag.String("workflow", "draft>review=owner|editor,review>published=editor,review>draft=editor,published>archived=editor,archived>draft=editor", "Editorial status transitions as from>to=role|role, the first state being the initial one. The owner role is the item author, admins may perform any transition.")
+	workflowResources = flag.String("workflow-resources", "feed,news,video,photo", "Comma separated list of the resources whose status follows the editorial workflow")
+)
+
+// transition is a change of status
+type transition struct {
+	from, to string
+}
+
+// workflow is the editorial state machine of the content status. Status
+// changes made by updates are checked against the allowed transitions and
+// the roles of the user, and recorded in the item status_history.
+type workflow struct {
+	initial string
+	states  []string
+	// transitions holds the roles allowed to perform each transition
+	transitions map[transition][]string
+	users       *resource.Resource
+	resources   map[string]*resource.Resource
+	// userField is the field storing the owner of the items
+	userField string
+	clock     clock
+}
+
+// newWorkflow parses the from>to=role|role,... transitions of spec
+func newWorkflow(spec string, users *resource.Resource, c clock) (*workflow, error) {
+	wf := &workflow{
+		transitions: map[transition][]string{},
+		users:       users,
+		resources:   map[string]*resource.Resource{},
+		userField:   "user",
+		clock:       c,
+	}
+	seen := map[string]bool{}
+	for _, def := range strings.Split(spec, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		parts := strings.SplitN(def, "=", 2)
+		states := strings.SplitN(parts[0], ">", 2)
+		if len(parts) != 2 || len(states) != 2 || states[0] == "" || states[1] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid transition %q", def)
+		}
+		t := transition{from: states[0], to: states[1]}
+		if _, found := wf.transitions[t]; found {
+			return nil, fmt.Errorf("duplicate transition %q", def)
+		}
+		wf.transitions[t] = strings.Split(parts[1], "|")
+		for _, state := range states {
+			if !seen[state] {
+				seen[state] = true
+				wf.states = append(wf.states, state)
+			}
+		}
+	}
+	if len(wf.states) == 0 {
+		return nil, fmt.Errorf("no transition")
+	}
+	wf.initial = wf.states[0]
+	return wf, nil
+}
+
+// Fields returns the fields holding the workflow state
+func (wf *workflow) Fields() schema.Fields {
+	return schema.Fields{
+		"status": {
+			Filterable: true,
+			Sortable:   true,
+			Default:    wf.initial,
+			Validator:  &schema.String{Allowed: wf.states},
+		},
+		"status_history": {
+			ReadOnly: true,
+			Validator: &schema.Array{
+				ValuesValidator: &schema.Object{
+					Schema: &schema.Schema{
+						Fields: schema.Fields{
+							"from": {Validator: &schema.String{}},
+							"to":   {Validator: &schema.String{}},
+							"at":   {Validator: &schema.Time{}},
+							"by":   {Validator: &schema.String{}},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// Use adds the workflow to res
+func (wf *workflow) Use(res *resource.Resource) {
+	wf.resources[res.Name()] = res
+	res.Use(traceHook("workflow", wf))
+}
+
+// Resources returns the names of the resources following the workflow
+func (wf *workflow) Resources() []string {
+	names := []string{}
+	for name := range wf.resources {
+		names = append(names, name)
+	}
+	return names
+}
+
+// sources returns the statuses with a transition to status
+func (wf *workflow) sources(status string) []string {
+	sources := []string{}
+	for _, state := range wf.states {
+		if _, found := wf.transitions[transition{state, status}]; found {
+			sources = append(sources, state)
+		}
+	}
+	return sources
+}
+
+// roles returns the workflow roles of user on item
+func (wf *workflow) roles(user, item *resource.Item) []string {
+	roles := []string{}
+	if item.Payload[wf.userField] == user.ID {
+		roles = append(roles, "owner")
+	}
+	granted, _ := user.Payload["roles"].([]interface{})
+	for _, r := range granted {
+		if role, ok := r.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// allow checks that the from to to transition exists and can be performed
+// with one of roles
+func (wf *workflow) allow(from, to string, roles []string) error {
+	allowed, found := wf.transitions[transition{from, to}]
+	if !found {
+		return &resource.Error{Code: 422, Message: fmt.Sprintf("Invalid status transition from %s to %s", from, to)}
+	}
+	for _, role := range roles {
+		if role == "admin" {
+			return nil
+		}
+		for _, a := range allowed {
+			if role == a {
+				return nil
+			}
+		}
+	}
+	return resource.ErrForbidden
+}
+
+// OnInsert implements resource.InsertEventHandler interface
+func (wf *workflow) OnInsert(ctx context.Context, r *http.Request, items []*resource.Item) error {
+	if isSystemContext(ctx) {
+		return nil
+	}
+	for _, item := range items {
+		if status, found := item.Payload["status"]; found && status != wf.initial {
+			return &resource.Error{Code: 422, Message: fmt.Sprintf("Items must be created with the %s status", wf.initial)}
+		}
+	}
+	return nil
+}
+
+// OnUpdate implements resource.UpdateEventHandler interface
+func (wf *workflow) OnUpdate(ctx context.Context, r *http.Request, item *resource.Item, original *resource.Item) error {
+	from, _ := original.Payload["status"].(string)
+	to, _ := item.Payload["status"].(string)
+	if from == to {
+		return nil
+	}
+	actor, _ := ActorFromContext(ctx)
+	if isSystemContext(ctx) {
+		// Internal operations are authorized by their caller but still have
+		// to follow the workflow
+		if err := wf.allow(from, to, []string{"admin"}); err != nil {
+			return err
+		}
+	} else {
+		user, found := UserFromToken(wf.users, ctx, r)
+		if !found {
+			return resource.ErrUnauthorized
+		}
+		if err := wf.allow(from, to, wf.roles(user, original)); err != nil {
+			return err
+		}
+		actor = fmt.Sprint(user.ID)
+	}
+	history, _ := original.Payload["status_history"].([]interface{})
+	item.Payload["status_history"] = append(append([]interface{}{}, history...), map[string]interface{}{
+		"from": from,
+		"to":   to,
+		"at":   wf.clock.Now(),
+		"by":   actor,
+	})
+	return nil
+}
+
+// Transition serves POST /{resource}/{id}/transition, moving the item to the
+// status given as {"to": status}. Unlike updates, transitions are not
+// restricted to the item owner: editors use it to review others' items.
+func (wf *workflow) Transition(w http.ResponseWriter, r *http.Request, a action) {
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+	user, found := UserFromToken(wf.users, r.Context(), r)
+	if !found {
+		writeResourceError(w, resource.ErrUnauthorized)
+		return
+	}
+	var body struct {
+		To string `json:"to"`
+	}
+	if !decodePayload(w, r, &body) {
+		return
+	}
+	if body.To == "" {
+		writeError(w, 422, "Missing target status")
+		return
+	}
+	res := wf.resources[a.Resource]
+	ctx := NewContextWithSystemActor(r.Context(), fmt.Sprint(user.ID))
+	original, err := res.Get(ctx, r, a.ID)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	from, _ := original.Payload["status"].(string)
+	if err := wf.allow(from, body.To, wf.roles(user, original)); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	payload := map[string]interface{}{}
+	for k, v := range original.Payload {
+		payload[k] = v
+	}
+	payload["status"] = body.To
+	payload["updated"] = wf.clock.Now()
+	item, err := resource.NewItem(payload)
+	if err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	if err := res.Update(ctx, r, item, original); err != nil {
+		writeResourceError(w, err)
+		return
+	}
+	writeItem(w, http.StatusOK, item)
+}